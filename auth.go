@@ -0,0 +1,85 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// Signed packet contents
+// Bytes 00-NN   The packet
+// Bytes NN+1... HMAC-SHA256 of the packet, keyed with the message secret
+//               (32 bytes)
+
+// The number of bytes that signing adds to a packet.
+const signatureSize = sha256.Size
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// RejectedMessages returns the number of packets that have been rejected
+// because they failed verification: their checksum was wrong, their
+// signature didn't match the message secret, or they couldn't be decrypted.
+// Multicast announcements that can't be read are counted too.
+func (c *Cluster) RejectedMessages() uint64 {
+	return c.rejectedMessages.Load()
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// signPacket appends the signature of packet, if we have a message secret.
+func (c *Cluster) signPacket(packet []byte) []byte {
+	secret := c.GetMessageSecret()
+	if secret == "" {
+		return packet
+	}
+
+	return append(packet, signature(secret, packet)...)
+}
+
+// verifyPacket checks the signature of packet, if we have a message secret,
+// and returns the packet without it.
+func (c *Cluster) verifyPacket(packet []byte) ([]byte, error) {
+	secret := c.GetMessageSecret()
+	if secret == "" {
+		return packet, nil
+	}
+
+	if len(packet) < signatureSize {
+		return nil, errors.New("signed packet too short")
+	}
+
+	signed := packet[:len(packet)-signatureSize]
+
+	if !hmac.Equal(packet[len(signed):], signature(secret, signed)) {
+		return nil, errors.New("packet signature mismatch")
+	}
+
+	return signed, nil
+}
+
+func signature(secret string, packet []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(packet)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport/memtransport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerifyPacket(t *testing.T) {
+	c := NewCluster()
+	c.SetMessageSecret("open sesame")
+
+	packet := []byte("a message of some kind")
+
+	signed := c.signPacket(append([]byte(nil), packet...))
+	require.Len(t, signed, len(packet)+signatureSize)
+
+	verified, err := c.verifyPacket(signed)
+	require.NoError(t, err)
+	require.Equal(t, packet, verified)
+
+	// Tampering is detected.
+	signed[0] ^= 0xFF
+	_, err = c.verifyPacket(signed)
+	require.Error(t, err)
+
+	// So is another secret.
+	other := NewCluster()
+	other.SetMessageSecret("open barley")
+	_, err = other.verifyPacket(other.signPacket(packet))
+	require.NoError(t, err)
+	_, err = c.verifyPacket(other.signPacket(packet))
+	require.Error(t, err)
+
+	_, err = c.verifyPacket(packet[:4])
+	require.Error(t, err)
+}
+
+func TestFailedVerificationCounted(t *testing.T) {
+	nw := memtransport.NewNetwork()
+	mt := nw.NewTransport(net.IPv4(10, 0, 19, 2))
+
+	addr, err := mt.ResolveAddr("udp", "10.0.19.2:9999")
+	require.NoError(t, err)
+
+	c := NewCluster()
+	c.SetMessageSecret("open sesame")
+
+	sender := &Node{ip: net.IPv4(10, 0, 19, 2), port: 9999}
+	msg := newMessage(verbPing, sender, 1)
+
+	// A corrupted message fails its checksum.
+	bytes := msg.encode(c.ipLen, c.clusterID())
+	bytes[len(bytes)-1] ^= 0xFF
+
+	_, err = c.decodeMessage(sender.ip, bytes)
+	require.ErrorIs(t, err, errBadChecksum)
+
+	require.Error(t, c.receiveMessage(addr, c.signPacket(bytes)))
+	require.Equal(t, uint64(1), c.RejectedMessages())
+
+	// An unsigned one is rejected before it's decoded.
+	require.Error(t, c.receiveMessage(addr, msg.encode(c.ipLen, c.clusterID())))
+	require.Equal(t, uint64(2), c.RejectedMessages())
+}
+
+func TestFailedMulticastVerificationCounted(t *testing.T) {
+	c := NewCluster()
+	c.thisHost = &Node{ip: net.IPv4(10, 0, 19, 3), port: 9999}
+
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 19, 3), Port: 9998}
+
+	// A corrupted announcement fails its checksum.
+	bytes := c.encodeMulticastAnnounceBytes()
+	bytes[len(bytes)-1] ^= 0xFF
+
+	require.Error(t, c.receiveMulticast(addr, bytes))
+	require.Equal(t, uint64(1), c.RejectedMessages())
+
+	// One that isn't an announcement at all can't be decoded.
+	require.Error(t, c.receiveMulticast(addr, []byte{}))
+	require.Error(t, c.receiveMulticast(addr, []byte{200, 1}))
+	require.Equal(t, uint64(3), c.RejectedMessages())
+}
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"net"
 	"sort"
-	"sync"
 )
 
 const (
@@ -32,27 +31,66 @@ const (
 	broadcastRemoveValue int8 = int8(-100)
 )
 
-// The index counter value for the next broadcast message
-var indexCounter uint32 = 1
+// broadcastKind tells user broadcasts, which are passed to the broadcast
+// listeners, from the ones that the cluster uses internally.
+type broadcastKind uint8
 
-// Emitted broadcasts. Once they are added here, the membership machinery will
-// pick them up and piggyback them onto standard messages.
-var broadcasts = struct {
-	sync.RWMutex
-	m map[string]*Broadcast
-}{m: make(map[string]*Broadcast)}
+const (
+	// A broadcast emitted with BroadcastBytes() or BroadcastString().
+	broadcastUser broadcastKind = iota
+
+	// A cluster-wide keyring operation (see keyringOps.go).
+	broadcastKeyringOp
+
+	// A node's reply to a keyring operation.
+	broadcastKeyringReply
+
+	// A fragment of a user broadcast that is too long to send whole (see
+	// fragment.go).
+	broadcastFragment
+
+	// A query, to be answered by the nodes it is meant for (see query.go).
+	broadcastQuery
+
+	// A user broadcast with a name, which supersedes the earlier broadcasts
+	// of the same name from the same origin (see namedBroadcast.go).
+	broadcastNamed
+
+	// A user broadcast on a topic, which is passed to the subscribers of
+	// that topic only (see topicBroadcast.go).
+	broadcastTopic
+)
 
 // Broadcast represents a packet of bytes emitted across the cluster on top of
-// the status update infrastructure. Although useful, its payload is limited
-// to only 256 bytes.
+// the status update infrastructure. Payloads longer than
+// GetMaxBroadcastBytes() travel as several fragments, and are limited to
+// MaxFragmentedBroadcastBytes.
 type Broadcast struct {
 	bytes       []byte
 	origin      *Node
 	index       uint32
+	epoch       uint64
 	label       string
 	emitCounter int8
+	kind        broadcastKind
+
+	// The name of a named broadcast. It travels in front of its bytes.
+	name string
+
+	// The topic of a topic broadcast. It travels in front of its bytes.
+	topic string
+
+	// Set if the origin asks every node that receives the broadcast to
+	// acknowledge it. It travels in the high bit of the kind byte.
+	ackRequested bool
+
+	// The handle that tracks a broadcast sent by this node.
+	handle *BroadcastHandle
 }
 
+// The bit of the kind byte that asks for acknowledgements.
+const broadcastAckFlag = 0x80
+
 // Bytes returns a copy of this broadcast's bytes. Manipulating the contents
 // of this slice will not be reflected in the contents of the broadcast.
 func (b *Broadcast) Bytes() []byte {
@@ -64,19 +102,24 @@ func (b *Broadcast) Bytes() []byte {
 }
 
 // Index returns the origin message index for this broadcast. This value is
-// incremented for each broadcast. The combination of
-// originIP:originPort:Index is unique.
+// incremented for each broadcast, and starts over whenever the origin is
+// restarted. The combination of originIP:originPort:Epoch:Index is unique.
 func (b *Broadcast) Index() uint32 {
 	return b.index
 }
 
-// Label returns a unique label string composed of originIP:originPort:Index.
+// Epoch returns the epoch of the origin when it sent this broadcast: the
+// time (in nanoseconds since the Unix epoch) at which it was started. It
+// tells apart the broadcasts sent before and after the origin restarted.
+func (b *Broadcast) Epoch() uint64 {
+	return b.epoch
+}
+
+// Label returns a unique label string composed of
+// originIP:originPort:Epoch:Index.
 func (b *Broadcast) Label() string {
 	if b.label == "" {
-		b.label = fmt.Sprintf("%s:%d:%d",
-			b.origin.ip.String(),
-			b.origin.port,
-			b.index)
+		b.label = broadcastLabel(b.origin.IP(), b.origin.Port(), b.epoch, b.index)
 	}
 
 	return b.label
@@ -87,56 +130,77 @@ func (b *Broadcast) Origin() *Node {
 	return b.origin
 }
 
-// BroadcastBytes allows a user to emit a short broadcast in the form of a byte
+// Name returns the name of a named broadcast (see BroadcastNamed), or an
+// empty string.
+func (b *Broadcast) Name() string {
+	return b.name
+}
+
+// Topic returns the topic of a topic broadcast (see BroadcastTopic), or an
+// empty string.
+func (b *Broadcast) Topic() string {
+	return b.topic
+}
+
+// BroadcastBytes allows a user to emit a broadcast in the form of a byte
 // slice, which will be transmitted at most once to all other healthy current
 // members. Members that join after the broadcast has already propagated
-// through the cluster will not receive the message. The maximum broadcast
-// length is 256 bytes.
-func BroadcastBytes(bytes []byte) error {
-	if len(bytes) > GetMaxBroadcastBytes() {
+// through the cluster will not receive the message, unless broadcasts are
+// kept for them (see SetBroadcastRetentionMillis). Broadcasts longer than
+// GetMaxBroadcastBytes() (256 bytes by default) are split into fragments,
+// which are reassembled by the receivers; the maximum length is
+// MaxFragmentedBroadcastBytes. The returned handle tells when the broadcast
+// has been spread (see BroadcastHandle).
+func (c *Cluster) BroadcastBytes(bytes []byte) (*BroadcastHandle, error) {
+	if len(bytes) > MaxFragmentedBroadcastBytes {
 		emsg := fmt.Sprintf(
 			"broadcast payload length exceeds %d bytes",
-			GetMaxBroadcastBytes())
+			MaxFragmentedBroadcastBytes)
 
-		return errors.New(emsg)
+		return nil, errors.New(emsg)
 	}
 
-	broadcasts.Lock()
-
-	bcast := Broadcast{
-		origin:      thisHost,
-		index:       indexCounter,
-		bytes:       bytes,
-		emitCounter: int8(emitCount())}
-
-	broadcasts.m[bcast.Label()] = &bcast
+	handle := c.newBroadcastHandle()
 
-	indexCounter++
+	if len(bytes) > c.GetMaxBroadcastBytes() {
+		c.queueFragmentedBroadcast(bytes, handle)
+	} else {
+		c.enqueueBroadcast(&Broadcast{
+			bytes:  bytes,
+			kind:   broadcastUser,
+			handle: handle})
+	}
 
-	broadcasts.Unlock()
+	handle.start()
 
-	return nil
+	return handle, nil
 }
 
-// BroadcastString allows a user to emit a short broadcast in the form of a
-// string, which will be transmitted at most once to all other healthy current
+// BroadcastString allows a user to emit a broadcast in the form of a string,
+// which will be transmitted at most once to all other healthy current
 // members. Members that join after the broadcast has already propagated
-// through the cluster will not receive the message. The maximum broadcast
-// length is 256 bytes.
-func BroadcastString(str string) error {
-	return BroadcastBytes([]byte(str))
+// through the cluster will not receive the message, unless broadcasts are
+// kept for them. Long broadcasts are fragmented, as with BroadcastBytes.
+func (c *Cluster) BroadcastString(str string) (*BroadcastHandle, error) {
+	return c.BroadcastBytes([]byte(str))
 }
 
-// Message contents for IPv6
+// Broadcast contents for IPv6, as of protocol version 1 (see message.go)
 // Bytes       Content
 // ------------------------
 // Bytes 00-15 Origin IP (00-03 for IPv4)
 // Bytes 16-17 Origin response port (04-05 for IPv4)
-// Bytes 18-21 Origin broadcast counter (06-09 for IPv4)
-// Bytes 22-23 Payload length (bytes) (10-11 for IPv4)
-// Bytes 24-NN Payload (12-NN for IPv4)
-func (b *Broadcast) encode() []byte {
-	size := 8 + ipLen + len(b.bytes)
+// Bytes 18-25 Origin epoch (06-13 for IPv4)
+// Bytes 26-29 Origin broadcast counter (14-17 for IPv4)
+// Bytes 30-31 Payload length (bytes) (18-19 for IPv4)
+// Bytes 32    Broadcast kind; high bit set to ask for acks (20 for IPv4)
+// Bytes 33-NN Payload (21-NN for IPv4)
+//
+// The payload of a named broadcast starts with a byte holding the length of
+// its name, followed by the name; that of a topic broadcast, likewise, with
+// its topic.
+func (b *Broadcast) encode(ipLen int) []byte {
+	size := b.encodedSize(ipLen)
 	bytes := make([]byte, size, size)
 
 	// Index pointer
@@ -156,13 +220,29 @@ func (b *Broadcast) encode() []byte {
 	// Bytes 16-17 Origin response port
 	p += encodeUint16(b.origin.Port(), bytes, p)
 
-	// Bytes 18-21 Origin broadcast counter
+	// Bytes 18-25 Origin epoch
+	p += encodeUint64(b.epoch, bytes, p)
+
+	// Bytes 26-29 Origin broadcast counter
 	p += encodeUint32(b.index, bytes, p)
 
-	// Bytes 22-23 Payload length (bytes)
-	p += encodeUint16(uint16(len(b.bytes)), bytes, p)
+	// Bytes 30-31 Payload length (bytes), name or topic included
+	p += encodeUint16(uint16(size-17-ipLen), bytes, p)
+
+	// Bytes 32 Broadcast kind
+	bytes[p] = byte(b.kind)
+	if b.ackRequested {
+		bytes[p] |= broadcastAckFlag
+	}
+	p++
 
-	// Bytes 24-NN Payload
+	if b.kind.hasPrefix() {
+		prefix := b.prefix()
+		p += encodeByte(byte(len(prefix)), bytes, p)
+		p += copy(bytes[p:], prefix)
+	}
+
+	// Bytes 33-NN Payload
 	for i, by := range b.bytes {
 		bytes[i+p] = by
 	}
@@ -170,24 +250,40 @@ func (b *Broadcast) encode() []byte {
 	return bytes
 }
 
-// Message contents
+// Returns the length of this broadcast once encoded.
+func (b *Broadcast) encodedSize(ipLen int) int {
+	if b.kind.hasPrefix() {
+		return 18 + ipLen + len(b.prefix()) + len(b.bytes)
+	}
+
+	return 17 + ipLen + len(b.bytes)
+}
+
+// Broadcast contents, as of protocol version 1 (see message.go)
 // Bytes       Content
 // ------------------------
 // Bytes 00-15 Origin IP (00-03 on IPv4)
 // Bytes 16-17 Origin response port (04-05 on IPv4)
-// Bytes 18-21 Origin broadcast counter (06-09 on IPv4)
-// Bytes 22-23 Payload length (bytes) (10-11 on IPv4)
-// Bytes 24-NN Payload (12-NN on IPv4)
-func decodeBroadcast(bytes []byte) (*Broadcast, error) {
+// Bytes 18-25 Origin epoch (06-13 on IPv4)
+// Bytes 26-29 Origin broadcast counter (14-17 on IPv4)
+// Bytes 30-31 Payload length (bytes) (18-19 on IPv4)
+// Bytes 32    Broadcast kind; high bit set to ask for acks (20 on IPv4)
+// Bytes 33-NN Payload (21-NN on IPv4)
+func (c *Cluster) decodeBroadcast(bytes []byte) (*Broadcast, error) {
 	var index uint32
+	var epoch uint64
 	var port uint16
 	var ip net.IP
 	var length uint16
 
+	if len(bytes) < 17+c.ipLen {
+		return nil, errors.New("broadcast too short")
+	}
+
 	// An index pointer
 	p := 0
 
-	if ipLen == net.IPv6len {
+	if c.ipLen == net.IPv6len {
 		// Bytes 00-15 Origin IP
 		ip = make(net.IP, net.IPv6len)
 		copy(ip, bytes[p:p+16])
@@ -196,19 +292,31 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 		ip = net.IPv4(bytes[p+0], bytes[p+1], bytes[p+2], bytes[p+3])
 	}
 
-	p += ipLen
+	p += c.ipLen
 
 	// Bytes 16-17 Origin response port
 	port, p = decodeUint16(bytes, p)
 
-	// Bytes 18-21 Origin broadcast counter
+	// Bytes 18-25 Origin epoch
+	epoch, p = decodeUint64(bytes, p)
+
+	// Bytes 26-29 Origin broadcast counter
 	index, p = decodeUint32(bytes, p)
 
-	// Bytes 22-23 Payload length (bytes)
+	// Bytes 30-31 Payload length (bytes)
 	length, p = decodeUint16(bytes, p)
 
+	// Bytes 32 Broadcast kind
+	kind := broadcastKind(bytes[p] &^ broadcastAckFlag)
+	ackRequested := bytes[p]&broadcastAckFlag != 0
+	p++
+
+	if len(bytes) < p+int(length) {
+		return nil, errors.New("broadcast payload truncated")
+	}
+
 	// Now that we have the IP and port, we can find the Node.
-	origin := knownNodes.getByIP(ip, port)
+	origin := c.getKnownNodeByIP(ip, port)
 
 	// We don't know this node, so create a new one!
 	if origin == nil {
@@ -218,8 +326,28 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 	bcast := Broadcast{
 		origin:      origin,
 		index:       index,
+		epoch:       epoch,
 		bytes:       bytes[p : p+int(length)],
-		emitCounter: int8(emitCount())}
+		emitCounter: int8(c.emitCount()),
+		kind:        kind,
+
+		ackRequested: ackRequested}
+
+	if kind.hasPrefix() {
+		if length == 0 || int(bytes[p]) >= int(length) {
+			return nil, errors.New("broadcast name or topic truncated")
+		}
+
+		end := p + 1 + int(bytes[p])
+		prefix := string(bytes[p+1 : end])
+		bcast.bytes = bytes[end : p+int(length)]
+
+		if kind == broadcastNamed {
+			bcast.name = prefix
+		} else {
+			bcast.topic = prefix
+		}
+	}
 
 	err := checkOrigin(origin)
 	if err != nil {
@@ -227,7 +355,7 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 		return &bcast, err
 	}
 
-	if int(length) > GetMaxBroadcastBytes() {
+	if int(length) > c.GetMaxBroadcastBytes() {
 		return &bcast,
 			errors.New("message length exceeds maximum length")
 	}
@@ -235,43 +363,51 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 	return &bcast, nil
 }
 
-// getBroadcastToEmit identifies the single known broadcast with the highest
-// emitCounter value (which can be negative), and returns it. If multiple
-// broadcasts have the same value, one is arbitrarily chosen.
-func getBroadcastToEmit() *Broadcast {
+// getBroadcastsToEmit returns the known broadcasts, highest emitCounter value
+// (which can be negative) first. Broadcasts with the same value are in
+// arbitrary order.
+func (c *Cluster) getBroadcastsToEmit() []*Broadcast {
 	// Get all broadcast messages.
 	values := make([]*Broadcast, 0, 0)
-	broadcasts.RLock()
-	for _, v := range broadcasts.m {
+	c.broadcasts.RLock()
+	for _, v := range c.broadcasts.m {
 		values = append(values, v)
 	}
-	broadcasts.RUnlock()
+	c.broadcasts.RUnlock()
 
 	// Remove all overly-emitted messages from the list
 	broadcastSlice := make([]*Broadcast, 0, 0)
-	broadcasts.Lock()
+	removed := make([]*Broadcast, 0)
+	c.broadcasts.Lock()
 	for _, b := range values {
 		if b.emitCounter <= broadcastRemoveValue {
 			logDebug("Removing ", b.Label(), " from recently updated list")
-			delete(broadcasts.m, b.Label())
+			delete(c.broadcasts.m, b.Label())
+			removed = append(removed, b)
 		} else {
 			broadcastSlice = append(broadcastSlice, b)
 		}
 	}
-	broadcasts.Unlock()
+	c.broadcasts.Unlock()
 
-	if len(broadcastSlice) > 0 {
-		// Put the newest nodes on top.
-		sort.Sort(byBroadcastEmitCounter(broadcastSlice))
-		return broadcastSlice[0]
+	// Broadcasts that are no longer gossiped won't be acknowledged anymore.
+	for _, b := range removed {
+		if b.handle != nil {
+			b.handle.expire()
+		}
 	}
 
-	return nil
+	// Put the newest broadcasts on top.
+	c.broadcasts.RLock()
+	sort.Sort(byBroadcastEmitCounter(broadcastSlice))
+	c.broadcasts.RUnlock()
+
+	return broadcastSlice
 }
 
 // receiveBroadcast is called by receiveMessageUDP when a broadcast payload
 // is found in a message.
-func receiveBroadcast(broadcast *Broadcast) {
+func (c *Cluster) receiveBroadcast(broadcast *Broadcast) {
 	if broadcast == nil {
 		return
 	}
@@ -282,24 +418,135 @@ func receiveBroadcast(broadcast *Broadcast) {
 		return
 	}
 
+	if !c.addReceivedBroadcast(broadcast) {
+		return
+	}
+
+	c.retainBroadcast(broadcast, 0)
+	c.handleBroadcast(broadcast)
+}
+
+// addReceivedBroadcast adds a broadcast received from another node to the
+// ones that are passed on. It returns false if the broadcast has been
+// received before.
+func (c *Cluster) addReceivedBroadcast(broadcast *Broadcast) bool {
 	label := broadcast.Label()
 
-	broadcasts.Lock()
-	_, contains := broadcasts.m[label]
-	if !contains {
-		broadcasts.m[label] = broadcast
+	c.broadcasts.Lock()
+	defer c.broadcasts.Unlock()
+
+	if _, contains := c.broadcasts.m[label]; contains || c.isRetained(label) {
+		return false
 	}
-	broadcasts.Unlock()
 
-	if !contains {
+	c.broadcasts.m[label] = broadcast
+
+	return true
+}
+
+// handleBroadcast acts on a new broadcast, according to its kind.
+func (c *Cluster) handleBroadcast(broadcast *Broadcast) {
+	label := broadcast.Label()
+
+	switch broadcast.kind {
+	case broadcastUser:
 		logfInfo("Broadcast [%s]=%s",
 			label,
 			string(broadcast.Bytes()))
 
-		doBroadcastUpdate(broadcast)
+		c.doBroadcastUpdate(broadcast)
+		c.ackBroadcast(broadcast)
+	case broadcastKeyringOp:
+		c.receiveKeyringOp(broadcast)
+	case broadcastKeyringReply:
+		c.receiveKeyringReply(broadcast)
+	case broadcastFragment:
+		c.receiveFragment(broadcast)
+	case broadcastQuery:
+		c.receiveQuery(broadcast)
+	case broadcastNamed:
+		c.receiveNamedBroadcast(broadcast)
+		c.ackBroadcast(broadcast)
+	case broadcastTopic:
+		c.receiveTopicBroadcast(broadcast)
+		c.ackBroadcast(broadcast)
+	default:
+		// Still passed on, for the nodes that understand it.
+		logfDebug("Broadcast [%s] is of unknown kind %d", label, broadcast.kind)
+	}
+}
+
+// queueBroadcast adds a broadcast of the given kind, originating from this
+// node, to the ones that are piggybacked on outgoing messages.
+func (c *Cluster) queueBroadcast(kind broadcastKind, bytes []byte) *Broadcast {
+	bcast := &Broadcast{
+		bytes: bytes,
+		kind:  kind}
+
+	c.enqueueBroadcast(bcast)
+
+	return bcast
+}
+
+// enqueueBroadcast gives a broadcast composed by this node its origin and
+// index, and queues it. If it has a handle, the handle tracks it from then
+// on.
+func (c *Cluster) enqueueBroadcast(bcast *Broadcast) {
+	c.broadcasts.Lock()
+
+	bcast.origin = c.thisHost
+	bcast.index = c.indexCounter
+	bcast.epoch = c.epoch
+	bcast.emitCounter = int8(c.emitCount())
+
+	if bcast.handle != nil {
+		bcast.handle.add(bcast)
+	}
+
+	c.broadcasts.m[bcast.Label()] = bcast
+
+	c.indexCounter++
+
+	c.broadcasts.Unlock()
+
+	c.retainBroadcast(bcast, 0)
+}
+
+// dropBroadcast stops gossiping a broadcast that can't be sent, for the given
+// reason, and fails its handle. It's removed with the others that are no
+// longer gossiped.
+func (c *Cluster) dropBroadcast(broadcast *Broadcast, reason error) {
+	logWarn("Dropping broadcast", broadcast.Label(), "->", reason)
+
+	c.broadcasts.Lock()
+	broadcast.emitCounter = broadcastRemoveValue
+	c.broadcasts.Unlock()
+
+	c.retained.Lock()
+	delete(c.retained.m, broadcast.Label())
+	c.retained.Unlock()
+
+	if broadcast.handle != nil {
+		broadcast.handle.fail(reason)
 	}
 }
 
+// hasPrefix returns true for the kinds of broadcasts whose payload starts
+// with a name or topic.
+func (k broadcastKind) hasPrefix() bool {
+	return k == broadcastNamed || k == broadcastTopic
+}
+
+// prefix returns the name or topic that travels in front of the bytes of a
+// broadcast.
+func (b *Broadcast) prefix() string {
+	if b.kind == broadcastTopic {
+		return b.topic
+	}
+
+	return b.name
+}
+
 // checkBroadcastOrigin checks wether the origin is set correctly
 func checkOrigin(origin *Node) error {
 	// normalize to IPv4 or IPv6 to check below
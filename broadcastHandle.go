@@ -0,0 +1,339 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Every broadcast sent with BroadcastBytes, BroadcastString or BroadcastNamed
+// comes with a handle, which is done once the broadcast has been spread. By
+// default, that is once this node has emitted it as many times as it's meant
+// to be (which says nothing of whether it was received). If an acknowledgement
+// percentage is set (see SetBroadcastAckPercent), the broadcast asks every node
+// that receives it to acknowledge it, and the handle is done once that share of
+// the other healthy nodes have; if the broadcast stops being gossiped first,
+// the handle is done with an error.
+//
+// Broadcast acknowledgement (BACK) message payload
+// Any number of labels:
+// Bytes 00-15 Origin IP (00-03 on IPv4)
+// Bytes 16-17 Origin response port (04-05 on IPv4)
+// Bytes 18-25 Origin epoch (06-13 on IPv4)
+// Bytes 26-29 Origin broadcast counter (14-17 on IPv4)
+
+// BroadcastHandle tracks the spread of a broadcast sent by this node.
+type BroadcastHandle struct {
+	cluster *Cluster
+
+	lock sync.Mutex
+
+	// The label of the broadcast; that of the whole broadcast, if it was
+	// fragmented.
+	label string
+
+	// The broadcasts being emitted: the broadcast itself, or its fragments.
+	broadcasts []*Broadcast
+
+	// The number of emits that were planned for the broadcasts.
+	planned int
+
+	// Set once every broadcast has been queued. The handle isn't done before
+	// then.
+	started bool
+
+	// Whether the handle waits for acknowledgements, and how many.
+	waitAcks bool
+	required int
+
+	// The keys (names, if known) of the nodes that have acknowledged the
+	// broadcast.
+	acked map[string]bool
+
+	done     chan struct{}
+	finished bool
+	err      error
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Label returns the label of the broadcast, as passed to the broadcast
+// listeners of the nodes that receive it (see Broadcast.Label()).
+func (h *BroadcastHandle) Label() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.label
+}
+
+// Progress returns the number of times this node has emitted the broadcast
+// (counting every fragment of a fragmented broadcast) so far, and the number
+// of times it's meant to.
+func (h *BroadcastHandle) Progress() (emitted, planned int) {
+	h.cluster.broadcasts.RLock()
+	defer h.cluster.broadcasts.RUnlock()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.emitted(), h.planned
+}
+
+// Acks returns the number of nodes that have acknowledged the broadcast so
+// far. It stays at 0 unless acknowledgements were asked for (see
+// SetBroadcastAckPercent).
+func (h *BroadcastHandle) Acks() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.acked)
+}
+
+// Done returns a channel that is closed once the broadcast has been spread,
+// or has stopped being gossiped without enough acknowledgements.
+func (h *BroadcastHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the broadcast has been spread, or ctx is done. It returns
+// nil if the broadcast was spread, an error if it stopped being gossiped
+// before enough nodes acknowledged it, or ctx.Err().
+func (h *BroadcastHandle) Wait(ctx context.Context) error {
+	select {
+	case <-h.done:
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		return h.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// newBroadcastHandle returns a handle for a broadcast about to be sent, which
+// waits for acknowledgements from GetBroadcastAckPercent() percent of the
+// other healthy nodes, if that is set.
+func (c *Cluster) newBroadcastHandle() *BroadcastHandle {
+	h := &BroadcastHandle{
+		cluster: c,
+		acked:   make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+
+	if percent := c.GetBroadcastAckPercent(); percent > 0 {
+		if percent > 100 {
+			percent = 100
+		}
+
+		peers := 0
+		for _, n := range c.HealthyNodes() {
+			if n.Address() != c.thisHost.Address() {
+				peers++
+			}
+		}
+
+		h.waitAcks = true
+		h.required = (percent*peers + 99) / 100
+	}
+
+	return h
+}
+
+// register gives the handle its label and, if it waits for
+// acknowledgements, makes it known under that label.
+func (h *BroadcastHandle) register(label string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.registerLabel(label)
+}
+
+func (h *BroadcastHandle) registerLabel(label string) {
+	h.label = label
+
+	if h.waitAcks {
+		h.cluster.handles.Lock()
+		h.cluster.handles.m[label] = h
+		h.cluster.handles.Unlock()
+	}
+}
+
+// add starts tracking a broadcast that has just been queued. Its label is the
+// handle's, unless the handle has one already.
+func (h *BroadcastHandle) add(broadcast *Broadcast) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	broadcast.ackRequested = h.waitAcks
+
+	h.broadcasts = append(h.broadcasts, broadcast)
+	if broadcast.emitCounter > 0 {
+		h.planned += int(broadcast.emitCounter)
+	}
+
+	if h.label == "" {
+		h.registerLabel(broadcast.Label())
+	}
+}
+
+// start marks every broadcast as queued, and checks whether the handle is
+// done already.
+func (h *BroadcastHandle) start() {
+	h.lock.Lock()
+	h.started = true
+	h.lock.Unlock()
+
+	h.check()
+}
+
+// emitted returns the number of emits so far. The lock must be held, and so
+// must the cluster's broadcasts lock, which guards the emit counters (and is
+// taken first).
+func (h *BroadcastHandle) emitted() int {
+	remaining := 0
+
+	for _, b := range h.broadcasts {
+		if b.emitCounter > 0 {
+			remaining += int(b.emitCounter)
+		}
+	}
+
+	return h.planned - remaining
+}
+
+// check finishes the handle if its broadcast has been spread: if enough
+// nodes have acknowledged it, or if every broadcast has been emitted as many
+// times as planned, when not waiting for acknowledgements.
+func (h *BroadcastHandle) check() {
+	h.cluster.broadcasts.RLock()
+	defer h.cluster.broadcasts.RUnlock()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.started || h.finished {
+		return
+	}
+
+	if h.waitAcks {
+		if len(h.acked) >= h.required {
+			h.finish(nil)
+		}
+
+		return
+	}
+
+	for _, b := range h.broadcasts {
+		if b.emitCounter > 0 {
+			return
+		}
+	}
+
+	h.finish(nil)
+}
+
+// acknowledge records an acknowledgement from node.
+func (h *BroadcastHandle) acknowledge(node *Node) {
+	h.lock.Lock()
+	if !h.finished {
+		h.acked[node.key()] = true
+	}
+	h.lock.Unlock()
+
+	h.check()
+}
+
+// expire finishes the handle with an error if it is still waiting for
+// acknowledgements once its broadcast is no longer gossiped.
+func (h *BroadcastHandle) expire() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.finished {
+		return
+	}
+
+	h.finish(fmt.Errorf("broadcast %s acknowledged by %d of %d required nodes",
+		h.label, len(h.acked), h.required))
+}
+
+// fail finishes the handle with err, unless it is done already.
+func (h *BroadcastHandle) fail(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.finished {
+		h.finish(err)
+	}
+}
+
+// finish marks the handle as done. The lock must be held.
+func (h *BroadcastHandle) finish(err error) {
+	h.finished = true
+	h.err = err
+	close(h.done)
+
+	if h.waitAcks {
+		h.cluster.handles.Lock()
+		delete(h.cluster.handles.m, h.label)
+		h.cluster.handles.Unlock()
+	}
+
+	logfDebug("Broadcast [%s] done: acks=%d err=%v", h.label, len(h.acked), err)
+}
+
+// ackBroadcast acknowledges a broadcast that has been passed to the broadcast
+// listeners to the node that sent it, if it asks for that.
+func (c *Cluster) ackBroadcast(broadcast *Broadcast) {
+	if !broadcast.ackRequested || broadcast.origin.Address() == c.thisHost.Address() {
+		return
+	}
+
+	err := c.transmitPayload(broadcast.origin, verbBroadcastAck, broadcast.encodeLabel(c.ipLen))
+	if err != nil {
+		logInfo("Failure to acknowledge broadcast", broadcast.Label(), "->", err)
+	}
+}
+
+// receiveVerbBroadcastAck records the acknowledgements of broadcasts that
+// this node sent, and is still tracking.
+func (c *Cluster) receiveVerbBroadcastAck(msg message) error {
+	labels, _, err := c.decodeBroadcastLabels(msg.payload)
+	if err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		c.handles.Lock()
+		h, ok := c.handles.m[label]
+		c.handles.Unlock()
+
+		if ok {
+			h.acknowledge(msg.sender)
+		}
+	}
+
+	return nil
+}
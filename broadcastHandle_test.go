@@ -0,0 +1,176 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcastHandleEmitted(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, 8)
+
+	handle, err := c.BroadcastString("hello")
+	require.NoError(t, err)
+
+	bc := c.broadcasts.m[handle.Label()]
+	require.NotNil(t, bc)
+	require.False(t, bc.ackRequested)
+
+	emitted, planned := handle.Progress()
+	require.Zero(t, emitted)
+	require.Equal(t, c.emitCount(), planned)
+
+	for i := 1; i < planned; i++ {
+		bc.emitCounter--
+		handle.check()
+	}
+
+	emitted, _ = handle.Progress()
+	require.Equal(t, planned-1, emitted)
+
+	select {
+	case <-handle.Done():
+		t.Fatal("Handle done before the last emit")
+	default:
+	}
+
+	bc.emitCounter--
+	handle.check()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, handle.Wait(ctx))
+}
+
+func TestBroadcastHandleFragmented(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, 8)
+
+	handle, err := c.BroadcastBytes(make([]byte, 1000))
+	require.NoError(t, err)
+
+	fragments := c.getBroadcastsToEmit()
+	require.Len(t, fragments, 5)
+
+	// The handle has the label of the whole broadcast, which took the first
+	// index.
+	require.Equal(t, broadcastLabel(c.thisHost.ip, 9999, c.epoch, 1), handle.Label())
+
+	_, planned := handle.Progress()
+	require.Equal(t, len(fragments)*c.emitCount(), planned)
+
+	for _, f := range fragments[1:] {
+		f.emitCounter = 0
+	}
+	handle.check()
+
+	select {
+	case <-handle.Done():
+		t.Fatal("Handle done before every fragment was emitted")
+	default:
+	}
+
+	fragments[0].emitCounter = 0
+	handle.check()
+
+	<-handle.Done()
+}
+
+func TestBroadcastHandleAcks(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, 4)
+	c.SetBroadcastAckPercent(50)
+
+	handle, err := c.BroadcastString("hello")
+	require.NoError(t, err)
+
+	bc := c.broadcasts.m[handle.Label()]
+	require.True(t, bc.ackRequested)
+
+	// The flag survives encoding.
+	decoded, err := c.decodeBroadcast(bc.encode(c.ipLen))
+	require.NoError(t, err)
+	require.True(t, decoded.ackRequested)
+	require.Equal(t, broadcastUser, decoded.kind)
+
+	// Emitting doesn't finish a handle that waits for acks.
+	bc.emitCounter = 0
+	handle.check()
+
+	ack := func(sender *Node) {
+		msg := newMessage(verbBroadcastAck, sender, 1)
+		msg.payload = bc.encodeLabel(c.ipLen)
+		require.NoError(t, c.receiveVerbBroadcastAck(msg))
+	}
+
+	peer := &Node{ip: net.IPv4(10, 0, 30, 2), port: 9999, name: "peer-1"}
+	ack(peer)
+	ack(peer)
+	require.Equal(t, 1, handle.Acks())
+
+	// Nor does it count twice after moving to another address.
+	ack(&Node{ip: net.IPv4(10, 0, 30, 9), port: 9999, name: "peer-1"})
+	require.Equal(t, 1, handle.Acks())
+
+	select {
+	case <-handle.Done():
+		t.Fatal("Handle done with 1 of 2 required acks")
+	default:
+	}
+
+	ack(&Node{ip: net.IPv4(10, 0, 30, 3), port: 9999})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, handle.Wait(ctx))
+	require.Empty(t, c.handles.m)
+}
+
+func TestBroadcastHandleExpired(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, 4)
+	c.SetBroadcastAckPercent(100)
+
+	handle, err := c.BroadcastString("hello")
+	require.NoError(t, err)
+
+	c.broadcasts.m[handle.Label()].emitCounter = broadcastRemoveValue
+	require.Empty(t, c.getBroadcastsToEmit())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.Error(t, handle.Wait(ctx))
+	require.Empty(t, c.handles.m)
+}
+
+func TestBroadcastHandleWaitContext(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, 4)
+	c.SetBroadcastAckPercent(100)
+
+	handle, err := c.BroadcastString("hello")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	require.ErrorIs(t, handle.Wait(ctx), context.DeadlineExceeded)
+}
@@ -35,9 +35,12 @@ var (
 
 	expectedOriginPort = uint16(1234)
 
-	expectedLabel = fmt.Sprintf("%s:%d:%d",
+	expectedEpoch = defaultCluster.epoch
+
+	expectedLabel = fmt.Sprintf("%s:%d:%d:%d",
 		expectedOriginIP.String(),
 		expectedOriginPort,
+		expectedEpoch,
 		expectedIndex)
 )
 
@@ -55,6 +58,7 @@ func testBroadcast() *Broadcast {
 		origin:      node,
 		bytes:       expectedBytes,
 		index:       expectedIndex,
+		epoch:       expectedEpoch,
 		emitCounter: expectedEmitCounter,
 	}
 }
@@ -90,56 +94,221 @@ func TestGetBroadcastToEmit(t *testing.T) {
 	bcc.emitCounter = 10
 	bcc.index = 3
 
-	broadcasts.m["a"] = bca
-	broadcasts.m["b"] = bcb
-	broadcasts.m["c"] = bcc
+	defaultCluster.broadcasts.m["a"] = bca
+	defaultCluster.broadcasts.m["b"] = bcb
+	defaultCluster.broadcasts.m["c"] = bcc
 
-	bc1 := getBroadcastToEmit()
-	require.Equal(t, bcb, bc1, fmt.Sprintf("Expected %v, got %v", bcb, bc1))
+	bcs := defaultCluster.getBroadcastsToEmit()
+	require.Equal(t, []*Broadcast{bcb, bcc, bca}, bcs)
 
-	delete(broadcasts.m, "b")
-	bc2 := getBroadcastToEmit()
-	require.Equal(t, bcc, bc2, fmt.Sprintf("Expected %v, got %v", bcc, bc2))
+	delete(defaultCluster.broadcasts.m, "b")
+	bcs = defaultCluster.getBroadcastsToEmit()
+	require.Equal(t, []*Broadcast{bcc, bca}, bcs)
 
-	delete(broadcasts.m, "c")
-	bc3 := getBroadcastToEmit()
-	require.Equal(t, bca, bc3, fmt.Sprintf("Expected %v, got %v", bcc, bc3))
+	delete(defaultCluster.broadcasts.m, "c")
+	bcs = defaultCluster.getBroadcastsToEmit()
+	require.Equal(t, []*Broadcast{bca}, bcs)
 
-	delete(broadcasts.m, "a")
+	delete(defaultCluster.broadcasts.m, "a")
 }
 
 func TestBroadcastBytes(t *testing.T) {
 	h := testNode()
-	thisHost = h
+	defaultCluster.thisHost = h
 
-	require.Empty(t, broadcasts.m, "Broadcasts map isn't empty")
+	require.Empty(t, defaultCluster.broadcasts.m, "Broadcasts map isn't empty")
 
-	err := BroadcastBytes(expectedBytes)
+	_, err := BroadcastBytes(expectedBytes)
 	require.Nil(t, err, "Should have been no error!")
 
-	bc := broadcasts.m[expectedLabel]
+	bc := defaultCluster.broadcasts.m[expectedLabel]
 
 	require.Equal(t, expectedBytes, bc.Bytes(), "Message contents mismatch")
 
-	delete(broadcasts.m, expectedLabel)
+	delete(defaultCluster.broadcasts.m, expectedLabel)
 }
 
 func TestBroadcastBytesTooLong(t *testing.T) {
-	bytesTooLong := make([]byte, GetMaxBroadcastBytes()*2, GetMaxBroadcastBytes()*2)
-	err := BroadcastBytes(bytesTooLong)
+	bytesTooLong := make([]byte, MaxFragmentedBroadcastBytes+1)
+	_, err := BroadcastBytes(bytesTooLong)
 	require.NotNil(t, err, "Should have been too long!")
 }
 
 func TestReceiveBroadcast(t *testing.T) {
 	bc := testBroadcast()
 
-	require.Empty(t, broadcasts.m, "Broadcasts map isn't empty")
+	require.Empty(t, defaultCluster.broadcasts.m, "Broadcasts map isn't empty")
+
+	defaultCluster.receiveBroadcast(bc)
+
+	require.True(t, defaultCluster.broadcasts.m[expectedLabel] != nil, "Broadcast value is nil")
+
+	defaultCluster.receiveBroadcast(bc)
+
+	require.True(t, len(defaultCluster.broadcasts.m) == 1, "Added another where it shouldn't have")
+}
+
+func TestNamedBroadcastEncoding(t *testing.T) {
+	c := NewCluster()
+
+	bc := &Broadcast{
+		origin: &Node{ip: expectedOriginIP, port: expectedOriginPort},
+		index:  expectedIndex,
+		bytes:  []byte("on"),
+		kind:   broadcastNamed,
+		name:   "feature-x",
+	}
+
+	bytes := bc.encode(c.ipLen)
+	require.Len(t, bytes, bc.encodedSize(c.ipLen))
+
+	decoded, err := c.decodeBroadcast(bytes)
+	require.NoError(t, err)
+	require.Equal(t, "feature-x", decoded.Name())
+	require.Equal(t, []byte("on"), decoded.Bytes())
+	require.Equal(t, bc.encodedSize(c.ipLen), decoded.encodedSize(c.ipLen))
+
+	// A name longer than the payload is an error.
+	bytes[c.ipLen+17] = 200
+	_, err = c.decodeBroadcast(bytes)
+	require.Error(t, err)
+}
+
+func TestNamedBroadcastSupersedes(t *testing.T) {
+	c := NewCluster()
+	c.thisHost = &Node{ip: net.IPv4(10, 0, 28, 1), port: 9999}
+
+	// Enough nodes for broadcasts to be emitted.
+	for i := 2; i < 10; i++ {
+		c.knownNodes.add(&Node{ip: net.IPv4(10, 0, 28, byte(i)), port: 9999})
+	}
+
+	_, err := c.BroadcastNamed("flag", []byte("1"))
+	require.NoError(t, err)
+	_, err = c.BroadcastNamed("flag", []byte("2"))
+	require.NoError(t, err)
+	_, err = c.BroadcastNamed("other", []byte("3"))
+	require.NoError(t, err)
+
+	emitting := make(map[string]string)
+	for _, bc := range c.getBroadcastsToEmit() {
+		if bc.emitCounter > 0 {
+			emitting[string(bc.Bytes())] = bc.Name()
+		}
+	}
+
+	require.Equal(t, map[string]string{"2": "flag", "3": "other"}, emitting)
+
+	// A stale broadcast received late isn't passed on.
+	receiver := NewCluster()
+	listener := &collectingBroadcastListener{}
+	receiver.AddBroadcastListener(listener)
+
+	for _, bc := range []*Broadcast{
+		{origin: c.thisHost, index: 2, kind: broadcastNamed, name: "flag", bytes: []byte("2")},
+		{origin: c.thisHost, index: 1, kind: broadcastNamed, name: "flag", bytes: []byte("1")},
+	} {
+		bc.emitCounter = 3
+		receiver.receiveBroadcast(bc)
+	}
 
-	receiveBroadcast(bc)
+	require.Equal(t, []string{"2"}, listener.received)
 
-	require.True(t, broadcasts.m[expectedLabel] != nil, "Broadcast value is nil")
+	for _, bc := range receiver.getBroadcastsToEmit() {
+		if bc.index == 1 {
+			require.Zero(t, bc.emitCounter)
+		}
+	}
+
+	_, err = c.BroadcastNamed("", []byte("x"))
+	require.Error(t, err)
+	_, err = c.BroadcastNamed("big", make([]byte, c.GetMaxBroadcastBytes()))
+	require.Error(t, err)
+}
+
+func TestNamedBroadcastSupersedesAcrossAddresses(t *testing.T) {
+	receiver := NewCluster()
+	listener := &collectingBroadcastListener{}
+	receiver.AddBroadcastListener(listener)
+
+	// The same node, before and after it restarted at another address.
+	before := &Node{name: "origin", ip: net.IPv4(10, 0, 28, 1), port: 9999}
+	after := &Node{name: "origin", ip: net.IPv4(10, 0, 28, 2), port: 9999}
+
+	for _, bc := range []*Broadcast{
+		{origin: after, epoch: 2, index: 1, kind: broadcastNamed, name: "flag", bytes: []byte("new")},
+		{origin: before, epoch: 1, index: 5, kind: broadcastNamed, name: "flag", bytes: []byte("old")},
+	} {
+		bc.emitCounter = 3
+		receiver.receiveBroadcast(bc)
+	}
+
+	require.Equal(t, []string{"new"}, listener.received)
+}
+
+func TestTopicBroadcastEncoding(t *testing.T) {
+	c := NewCluster()
+
+	bc := &Broadcast{
+		origin: &Node{ip: expectedOriginIP, port: expectedOriginPort},
+		index:  expectedIndex,
+		bytes:  []byte("v1.2.3"),
+		kind:   broadcastTopic,
+		topic:  "deploy",
+	}
+
+	bytes := bc.encode(c.ipLen)
+	require.Len(t, bytes, bc.encodedSize(c.ipLen))
+
+	decoded, err := c.decodeBroadcast(bytes)
+	require.NoError(t, err)
+	require.Equal(t, "deploy", decoded.Topic())
+	require.Empty(t, decoded.Name())
+	require.Equal(t, []byte("v1.2.3"), decoded.Bytes())
+}
+
+func TestTopicBroadcastDispatch(t *testing.T) {
+	c := NewCluster()
+	c.thisHost = &Node{ip: net.IPv4(10, 0, 31, 1), port: 9999}
+
+	// Enough nodes for broadcasts to be emitted.
+	for i := 2; i < 10; i++ {
+		c.knownNodes.add(&Node{ip: net.IPv4(10, 0, 31, byte(i)), port: 9999})
+	}
+
+	all := &collectingBroadcastListener{}
+	deploy := &collectingBroadcastListener{}
+	c.AddBroadcastListener(all)
+	c.SubscribeTopic("deploy", deploy)
+
+	origin := &Node{ip: net.IPv4(10, 0, 31, 2), port: 9999}
+
+	for i, bc := range []*Broadcast{
+		{kind: broadcastTopic, topic: "deploy", bytes: []byte("v1.2.3")},
+		{kind: broadcastTopic, topic: "metrics", bytes: []byte("cpu=3")},
+		{kind: broadcastUser, bytes: []byte("plain")},
+	} {
+		bc.origin = origin
+		bc.index = uint32(i + 1)
+		bc.emitCounter = 3
+		c.receiveBroadcast(bc)
+	}
+
+	require.Equal(t, []string{"v1.2.3"}, deploy.received)
+	require.Equal(t, []string{"plain"}, all.received)
+
+	// A topic without subscribers is still passed on.
+	relayed := false
+	for _, bc := range c.getBroadcastsToEmit() {
+		if bc.Topic() == "metrics" && bc.emitCounter > 0 {
+			relayed = true
+		}
+	}
 
-	receiveBroadcast(bc)
+	require.True(t, relayed)
 
-	require.True(t, len(broadcasts.m) == 1, "Added another where it shouldn't have")
+	_, err := c.BroadcastTopic("", []byte("x"))
+	require.Error(t, err)
+	_, err = c.BroadcastTopic("big", make([]byte, c.GetMaxBroadcastBytes()))
+	require.Error(t, err)
 }
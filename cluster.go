@@ -0,0 +1,433 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+)
+
+// Cluster is a single, self-contained membership instance: its own
+// configuration, known nodes, pending acknowledgements, broadcasts and
+// listeners. Any number of clusters can run side by side in one process.
+//
+// The package-level functions (Begin, AddNode, BroadcastBytes, ...) operate
+// on a default instance; see default_smudge.go.
+type Cluster struct {
+	properties
+
+	transportImpl transport.Transport
+
+	// This node's heartbeat, which the probe loop and received messages
+	// advance.
+	currentHeartbeat atomic.Uint32
+
+	pendingAcks struct {
+		sync.RWMutex
+		m map[string]*pendingAck
+	}
+
+	thisHostAddress string
+
+	thisHost *Node
+
+	ipLen int
+
+	// This flag is set whenever a known node is added or removed.
+	knownNodesModifiedFlag atomic.Bool
+
+	pingdata pingData
+
+	// All known nodes, living and dead. Dead nodes are pinged (far) less
+	// often, and are eventually removed
+	knownNodes nodeMap
+
+	// All nodes that have been updated "recently", living and dead
+	updatedNodes nodeMap
+
+	deadNodeRetries struct {
+		sync.RWMutex
+		m map[string]*deadNodeCounter
+	}
+
+	// The index counter value for the next broadcast message
+	indexCounter uint32
+
+	// When this instance was created, in nanoseconds since the Unix epoch.
+	// Broadcasts carry it, so that the ones sent after a restart (when the
+	// index counter starts over) aren't mistaken for earlier ones.
+	epoch uint64
+
+	// Broadcasts kept for nodes that missed them, by label (see
+	// SetBroadcastRetentionMillis).
+	retained struct {
+		sync.Mutex
+		m map[string]*retainedBroadcast
+	}
+
+	// The latest named broadcast of each name and origin (see
+	// namedBroadcast.go).
+	named struct {
+		sync.Mutex
+		m map[string]*Broadcast
+	}
+
+	// Broadcasts being reassembled from their fragments, by label.
+	fragments struct {
+		sync.Mutex
+		m map[string]*fragmentBuffer
+	}
+
+	// The handles of the broadcasts sent by this node that are still being
+	// tracked, by label.
+	handles struct {
+		sync.Mutex
+		m map[string]*BroadcastHandle
+	}
+
+	// Emitted broadcasts. Once they are added here, the membership machinery
+	// will pick them up and piggyback them onto standard messages.
+	broadcasts struct {
+		sync.RWMutex
+		m map[string]*Broadcast
+	}
+
+	broadcastListeners struct {
+		sync.RWMutex
+		s []BroadcastListener
+	}
+
+	// The subscribers to each topic (see SubscribeTopic).
+	topicListeners struct {
+		sync.RWMutex
+		m map[string][]BroadcastListener
+	}
+
+	statusListeners struct {
+		sync.RWMutex
+		s []StatusListener
+	}
+
+	addressListeners struct {
+		sync.RWMutex
+		s []AddressListener
+	}
+
+	metaListeners struct {
+		sync.RWMutex
+		s []MetaListener
+	}
+
+	messageListeners struct {
+		sync.RWMutex
+		s []MessageListener
+	}
+
+	incompatibleListeners struct {
+		sync.RWMutex
+		s []IncompatibleListener
+	}
+
+	// This node's metadata, as set by SetLocalMeta().
+	localMeta struct {
+		sync.Mutex
+		meta    map[string]string
+		bytes   []byte
+		version uint32
+	}
+
+	// Set once Leave() is called: the heartbeat of our LEAVE, and the
+	// addresses of the nodes that have acknowledged it.
+	leave struct {
+		sync.Mutex
+		heartbeat uint32
+		acked     map[string]bool
+	}
+
+	// Running suspicion timers, by node address.
+	suspicions struct {
+		sync.Mutex
+		m map[string]*suspicion
+	}
+
+	// Our own local health score; see adjustLocalHealth().
+	localHealth struct {
+		sync.Mutex
+		score int
+	}
+
+	// Nodes that have recently left the cluster, by name.
+	leftNodes struct {
+		sync.RWMutex
+		m map[string]leftNode
+	}
+
+	// The context of the current run; it's done once the node is stopping.
+	// Running is true while the node is up and listening. The lock also
+	// guards replacing thisHost, which each run does.
+	run struct {
+		sync.RWMutex
+		ctx     context.Context
+		running bool
+	}
+
+	// Join() calls in progress, waiting to hear from their seeds.
+	joins struct {
+		sync.Mutex
+		m map[*joinAttempt]bool
+	}
+
+	// Tracks every goroutine started on behalf of the current run.
+	background sync.WaitGroup
+
+	// The keyring that gossip is encrypted with, if any. FromEnv is true
+	// once SMUDGE_GOSSIP_KEY has been looked at.
+	keyring struct {
+		sync.Mutex
+		k       *Keyring
+		fromEnv bool
+	}
+
+	// Cluster-wide keyring operations started by this node, by ID.
+	keyringOps struct {
+		sync.Mutex
+		m map[uint64]*keyringOp
+	}
+
+	// Queries started by this node that are still collecting responses, by
+	// ID.
+	queries struct {
+		sync.Mutex
+		m map[uint64]*QueryResponse
+	}
+
+	// The handlers that answer queries, by query name.
+	queryHandlers struct {
+		sync.RWMutex
+		m map[string]QueryHandler
+	}
+
+	// The number of messages dropped for coming from another cluster.
+	foreignMessages atomic.Uint64
+
+	// The number of packets rejected for failing verification.
+	rejectedMessages atomic.Uint64
+
+	// The protocol versions of incompatible nodes that have been reported,
+	// by address.
+	incompatibleNodes struct {
+		sync.Mutex
+		m map[string][2]uint8
+	}
+}
+
+// NewCluster returns a new, unstarted cluster instance. Configure it with its
+// Set* methods, then call Begin() or RunGossip().
+func NewCluster() *Cluster {
+	c := &Cluster{
+		properties:   newProperties(),
+		ipLen:        net.IPv4len,
+		indexCounter: 1,
+		epoch:        uint64(time.Now().UnixNano()),
+	}
+
+	c.pendingAcks.m = make(map[string]*pendingAck)
+	c.deadNodeRetries.m = make(map[string]*deadNodeCounter)
+	c.broadcasts.m = make(map[string]*Broadcast)
+	c.fragments.m = make(map[string]*fragmentBuffer)
+	c.retained.m = make(map[string]*retainedBroadcast)
+	c.named.m = make(map[string]*Broadcast)
+	c.handles.m = make(map[string]*BroadcastHandle)
+	c.leftNodes.m = make(map[string]leftNode)
+	c.joins.m = make(map[*joinAttempt]bool)
+	c.keyringOps.m = make(map[uint64]*keyringOp)
+	c.queries.m = make(map[uint64]*QueryResponse)
+	c.queryHandlers.m = make(map[string]QueryHandler)
+	c.incompatibleNodes.m = make(map[string][2]uint8)
+	c.suspicions.m = make(map[string]*suspicion)
+	c.broadcastListeners.s = make([]BroadcastListener, 0, 16)
+	c.topicListeners.m = make(map[string][]BroadcastListener)
+	c.statusListeners.s = make([]StatusListener, 0, 16)
+	c.addressListeners.s = make([]AddressListener, 0, 16)
+	c.metaListeners.s = make([]MetaListener, 0, 16)
+	c.incompatibleListeners.s = make([]IncompatibleListener, 0, 16)
+	c.messageListeners.s = make([]MessageListener, 0, 16)
+
+	c.knownNodes.init()
+	c.updatedNodes.init()
+
+	c.pingdata = newPingData(c.GetPingHistoryFrontload(), 50)
+
+	return c
+}
+
+// ThisHost returns the node that represents this cluster member. It is nil
+// until Begin() has been called.
+func (c *Cluster) ThisHost() *Node {
+	c.run.RLock()
+	defer c.run.RUnlock()
+
+	return c.thisHost
+}
+
+// DroppedForeignMessages returns the number of messages that have been
+// dropped because they were sent by a node of another cluster; that is, one
+// with a different cluster name.
+func (c *Cluster) DroppedForeignMessages() uint64 {
+	return c.foreignMessages.Load()
+}
+
+// RunGossip configures this cluster, joins through the initial node (if any;
+// see Join) and runs the gossip until ctx is done. It returns once the node
+// has fully stopped.
+func (c *Cluster) RunGossip(ctx context.Context, trns transport.Transport, listenIp string, listenPort int,
+	initialNodeAddr string, logger Logger, logLvl LogLevel,
+) error {
+	var ip net.IP
+
+	var err error
+
+	if listenIp == "" {
+		ip, err = GetLocalIP()
+		if err != nil {
+			return fmt.Errorf("Could not get local ip: %w", err)
+		}
+	} else {
+		ip = net.ParseIP(listenIp)
+	}
+
+	c.SetTransport(trns)
+
+	if logger != nil {
+		SetLogger(logger)
+	} else {
+		SetLogThreshold(LogAll)
+	}
+
+	SetLogThreshold(logLvl)
+	c.SetListenPort(listenPort)
+	c.SetHeartbeatMillis(c.heartbeatMillis)
+	c.SetListenIP(ip)
+
+	if ip.To4() == nil {
+		c.SetMaxBroadcastBytes(512) // 512 for IPv6
+	}
+
+	if initialNodeAddr != "" {
+		if _, _, err := c.parseNodeAddress(initialNodeAddr); err != nil {
+			return fmt.Errorf("Bad initial node address: %w", err)
+		}
+
+		// Join waits for the node to start, and BeginContext for Join.
+		c.goBackground(func() {
+			_, err := c.Join(ctx, initialNodeAddr)
+			if err != nil {
+				logError(err)
+			}
+		})
+	}
+
+	return c.BeginContext(ctx)
+}
+
+// clusterID returns the identifier of this cluster that every message
+// carries: a hash of the cluster name.
+func (c *Cluster) clusterID() uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(c.GetClusterName()))
+
+	return h.Sum32()
+}
+
+// goBackground runs f in a goroutine that BeginContext waits for before it
+// returns.
+func (c *Cluster) goBackground(f func()) {
+	c.background.Add(1)
+
+	go func() {
+		defer c.background.Done()
+		f()
+	}()
+}
+
+// goBackgroundIfRunning is like goBackground, for goroutines started on
+// behalf of callers rather than of the node itself. It runs f only if the node
+// is running, checked under the lock that stopping it takes, so that f is
+// never added once BeginContext has started waiting. It returns false if the
+// node isn't running.
+func (c *Cluster) goBackgroundIfRunning(f func()) bool {
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	if !c.run.running {
+		return false
+	}
+
+	c.goBackground(f)
+
+	return true
+}
+
+func (c *Cluster) runContext() context.Context {
+	c.run.RLock()
+	defer c.run.RUnlock()
+
+	if c.run.ctx == nil {
+		return context.Background()
+	}
+
+	return c.run.ctx
+}
+
+func (c *Cluster) setRunContext(ctx context.Context) {
+	c.run.Lock()
+	c.run.ctx = ctx
+	c.run.Unlock()
+}
+
+func (c *Cluster) isRunning() bool {
+	c.run.RLock()
+	defer c.run.RUnlock()
+
+	return c.run.running
+}
+
+func (c *Cluster) setRunning(running bool) {
+	c.run.Lock()
+	c.run.running = running
+	c.run.Unlock()
+}
+
+// sleepContext sleeps for d, returning false early if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,1182 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport/memtransport"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCluster(nw *memtransport.Network, ip net.IP) *Cluster {
+	c := NewCluster()
+	c.SetTransport(nw.NewTransport(ip))
+	c.SetListenIP(ip)
+	c.SetListenPort(9999)
+	c.SetHeartbeatMillis(20)
+	c.SetMulticastEnabled(false)
+
+	return c
+}
+
+// newTestClusterWithPeers returns a cluster that isn't started, but knows of
+// itself and of n live peers, which it returns too.
+func newTestClusterWithPeers(t *testing.T, n int) (*Cluster, []*Node) {
+	c := NewCluster()
+	c.SetListenIP(net.IPv4(10, 0, 3, 1))
+	c.initHostEnvironment()
+	c.AddNode(c.thisHost)
+
+	peers := make([]*Node, n)
+	for i := range peers {
+		peer, err := CreateNodeByIP(net.IPv4(10, 0, 3, byte(i+2)), 9999)
+		require.NoError(t, err)
+
+		peers[i], _ = c.AddNode(peer)
+	}
+
+	return c, peers
+}
+
+type collectingBroadcastListener struct {
+	sync.Mutex
+	received []string
+}
+
+func (l *collectingBroadcastListener) OnBroadcast(b *Broadcast) {
+	l.Lock()
+	l.received = append(l.received, string(b.Bytes()))
+	l.Unlock()
+}
+
+func (l *collectingBroadcastListener) count() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.received)
+}
+
+type collectingMessageListener struct {
+	sync.Mutex
+	senders  []string
+	received []string
+}
+
+func (l *collectingMessageListener) OnMessage(sender *Node, payload []byte) {
+	l.Lock()
+	l.senders = append(l.senders, sender.Address())
+	l.received = append(l.received, string(payload))
+	l.Unlock()
+}
+
+func (l *collectingMessageListener) count() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.received)
+}
+
+// runTestCluster runs c until the test ends.
+func runTestCluster(t *testing.T, c *Cluster) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	// The error is checked on cleanup, as t.FailNow may only be called from the
+	// test's goroutine.
+	go func() {
+		done <- c.BeginContext(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+func TestClustersSideBySide(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	ips := []net.IP{
+		net.IPv4(10, 0, 0, 1),
+		net.IPv4(10, 0, 0, 2),
+		net.IPv4(10, 0, 0, 3),
+	}
+
+	clusters := make([]*Cluster, len(ips))
+	listeners := make([]*collectingBroadcastListener, len(ips))
+
+	for i, ip := range ips {
+		clusters[i] = newTestCluster(nw, ip)
+		listeners[i] = &collectingBroadcastListener{}
+		clusters[i].AddBroadcastListener(listeners[i])
+
+		if i > 0 {
+			seed, err := CreateNodeByIP(ips[0], 9999)
+			require.NoError(t, err)
+
+			clusters[i].AddNode(seed)
+		}
+
+		runTestCluster(t, clusters[i])
+	}
+
+	require.Eventually(t, func() bool {
+		for _, c := range clusters {
+			if len(c.HealthyNodes()) != len(ips) {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second*10, time.Millisecond*50)
+
+	_, err := clusters[0].BroadcastString("hello")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return listeners[1].count() == 1 && listeners[2].count() == 1
+	}, time.Second*10, time.Millisecond*50)
+
+	require.Zero(t, listeners[0].count())
+}
+
+func TestBeginContextStops(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	ipA := net.IPv4(10, 0, 1, 1)
+	ipB := net.IPv4(10, 0, 1, 2)
+
+	a := newTestCluster(nw, ipA)
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, ipB)
+	seed, err := CreateNodeByIP(ipA, 9999)
+	require.NoError(t, err)
+	b.AddNode(seed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- b.BeginContext(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(b.HealthyNodes()) == 2
+	}, time.Second*10, time.Millisecond*50)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("BeginContext did not return after its context was cancelled")
+	}
+
+	// The listening address has been released, so the node can start again.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		done <- b.BeginContext(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(b.HealthyNodes()) == 2
+	}, time.Second*10, time.Millisecond*50)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+type collectingStatusListener struct {
+	sync.Mutex
+	changes map[string][]NodeStatus
+}
+
+func (l *collectingStatusListener) OnChange(node *Node, status NodeStatus) {
+	l.Lock()
+	if l.changes == nil {
+		l.changes = make(map[string][]NodeStatus)
+	}
+	l.changes[node.Address()] = append(l.changes[node.Address()], status)
+	l.Unlock()
+}
+
+func (l *collectingStatusListener) statuses(address string) []NodeStatus {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]NodeStatus(nil), l.changes[address]...)
+}
+
+func TestLeave(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	ips := []net.IP{
+		net.IPv4(10, 0, 2, 1),
+		net.IPv4(10, 0, 2, 2),
+		net.IPv4(10, 0, 2, 3),
+	}
+
+	clusters := make([]*Cluster, len(ips))
+	listeners := make([]*collectingStatusListener, len(ips))
+
+	for i, ip := range ips {
+		clusters[i] = newTestCluster(nw, ip)
+		listeners[i] = &collectingStatusListener{}
+		clusters[i].AddStatusListener(listeners[i])
+
+		if i > 0 {
+			seed, err := CreateNodeByIP(ips[0], 9999)
+			require.NoError(t, err)
+
+			clusters[i].AddNode(seed)
+		}
+
+		runTestCluster(t, clusters[i])
+	}
+
+	require.Eventually(t, func() bool {
+		for _, c := range clusters {
+			if len(c.HealthyNodes()) != len(ips) {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second*10, time.Millisecond*50)
+
+	leaver := clusters[2].ThisHost().Address()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	require.NoError(t, clusters[2].Leave(ctx))
+
+	require.Eventually(t, func() bool {
+		return len(clusters[0].AllNodes()) == 2 && len(clusters[1].AllNodes()) == 2
+	}, time.Second*5, time.Millisecond*20)
+
+	// Give a suspicion cycle the chance to start, if it were going to.
+	time.Sleep(time.Millisecond * 500)
+
+	for _, l := range listeners[:2] {
+		statuses := l.statuses(leaver)
+		require.NotEmpty(t, statuses)
+		require.Equal(t, StatusLeft, statuses[len(statuses)-1])
+		require.NotContains(t, statuses, StatusSuspected)
+		require.NotContains(t, statuses, StatusDead)
+	}
+
+	require.Len(t, clusters[0].AllNodes(), 2)
+	require.Len(t, clusters[1].AllNodes(), 2)
+}
+
+func TestFailedNodeSuspectedThenDead(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	ips := []net.IP{
+		net.IPv4(10, 0, 5, 1),
+		net.IPv4(10, 0, 5, 2),
+		net.IPv4(10, 0, 5, 3),
+	}
+
+	clusters := make([]*Cluster, len(ips))
+	listener := &collectingStatusListener{}
+
+	for i, ip := range ips {
+		clusters[i] = newTestCluster(nw, ip)
+
+		if i > 0 {
+			seed, err := CreateNodeByIP(ips[0], 9999)
+			require.NoError(t, err)
+
+			clusters[i].AddNode(seed)
+		}
+	}
+
+	clusters[0].AddStatusListener(listener)
+
+	runTestCluster(t, clusters[0])
+	runTestCluster(t, clusters[1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- clusters[2].BeginContext(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		for _, c := range clusters {
+			if len(c.HealthyNodes()) != len(ips) {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second*10, time.Millisecond*50)
+
+	failed := clusters[2].ThisHost().Address()
+
+	// Stop the node without leaving, as if it had crashed.
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Eventually(t, func() bool {
+		statuses := listener.statuses(failed)
+
+		return len(statuses) > 0 && statuses[len(statuses)-1] == StatusDead
+	}, time.Second*10, time.Millisecond*20)
+
+	require.Contains(t, listener.statuses(failed), StatusSuspected)
+}
+
+func TestMetaReachesLateJoiner(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 7, 1))
+	require.NoError(t, a.SetLocalMeta(map[string]string{"role": "db"}))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 7, 2))
+	seed, err := CreateNodeByIP(net.IPv4(10, 0, 7, 1), 9999)
+	require.NoError(t, err)
+	b.AddNode(seed)
+	runTestCluster(t, b)
+
+	metaOf := func(c *Cluster, address string) map[string]string {
+		for _, n := range c.AllNodes() {
+			if n.Address() == address {
+				return n.Meta()
+			}
+		}
+
+		return nil
+	}
+
+	require.Eventually(t, func() bool {
+		return metaOf(b, a.ThisHost().Address())["role"] == "db"
+	}, time.Second*10, time.Millisecond*20)
+
+	require.NoError(t, a.SetLocalMeta(map[string]string{"role": "db", "leader": "yes"}))
+
+	require.Eventually(t, func() bool {
+		return metaOf(b, a.ThisHost().Address())["leader"] == "yes"
+	}, time.Second*10, time.Millisecond*20)
+}
+
+type collectingAddressListener struct {
+	sync.Mutex
+	moves []string
+}
+
+func (l *collectingAddressListener) OnAddressChange(node *Node, oldAddress string) {
+	l.Lock()
+	l.moves = append(l.moves, node.Name()+" "+oldAddress+" -> "+node.Address())
+	l.Unlock()
+}
+
+func (l *collectingAddressListener) count() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.moves)
+}
+
+func TestNodeKeepsIdentityAcrossAddresses(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 9, 1))
+	a.SetNodeName("a")
+	moves := &collectingAddressListener{}
+	a.AddAddressListener(moves)
+	statuses := &collectingStatusListener{}
+	a.AddStatusListener(statuses)
+	runTestCluster(t, a)
+
+	startB := func(ctx context.Context, ip net.IP) chan error {
+		b := newTestCluster(nw, ip)
+		b.SetNodeName("b")
+		seed, err := CreateNodeByIP(net.IPv4(10, 0, 9, 1), 9999)
+		require.NoError(t, err)
+		b.AddNode(seed)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- b.BeginContext(ctx)
+		}()
+
+		return done
+	}
+
+	named := func(name string) *Node {
+		for _, n := range a.AllNodes() {
+			if n.Name() == name {
+				return n
+			}
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startB(ctx, net.IPv4(10, 0, 9, 2))
+
+	require.Eventually(t, func() bool {
+		n := named("b")
+		return n != nil && n.Status() == StatusAlive
+	}, time.Second*10, time.Millisecond*20)
+
+	// The same node comes back at a different address.
+	cancel()
+	require.NoError(t, <-done)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	done = startB(ctx, net.IPv4(10, 0, 9, 3))
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	require.Eventually(t, func() bool {
+		n := named("b")
+		return n != nil && n.Address() == "10.0.9.3:9999" && n.Status() == StatusAlive
+	}, time.Second*10, time.Millisecond*20)
+
+	require.Equal(t, 1, moves.count())
+	require.Len(t, a.AllNodes(), 2)
+	require.NotContains(t, statuses.statuses("10.0.9.2:9999"), StatusLeft)
+}
+
+func TestPushPullOnJoin(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	// Slow gossip, so that only a push-pull could bring b up to date in time.
+	a := newTestCluster(nw, net.IPv4(10, 0, 12, 1))
+	a.SetHeartbeatMillis(5000)
+
+	for i := 0; i < 100; i++ {
+		n, err := CreateNodeByIP(net.IPv4(10, 0, 13, byte(i)), 9999)
+		require.NoError(t, err)
+		a.AddNode(n)
+	}
+
+	runTestCluster(t, a)
+
+	// a is listening once it knows its own address.
+	require.Eventually(t, func() bool {
+		return a.ThisHost() != nil
+	}, time.Second, time.Millisecond*5)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 12, 2))
+	b.SetHeartbeatMillis(5000)
+	seed, err := CreateNodeByIP(net.IPv4(10, 0, 12, 1), 9999)
+	require.NoError(t, err)
+	b.AddNode(seed)
+	runTestCluster(t, b)
+
+	require.Eventually(t, func() bool {
+		return len(b.AllNodes()) == 102 && len(a.AllNodes()) == 102
+	}, time.Second*2, time.Millisecond*20)
+}
+
+func TestJoin(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 14, 1))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 14, 2))
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Join waits for b to start; the seed that isn't there doesn't answer.
+	answered, err := b.Join(ctx, "10.0.14.1:9999", "10.0.14.9:9999")
+	require.NoError(t, err)
+	require.Equal(t, 1, answered)
+
+	require.Eventually(t, func() bool {
+		return len(a.HealthyNodes()) == 2
+	}, time.Second*5, time.Millisecond*20)
+}
+
+func TestJoinTimesOut(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	c := newTestCluster(nw, net.IPv4(10, 0, 15, 1))
+	runTestCluster(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	answered, err := c.Join(ctx, "10.0.15.2:9999")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 0, answered)
+
+	_, err = c.Join(ctx, "not an address")
+	require.Error(t, err)
+}
+
+func TestForeignClusterDropped(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 16, 1))
+	a.SetClusterName("staging-a")
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 16, 2))
+	b.SetClusterName("staging-b")
+	seed, err := CreateNodeByIP(net.IPv4(10, 0, 16, 1), 9999)
+	require.NoError(t, err)
+	b.AddNode(seed)
+	runTestCluster(t, b)
+
+	require.Eventually(t, func() bool {
+		return a.DroppedForeignMessages() > 0
+	}, time.Second*5, time.Millisecond*20)
+
+	// a never hears of b.
+	require.Len(t, a.AllNodes(), 1)
+}
+
+func TestEncryptedGossip(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	newKeyring := func(key []byte) *Keyring {
+		k, err := NewKeyring(nil, key)
+		require.NoError(t, err)
+		return k
+	}
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 17, 1))
+	a.SetKeyring(newKeyring(oldKey))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 17, 2))
+	b.SetKeyring(newKeyring(oldKey))
+	runTestCluster(t, b)
+
+	// c has the wrong key, so neither side can read the other.
+	c := newTestCluster(nw, net.IPv4(10, 0, 17, 3))
+	c.SetKeyring(newKeyring(newKey))
+	runTestCluster(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.17.1:9999")
+	require.NoError(t, err)
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer shortCancel()
+
+	_, err = c.Join(shortCtx, "10.0.17.1:9999")
+	require.Error(t, err)
+
+	// Rotate a and b onto c's key; all three then converge.
+	for _, cl := range []*Cluster{a, b} {
+		require.NoError(t, cl.GetKeyring().AddKey(newKey))
+	}
+
+	for _, cl := range []*Cluster{a, b} {
+		require.NoError(t, cl.GetKeyring().UseKey(newKey))
+		require.NoError(t, cl.GetKeyring().RemoveKey(oldKey))
+	}
+
+	_, err = c.Join(ctx, "10.0.17.1:9999")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(a.HealthyNodes()) == 3 && len(b.HealthyNodes()) == 3
+	}, time.Second*5, time.Millisecond*20)
+}
+
+func TestKeyringOperations(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	clusters := make([]*Cluster, 0, 3)
+
+	for i := 1; i <= 3; i++ {
+		keyring, err := NewKeyring(nil, oldKey)
+		require.NoError(t, err)
+
+		c := newTestCluster(nw, net.IPv4(10, 0, 18, byte(i)))
+		c.SetKeyring(keyring)
+		runTestCluster(t, c)
+
+		clusters = append(clusters, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	for _, c := range clusters[1:] {
+		_, err := c.Join(ctx, "10.0.18.1:9999")
+		require.NoError(t, err)
+	}
+
+	a := clusters[0]
+
+	require.Eventually(t, func() bool {
+		return len(a.HealthyNodes()) == 3
+	}, time.Second*5, time.Millisecond*20)
+
+	// Rotate from one node.
+	summary, err := a.InstallKey(ctx, newKey)
+	require.NoError(t, err)
+	require.Len(t, summary.Applied(), 3)
+
+	summary, err = a.UseKey(ctx, newKey)
+	require.NoError(t, err)
+	require.Len(t, summary.Applied(), 3)
+
+	summary, err = a.RemoveKey(ctx, oldKey)
+	require.NoError(t, err)
+	require.Len(t, summary.Applied(), 3)
+
+	for _, c := range clusters {
+		require.Equal(t, [][]byte{newKey}, c.GetKeyring().GetKeys())
+	}
+
+	summary, err = a.ListKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, summary.Results, 3)
+
+	for _, r := range summary.Results {
+		require.Equal(t, [][]byte{newKey}, r.Keys)
+	}
+
+	// Every node refuses to remove its primary key.
+	summary, err = a.RemoveKey(ctx, newKey)
+	require.Error(t, err)
+	require.Empty(t, summary.Applied())
+	require.Len(t, summary.Failed(), 3)
+}
+
+func TestSignedMessages(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 20, 1))
+	a.SetMessageSecret("open sesame")
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 20, 2))
+	b.SetMessageSecret("open sesame")
+	runTestCluster(t, b)
+
+	// c doesn't know the secret, so it can't forge anything.
+	c := newTestCluster(nw, net.IPv4(10, 0, 20, 3))
+	c.SetMessageSecret("open barley")
+	runTestCluster(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.20.1:9999")
+	require.NoError(t, err)
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer shortCancel()
+
+	_, err = c.Join(shortCtx, "10.0.20.1:9999")
+	require.Error(t, err)
+
+	require.Greater(t, a.RejectedMessages(), uint64(0))
+	require.Len(t, a.AllNodes(), 2)
+}
+
+func TestBroadcastBurstDrains(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	// Slow heartbeats: at one broadcast per message, the burst would take
+	// many seconds to get across.
+	a := newTestCluster(nw, net.IPv4(10, 0, 21, 1))
+	a.SetHeartbeatMillis(200)
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 21, 2))
+	b.SetHeartbeatMillis(200)
+	listener := &collectingBroadcastListener{}
+	b.AddBroadcastListener(listener)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.21.1:9999")
+	require.NoError(t, err)
+
+	for i := 0; i < 40; i++ {
+		_, err = a.BroadcastString(fmt.Sprintf("broadcast number %02d of the burst", i))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return listener.count() == 40
+	}, time.Second*2, time.Millisecond*20)
+}
+
+func TestOversizedBroadcastDropped(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 21, 3))
+	a.SetMaxBroadcastBytes(ReadBufSize * 2)
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 21, 4))
+	listener := &collectingBroadcastListener{}
+	b.AddBroadcastListener(listener)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.21.3:9999")
+	require.NoError(t, err)
+
+	// Too long for any message, so it can never be sent.
+	handle, err := a.BroadcastNamed("big", make([]byte, ReadBufSize))
+	require.NoError(t, err)
+
+	_, err = a.BroadcastString("small")
+	require.NoError(t, err)
+
+	err = handle.Wait(ctx)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, context.DeadlineExceeded)
+
+	require.Eventually(t, func() bool {
+		a.broadcasts.RLock()
+		defer a.broadcasts.RUnlock()
+
+		_, ok := a.broadcasts.m[handle.Label()]
+		return !ok && listener.count() == 1
+	}, time.Second*2, time.Millisecond*20)
+}
+
+func TestLargeBroadcast(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 24, 1))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 24, 2))
+	listener := &collectingBroadcastListener{}
+	b.AddBroadcastListener(listener)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.24.1:9999")
+	require.NoError(t, err)
+
+	payload := strings.Repeat("a config snippet, ", 300)
+	_, err = a.BroadcastString(payload)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return listener.count() == 1
+	}, time.Second*5, time.Millisecond*20)
+
+	// No second delivery, and no fragments leak through.
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, listener.count())
+
+	listener.Lock()
+	require.Equal(t, payload, listener.received[0])
+	listener.Unlock()
+}
+
+func TestSendTo(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 25, 1))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 25, 2))
+	listener := &collectingMessageListener{}
+	b.AddMessageListener(listener)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.25.1:9999")
+	require.NoError(t, err)
+
+	var node *Node
+	require.Eventually(t, func() bool {
+		for _, n := range a.AllNodes() {
+			if n.Address() == "10.0.25.2:9999" {
+				node = n
+				return true
+			}
+		}
+		return false
+	}, time.Second*5, time.Millisecond*20)
+
+	require.NoError(t, a.SendTo(node, []byte("just for you")))
+
+	require.Eventually(t, func() bool {
+		return listener.count() == 1
+	}, time.Second*5, time.Millisecond*20)
+
+	listener.Lock()
+	require.Equal(t, "just for you", listener.received[0])
+	require.Equal(t, "10.0.25.1:9999", listener.senders[0])
+	listener.Unlock()
+
+	// Too long for a packet.
+	require.Error(t, a.SendTo(node, make([]byte, ReadBufSize)))
+	require.Error(t, a.SendTo(nil, []byte("nobody")))
+}
+
+type echoQueryHandler struct {
+	from string
+}
+
+func (h echoQueryHandler) OnQuery(origin *Node, payload []byte) []byte {
+	return append([]byte(h.from+": "), payload...)
+}
+
+func TestQuery(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 26, 1))
+	a.AddQueryHandler("echo", echoQueryHandler{from: "a"})
+	runTestCluster(t, a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 26, 2))
+	b.AddQueryHandler("echo", echoQueryHandler{from: "b"})
+	runTestCluster(t, b)
+
+	// Node c acknowledges the query, but has no handler to answer it.
+	c := newTestCluster(nw, net.IPv4(10, 0, 26, 3))
+	runTestCluster(t, c)
+
+	for _, n := range []*Cluster{b, c} {
+		_, err := n.Join(ctx, "10.0.26.1:9999")
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(a.HealthyNodes()) == 3
+	}, time.Second*5, time.Millisecond*20)
+
+	queryCtx, queryCancel := context.WithTimeout(ctx, time.Second)
+	defer queryCancel()
+
+	resp, err := a.Query(queryCtx, "echo", []byte("hello"), nil)
+	require.NoError(t, err)
+
+	var answers []string
+	for r := range resp.Responses() {
+		answers = append(answers, string(r.Payload))
+	}
+
+	require.ElementsMatch(t, []string{"a: hello", "b: hello"}, answers)
+	require.Equal(t, 3, resp.AckCount())
+	require.Equal(t, 2, resp.ResponseCount())
+
+	// Only the nodes that pass the filter answer.
+	queryCtx, queryCancel = context.WithTimeout(ctx, time.Millisecond*500)
+	defer queryCancel()
+
+	resp, err = a.Query(queryCtx, "echo", []byte("again"),
+		&QueryFilter{Nodes: []string{"10.0.26.2:9999"}})
+	require.NoError(t, err)
+
+	answers = nil
+	for r := range resp.Responses() {
+		answers = append(answers, string(r.Payload))
+	}
+
+	require.Equal(t, []string{"b: again"}, answers)
+	require.Equal(t, 1, resp.AckCount())
+}
+
+func TestReliableBroadcastLateJoiner(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 27, 1))
+	a.SetBroadcastRetentionMillis(10000)
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 27, 2))
+	b.SetBroadcastRetentionMillis(10000)
+	early := &collectingBroadcastListener{}
+	b.AddBroadcastListener(early)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.27.1:9999")
+	require.NoError(t, err)
+
+	_, err = a.BroadcastString("before you came")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return early.count() == 1
+	}, time.Second*5, time.Millisecond*20)
+
+	// Wait for the broadcast to stop being gossiped.
+	require.Eventually(t, func() bool {
+		for _, c := range []*Cluster{a, b} {
+			for _, bc := range c.getBroadcastsToEmit() {
+				c.broadcasts.RLock()
+				pending := bc.emitCounter > 0
+				c.broadcasts.RUnlock()
+
+				if pending {
+					return false
+				}
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*20)
+
+	c := newTestCluster(nw, net.IPv4(10, 0, 27, 3))
+	c.SetBroadcastRetentionMillis(10000)
+	late := &collectingBroadcastListener{}
+	c.AddBroadcastListener(late)
+	runTestCluster(t, c)
+
+	_, err = c.Join(ctx, "10.0.27.2:9999")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return late.count() == 1
+	}, time.Second*5, time.Millisecond*20)
+
+	// Later exchanges don't deliver it again.
+	_, err = c.Join(ctx, "10.0.27.1:9999")
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, late.count())
+	require.Equal(t, 1, early.count())
+
+	late.Lock()
+	require.Equal(t, "before you came", late.received[0])
+	late.Unlock()
+}
+
+func TestNamedBroadcast(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 28, 1))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 28, 2))
+	listener := &collectingBroadcastListener{}
+	b.AddBroadcastListener(listener)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.28.1:9999")
+	require.NoError(t, err)
+
+	_, err = a.BroadcastNamed("leader", []byte("10.0.28.1"))
+	require.NoError(t, err)
+	_, err = a.BroadcastNamed("leader", []byte("10.0.28.2"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		listener.Lock()
+		defer listener.Unlock()
+
+		n := len(listener.received)
+		return n > 0 && listener.received[n-1] == "10.0.28.2"
+	}, time.Second*5, time.Millisecond*20)
+
+	// The superseded value was never sent.
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, listener.count())
+}
+
+func TestBroadcastAfterRestart(t *testing.T) {
+	nw := memtransport.NewNetwork()
+	ipA := net.IPv4(10, 0, 29, 1)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 29, 2))
+	listener := &collectingBroadcastListener{}
+	b.AddBroadcastListener(listener)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	a := newTestCluster(nw, ipA)
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- a.BeginContext(runCtx)
+	}()
+
+	_, err := b.Join(ctx, "10.0.29.1:9999")
+	require.NoError(t, err)
+
+	_, err = a.BroadcastString("before")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return listener.count() == 1
+	}, time.Second*5, time.Millisecond*20)
+
+	stop()
+	require.NoError(t, <-done)
+
+	// The restarted node's index counter starts over, but its epoch doesn't
+	// match, so its first broadcast isn't mistaken for the earlier one.
+	restarted := newTestCluster(nw, ipA)
+	runTestCluster(t, restarted)
+
+	_, err = restarted.Join(ctx, "10.0.29.2:9999")
+	require.NoError(t, err)
+
+	_, err = restarted.BroadcastString("after")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return listener.count() == 2
+	}, time.Second*5, time.Millisecond*20)
+
+	listener.Lock()
+	require.Equal(t, []string{"before", "after"}, listener.received)
+	listener.Unlock()
+}
+
+func TestBroadcastHandle(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 30, 1))
+	runTestCluster(t, a)
+
+	listeners := make([]*collectingBroadcastListener, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for i := range listeners {
+		n := newTestCluster(nw, net.IPv4(10, 0, 30, byte(i+2)))
+		listeners[i] = &collectingBroadcastListener{}
+		n.AddBroadcastListener(listeners[i])
+		runTestCluster(t, n)
+
+		_, err := n.Join(ctx, "10.0.30.1:9999")
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(a.HealthyNodes()) == 3
+	}, time.Second*5, time.Millisecond*20)
+
+	// Done once emitted.
+	handle, err := a.BroadcastString("emitted")
+	require.NoError(t, err)
+	require.NoError(t, handle.Wait(ctx))
+
+	emitted, planned := handle.Progress()
+	require.Equal(t, planned, emitted)
+	require.Positive(t, planned)
+
+	// Done once every other node has acknowledged it.
+	a.SetBroadcastAckPercent(100)
+
+	handle, err = a.BroadcastString("acknowledged")
+	require.NoError(t, err)
+	require.NoError(t, handle.Wait(ctx))
+	require.Equal(t, 2, handle.Acks())
+
+	// Fragmented broadcasts are acknowledged once reassembled.
+	long := strings.Repeat("acknowledged in fragments, ", 40)
+
+	handle, err = a.BroadcastString(long)
+	require.NoError(t, err)
+	require.NoError(t, handle.Wait(ctx))
+	require.Equal(t, 2, handle.Acks())
+
+	for _, l := range listeners {
+		l.Lock()
+		require.Contains(t, l.received, "acknowledged")
+		require.Contains(t, l.received, long)
+		l.Unlock()
+	}
+}
+
+func TestTopicBroadcast(t *testing.T) {
+	nw := memtransport.NewNetwork()
+
+	a := newTestCluster(nw, net.IPv4(10, 0, 31, 1))
+	runTestCluster(t, a)
+
+	b := newTestCluster(nw, net.IPv4(10, 0, 31, 2))
+	all := &collectingBroadcastListener{}
+	deploy := &collectingBroadcastListener{}
+	b.AddBroadcastListener(all)
+	b.SubscribeTopic("deploy", deploy)
+	runTestCluster(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := b.Join(ctx, "10.0.31.1:9999")
+	require.NoError(t, err)
+
+	_, err = a.BroadcastTopic("metrics", []byte("cpu=3"))
+	require.NoError(t, err)
+	_, err = a.BroadcastTopic("deploy", []byte("v1.2.3"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return deploy.count() == 1
+	}, time.Second*5, time.Millisecond*20)
+
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, deploy.count())
+	require.Zero(t, all.count())
+
+	deploy.Lock()
+	require.Equal(t, "v1.2.3", deploy.received[0])
+	deploy.Unlock()
+}
@@ -2,69 +2,549 @@ package smudge
 
 import (
 	"context"
-	"fmt"
 	"net"
 
 	"github.com/andyollylarkin/smudge-custom-transport/transport"
 )
 
+// The package-level functions in this file are thin wrappers that operate on
+// a default Cluster instance, for programs that only need one membership per
+// process. Use NewCluster() to run several side by side.
+var defaultCluster = NewCluster()
+
 // GetNodes get all connected nodes.
 func GetNodes() []*Node {
-	return AllNodes()
+	return defaultCluster.AllNodes()
 }
 
+// ThisHost returns the node that represents this process in the default
+// cluster.
 func ThisHost() *Node {
-	return thisHost
+	return defaultCluster.ThisHost()
 }
 
+// RunGossip configures the default cluster, joins through the initial node
+// (if any; see Join) and runs the gossip until ctx is done. It returns once
+// the node has fully stopped.
 func RunGossip(ctx context.Context, trns transport.Transport, listenIp string, listenPort int,
 	initialNodeAddr string, logger Logger, logLvl LogLevel,
 ) error {
-	var ip net.IP
+	return defaultCluster.RunGossip(ctx, trns, listenIp, listenPort, initialNodeAddr, logger, logLvl)
+}
+
+// SetTransport sets the transport used to exchange messages with other
+// nodes. If no transport is set, UDP is used. It has no effect once Begin()
+// has been called.
+func SetTransport(trns transport.Transport) {
+	defaultCluster.SetTransport(trns)
+}
+
+// Begin starts the server by opening a UDP port and beginning the heartbeat.
+// Note that this is a blocking function, so act appropriately.
+func Begin() {
+	defaultCluster.Begin()
+}
+
+// BeginContext is like Begin, but the node runs only until ctx is done. At
+// that point the heartbeat stops, the listening connection is closed, and
+// BeginContext returns once every background goroutine has exited. An error
+// is returned if the listening connection can't be opened.
+func BeginContext(ctx context.Context) error {
+	return defaultCluster.BeginContext(ctx)
+}
+
+// DroppedForeignMessages returns the number of messages that have been
+// dropped because they were sent by a node of another cluster; that is, one
+// with a different cluster name.
+func DroppedForeignMessages() uint64 {
+	return defaultCluster.DroppedForeignMessages()
+}
+
+// RejectedMessages returns the number of packets that have been rejected
+// because they failed verification: their checksum was wrong, their
+// signature didn't match the message secret, or they couldn't be decrypted.
+// Multicast announcements that can't be read are counted too.
+func RejectedMessages() uint64 {
+	return defaultCluster.RejectedMessages()
+}
+
+// GetKeyring returns the keyring that gossip is encrypted with, or nil if
+// gossip isn't encrypted. If no keyring has been set, one is made from the
+// base64-encoded key in SMUDGE_GOSSIP_KEY (if any).
+func GetKeyring() *Keyring {
+	return defaultCluster.GetKeyring()
+}
+
+// InstallKey installs key in the keyring of every node in the cluster,
+// starting with this one. The change is spread as a broadcast (repeated with
+// a backoff until every node has replied), and each node replies with its
+// outcome. InstallKey returns once every node that was healthy has replied,
+// or ctx is done, with a summary of which nodes applied the change. An error
+// is returned if any of them failed or didn't reply.
+func InstallKey(ctx context.Context, key []byte) (*KeyringSummary, error) {
+	return defaultCluster.InstallKey(ctx, key)
+}
+
+// Join adds the given seeds (as IP or IP:PORT) to the known nodes, and
+// exchanges membership state with them until at least one has answered. Seeds
+// that don't answer are retried with an exponential backoff. It returns the
+// number of seeds that answered, or an error if none of them did before ctx
+// was done.
+//
+// Join must be called while the node is running (see BeginContext); if it
+// hasn't started yet, Join waits for it.
+func Join(ctx context.Context, seeds ...string) (int, error) {
+	return defaultCluster.Join(ctx, seeds...)
+}
+
+// Leave announces to the cluster that this node is leaving on purpose. It
+// sends a LEAVE to other healthy nodes until enough of them (as many as a
+// status update is normally gossiped to) have acknowledged it, and then
+// returns. Peers remove the node right away, without suspecting it first,
+// and notify their status listeners with StatusLeft.
+//
+// This node stops pinging once Leave has been called. It is still running,
+// though: cancel the context passed to BeginContext to shut it down. If ctx
+// is done before the departure has spread, its error is returned.
+func Leave(ctx context.Context) error {
+	return defaultCluster.Leave(ctx)
+}
+
+// ListKeys collects the keys installed on every node in the cluster; each
+// result holds the keys of one node. It reports its outcome as InstallKey
+// does.
+func ListKeys(ctx context.Context) (*KeyringSummary, error) {
+	return defaultCluster.ListKeys(ctx)
+}
+
+// PingNode can be used to explicitly ping a node. Calls the low-level
+// doPingNode(), and outputs a message (and returns an error) if it fails.
+func PingNode(node *Node) error {
+	return defaultCluster.PingNode(node)
+}
+
+// AddNode can be used to explicitly add a node to the list of known live
+// nodes. Updates the node timestamp but DOES NOT implicitly update the node's
+// status; you need to do this explicitly.
+func AddNode(node *Node) (*Node, error) {
+	return defaultCluster.AddNode(node)
+}
+
+// CreateNodeByAddress will create and return a new node when supplied with a
+// node address ("ip:port" string). This doesn't add the node to the list of
+// live nodes; use AddNode().
+func CreateNodeByAddress(address string) (*Node, error) {
+	return defaultCluster.CreateNodeByAddress(address)
+}
+
+// TryGetLocalIP4 try get ipv4 listen address. If v4 address not set, return default listen address.
+func TryGetLocalIPv4() (net.IP, error) {
+	return defaultCluster.TryGetLocalIPv4()
+}
+
+// AllNodes will return a list of all nodes known at the time of the request,
+// including nodes that have been marked as "dead" but haven't yet been
+// removed from the registry.
+func AllNodes() []*Node {
+	return defaultCluster.AllNodes()
+}
+
+// HealthyNodes will return a list of all nodes known at the time of the
+// request with a healthy status.
+func HealthyNodes() []*Node {
+	return defaultCluster.HealthyNodes()
+}
+
+// RemoveNode can be used to explicitly remove a node from the list of known
+// live nodes. Updates the node timestamp but DOES NOT implicitly update the
+// node's status; you need to do this explicitly.
+func RemoveNode(node *Node) (*Node, error) {
+	return defaultCluster.RemoveNode(node)
+}
+
+// UpdateNodeStatus assigns a new status for the specified node and adds it to
+// the list of recently updated nodes. If the status is StatusDead, then the
+// node will be moved from the live nodes list to the dead nodes list.
+func UpdateNodeStatus(node *Node, status NodeStatus, statusSource *Node) {
+	defaultCluster.UpdateNodeStatus(node, status, statusSource)
+}
+
+// BroadcastBytes allows a user to emit a broadcast in the form of a byte
+// slice, which will be transmitted at most once to all other healthy current
+// members. Members that join after the broadcast has already propagated
+// through the cluster will not receive the message, unless broadcasts are
+// kept for them (see SetBroadcastRetentionMillis). Broadcasts longer than
+// GetMaxBroadcastBytes() (256 bytes by default) are split into fragments,
+// which are reassembled by the receivers; the maximum length is
+// MaxFragmentedBroadcastBytes. The returned handle tells when the broadcast
+// has been spread (see BroadcastHandle).
+func BroadcastBytes(bytes []byte) (*BroadcastHandle, error) {
+	return defaultCluster.BroadcastBytes(bytes)
+}
+
+// BroadcastNamed emits bytes as the latest value of the broadcast called
+// name. It supersedes any earlier broadcast of the same name from this node:
+// those stop being gossiped, here and on every node that receives this one,
+// and listeners aren't passed them once they've been passed a newer one. The
+// name (1 to 255 bytes) and bytes must fit in a single broadcast, as named
+// broadcasts aren't fragmented. The returned handle tells when the broadcast
+// has been spread (see BroadcastHandle).
+func BroadcastNamed(name string, bytes []byte) (*BroadcastHandle, error) {
+	return defaultCluster.BroadcastNamed(name, bytes)
+}
+
+// BroadcastString allows a user to emit a broadcast in the form of a string,
+// which will be transmitted at most once to all other healthy current
+// members. Members that join after the broadcast has already propagated
+// through the cluster will not receive the message, unless broadcasts are
+// kept for them. Long broadcasts are fragmented, as with BroadcastBytes.
+func BroadcastString(str string) (*BroadcastHandle, error) {
+	return defaultCluster.BroadcastString(str)
+}
+
+// BroadcastTopic emits bytes on topic. It is passed to the listeners that
+// subscribed to topic (see SubscribeTopic) on every node that receives it,
+// and to no others. The topic (1 to 255 bytes) and bytes must fit in a single
+// broadcast, as topic broadcasts aren't fragmented. The returned handle tells
+// when the broadcast has been spread (see BroadcastHandle).
+func BroadcastTopic(topic string, bytes []byte) (*BroadcastHandle, error) {
+	return defaultCluster.BroadcastTopic(topic, bytes)
+}
+
+// AddBroadcastListener allows the submission of a BroadcastListener implementation
+// whose OnChange() function will be called whenever the node is notified of any
+// change in the status of a cluster member.
+func AddBroadcastListener(listener BroadcastListener) {
+	defaultCluster.AddBroadcastListener(listener)
+}
+
+// SubscribeTopic registers a listener whose OnBroadcast() function is called
+// whenever this node receives a broadcast on topic (see BroadcastTopic).
+// Broadcast listeners added with AddBroadcastListener() aren't passed topic
+// broadcasts.
+func SubscribeTopic(topic string, listener BroadcastListener) {
+	defaultCluster.SubscribeTopic(topic, listener)
+}
+
+// AddMessageListener allows the submission of a MessageListener
+// implementation whose OnMessage() function will be called whenever another
+// node sends this one a message with SendTo().
+func AddMessageListener(listener MessageListener) {
+	defaultCluster.AddMessageListener(listener)
+}
+
+// SendTo sends payload straight to node, over the configured transport, as a
+// USER message. The receiving node passes it to its message listeners, along
+// with this node as the sender. Like any other message, it may be lost: SendTo
+// only reports whether it could be sent. The payload must fit in a single
+// packet, along with the message header; for UDP, that's a little over a
+// kilobyte.
+func SendTo(node *Node, payload []byte) error {
+	return defaultCluster.SendTo(node, payload)
+}
+
+// AddQueryHandler registers the handler that answers the queries named name
+// on this node, in place of any handler registered for it before. Nodes that
+// have no handler for a query still acknowledge it.
+func AddQueryHandler(name string, handler QueryHandler) {
+	defaultCluster.AddQueryHandler(name, handler)
+}
+
+// Query asks the healthy nodes of the cluster (this one included) that pass
+// filter, or all of them if filter is nil, the query named name. The query is
+// spread like a broadcast, so payload and filter must fit in one, along with
+// the name. Each node that receives it acknowledges it, and answers it with
+// its handler for name, if it has one, straight to this node. Query returns
+// at once: the responses are streamed by the returned QueryResponse until
+// ctx is done, so ctx should have a deadline.
+func Query(ctx context.Context, name string, payload []byte, filter *QueryFilter) (*QueryResponse, error) {
+	return defaultCluster.Query(ctx, name, payload, filter)
+}
+
+// AddStatusListener allows the submission of a StatusListener implementation
+// whose OnChange() function will be called whenever the node is notified of any
+// change in the status of a cluster member.
+func AddStatusListener(listener StatusListener) {
+	defaultCluster.AddStatusListener(listener)
+}
+
+// AddAddressListener allows the submission of an AddressListener
+// implementation whose OnAddressChange() function will be called whenever a
+// known cluster member (identified by its name) is found at a new address.
+func AddAddressListener(listener AddressListener) {
+	defaultCluster.AddAddressListener(listener)
+}
+
+// AddIncompatibleListener allows the submission of an IncompatibleListener
+// implementation whose OnIncompatible() function will be called whenever a
+// message arrives from a node that has no protocol version in common with
+// this one.
+func AddIncompatibleListener(listener IncompatibleListener) {
+	defaultCluster.AddIncompatibleListener(listener)
+}
+
+// AddMetaListener allows the submission of a MetaListener implementation
+// whose OnMetaChange() function will be called whenever the node is notified
+// of new metadata for another cluster member.
+func AddMetaListener(listener MetaListener) {
+	defaultCluster.AddMetaListener(listener)
+}
 
-	var err error
+// RemoveKey removes key from the keyring of every node in the cluster. Nodes
+// that use it as their primary key refuse to remove it. It reports its
+// outcome as InstallKey does.
+func RemoveKey(ctx context.Context, key []byte) (*KeyringSummary, error) {
+	return defaultCluster.RemoveKey(ctx, key)
+}
+
+// SetKeyring sets the keyring that gossip is encrypted with. Once it is set,
+// every packet sent is encrypted with its primary key, and packets that
+// can't be decrypted with any of its keys (plaintext ones included) are
+// dropped. All nodes of a cluster need a key in common. Keys can be rotated
+// through the keyring while the node is running.
+func SetKeyring(keyring *Keyring) {
+	defaultCluster.SetKeyring(keyring)
+}
+
+// UseKey makes key, which must already be installed everywhere, the primary
+// key of every node in the cluster. It reports its outcome as InstallKey
+// does.
+func UseKey(ctx context.Context, key []byte) (*KeyringSummary, error) {
+	return defaultCluster.UseKey(ctx, key)
+}
+
+// SetLocalMeta sets the metadata of this node: a small set of key/value pairs
+// (role, zone, version, and so on) that is gossiped to the rest of the
+// cluster along with the node's status. Each call replaces the previous
+// metadata with a newer version. An error is returned if the metadata is
+// too large to be encoded; see MaxMetaBytes.
+func SetLocalMeta(meta map[string]string) error {
+	return defaultCluster.SetLocalMeta(meta)
+}
+
+// GetClusterName gets the name of the cluster. Messages (multicast or not)
+// from differently-named instances are ignored.
+func GetClusterName() string {
+	return defaultCluster.GetClusterName()
+}
+
+// GetHeartbeatMillis gets this host's heartbeat frequency in milliseconds.
+func GetHeartbeatMillis() int {
+	return defaultCluster.GetHeartbeatMillis()
+}
+
+// GetInitialHosts returns the list of initially known hosts.
+func GetInitialHosts() []string {
+	return defaultCluster.GetInitialHosts()
+}
+
+// GetListenPort returns the port that this host will listen on.
+func GetListenPort() int {
+	return defaultCluster.GetListenPort()
+}
+
+// GetListenIP returns the IP that this host will listen on.
+func GetListenIP() net.IP {
+	return defaultCluster.GetListenIP()
+}
+
+// GetMaxBroadcastBytes returns the maximum byte length for broadcast payloads.
+// Longer broadcasts are split into fragments of this size.
+func GetMaxBroadcastBytes() int {
+	return defaultCluster.GetMaxBroadcastBytes()
+}
+
+// GetMinPingTime returns the minimum ping response time in milliseconds. Ping
+// response times below this value are recorded as this minimum.
+func GetMinPingTime() int {
+	return defaultCluster.GetMinPingTime()
+}
+
+// GetMulticastEnabled returns whether multicast announcements are enabled.
+func GetMulticastEnabled() bool {
+	return defaultCluster.GetMulticastEnabled()
+}
+
+// GetMulticastAnnounceIntervalSeconds returns the amount of seconds to wait between
+// multicast announcements.
+func GetMulticastAnnounceIntervalSeconds() int {
+	return defaultCluster.GetMulticastAnnounceIntervalSeconds()
+}
+
+// GetMulticastAddress returns the address the will be used for multicast
+// announcements.
+func GetMulticastAddress() string {
+	return defaultCluster.GetMulticastAddress()
+}
+
+// GetMulticastPort returns the defined multicast announcement listening port.
+func GetMulticastPort() int {
+	return defaultCluster.GetMulticastPort()
+}
+
+// GetNodeName returns the name of this node. If no name has been set, one
+// is generated; see GetNodeNameFile().
+func GetNodeName() string {
+	return defaultCluster.GetNodeName()
+}
+
+// GetNodeNameFile returns the file that a generated node name is kept in.
+// Empty string indicates that a generated name isn't kept.
+func GetNodeNameFile() string {
+	return defaultCluster.GetNodeNameFile()
+}
 
-	if listenIp == "" {
-		ip, err = GetLocalIP()
-		if err != nil {
-			return fmt.Errorf("Could not get local ip: %w", err)
-		}
-	} else {
-		ip = net.ParseIP(listenIp)
-	}
+// GetMessageSecret returns the secret that messages are signed with. Empty
+// string indicates that messages aren't signed.
+func GetMessageSecret() string {
+	return defaultCluster.GetMessageSecret()
+}
 
-	SetTransport(trns)
+// GetPushPullIntervalMillis returns the interval (in milliseconds) between
+// full membership state exchanges with a random node. A negative value means
+// that they're disabled, except on joining.
+func GetPushPullIntervalMillis() int {
+	return defaultCluster.GetPushPullIntervalMillis()
+}
 
-	if logger != nil {
-		SetLogger(logger)
-	} else {
-		SetLogThreshold(LogAll)
-	}
+// GetBroadcastRetentionMillis returns how long (in milliseconds) broadcasts
+// are kept, so that nodes that missed them can catch up. 0 means that
+// reliable broadcasts are disabled.
+func GetBroadcastRetentionMillis() int {
+	return defaultCluster.GetBroadcastRetentionMillis()
+}
 
-	SetLogThreshold(logLvl)
-	SetListenPort(listenPort)
-	SetHeartbeatMillis(heartbeatMillis)
-	SetListenIP(ip)
+// GetBroadcastAckPercent returns the percentage of the other healthy nodes
+// that must acknowledge a broadcast before its handle is done. 0 means that
+// broadcasts aren't acknowledged.
+func GetBroadcastAckPercent() int {
+	return defaultCluster.GetBroadcastAckPercent()
+}
 
-	if ip.To4() == nil {
-		SetMaxBroadcastBytes(512) // 512 for IPv6
-	}
+// GetPingHistoryFrontload returns the value (in milliseconds) used to
+// pre-populate the ping history buffer, which is used to dynamically calculate
+// ping timeouts and is gradually overwritten with real data over time.
+func GetPingHistoryFrontload() int {
+	return defaultCluster.GetPingHistoryFrontload()
+}
 
-	if initialNodeAddr != "" {
-		node, err := CreateNodeByAddress(initialNodeAddr)
+// SetClusterName sets the name of the cluster. Messages (multicast or not)
+// from differently-named instances are ignored.
+func SetClusterName(val string) {
+	defaultCluster.SetClusterName(val)
+}
 
-		if err == nil {
-			AddNode(node)
-		} else {
-			fmt.Println(err)
-		}
-	}
+// SetHeartbeatMillis sets this nodes heartbeat frequency. Unlike
+// SetListenPort(), calling this function after Begin() has been called will
+// have an effect.
+func SetHeartbeatMillis(val int) {
+	defaultCluster.SetHeartbeatMillis(val)
+}
 
-	go func() {
-		Begin()
-	}()
+// SetListenPort sets the UDP port to listen on. It has no effect once
+// Begin() has been called.
+func SetListenPort(val int) {
+	defaultCluster.SetListenPort(val)
+}
 
-	<-ctx.Done()
+// SetListenIP sets the IP to listen on. It has no effect once
+// Begin() has been called.
+func SetListenIP(val net.IP) {
+	defaultCluster.SetListenIP(val)
+}
+
+// SetMaxBroadcastBytes sets the maximum byte length for broadcast payloads.
+// Longer broadcasts are split into fragments of this size. Note that
+// increasing this beyond the default of 256 runs the risk of packet
+// fragmentation and dropped messages.
+func SetMaxBroadcastBytes(val int) {
+	defaultCluster.SetMaxBroadcastBytes(val)
+}
+
+// SetMinPingTime sets the minimum ping response time in milliseconds. Ping
+// response times below this value are recorded as this minimum.
+func SetMinPingTime(val int) {
+	defaultCluster.SetMinPingTime(val)
+}
+
+// SetMulticastAddress sets the address that will be used for multicast
+// announcements.
+func SetMulticastAddress(val string) {
+	defaultCluster.SetMulticastAddress(val)
+}
+
+// SetMulticastEnabled sets whether multicast announcements are enabled.
+func SetMulticastEnabled(val bool) {
+	defaultCluster.SetMulticastEnabled(val)
+}
+
+// SetMulticastAnnounceIntervalSeconds sets the number of seconds between multicast announcements
+func SetMulticastAnnounceIntervalSeconds(val int) {
+	defaultCluster.SetMulticastAnnounceIntervalSeconds(val)
+}
+
+// SetMulticastPort sets multicast announcement listening port.
+func SetMulticastPort(val int) {
+	defaultCluster.SetMulticastPort(val)
+}
+
+// SetNodeName sets the name of this node, which identifies it in the
+// cluster whatever its address. It must be unique within the cluster, and
+// may be up to 255 bytes long; a longer name is rejected with an error. It
+// has no effect once Begin() has been called.
+func SetNodeName(val string) error {
+	return defaultCluster.SetNodeName(val)
+}
+
+// SetNodeNameFile sets the file that a generated node name is kept in, so
+// that the node keeps its name across restarts. If the file doesn't exist,
+// it is created; if it holds a name longer than 255 bytes, it is rejected
+// with an error. It has no effect once Begin() has been called, or if a node
+// name has been set.
+func SetNodeNameFile(val string) error {
+	return defaultCluster.SetNodeNameFile(val)
+}
+
+// SetPingHistoryFrontload sets the value (in milliseconds) used to
+// pre-populate the ping history buffer, which is used to dynamically calculate
+// ping timeouts and is gradually overwritten with real data over time.
+// Setting this to 0 will restore the default value.
+func SetPingHistoryFrontload(val int) {
+	defaultCluster.SetPingHistoryFrontload(val)
+}
+
+// SetMessageSecret sets the secret that every message is signed with
+// (HMAC-SHA256), so that nodes that don't know it can't forge statuses.
+// Messages whose signature doesn't match are rejected (see
+// RejectedMessages). All nodes of a cluster must share the secret. Empty
+// string restores the default value.
+func SetMessageSecret(val string) {
+	defaultCluster.SetMessageSecret(val)
+}
+
+// SetPushPullIntervalMillis sets the interval (in milliseconds) between full
+// membership state exchanges with a random node, which speed up convergence
+// after partitions heal. A negative value disables them, except on joining;
+// 0 restores the default value.
+func SetPushPullIntervalMillis(val int) {
+	defaultCluster.SetPushPullIntervalMillis(val)
+}
+
+// SetBroadcastRetentionMillis sets how long (in milliseconds) broadcasts are
+// kept after they are sent or received. While they are, they're offered to
+// the nodes that this one exchanges state with, so that nodes that join (or
+// come back) within that time catch up on them. 0 restores the default,
+// which disables reliable broadcasts.
+func SetBroadcastRetentionMillis(val int) {
+	defaultCluster.SetBroadcastRetentionMillis(val)
+}
 
-	return nil
+// SetBroadcastAckPercent sets the percentage (1 to 100) of the other healthy
+// nodes that must acknowledge the broadcasts sent from then on before their
+// handles are done. Nodes that receive such a broadcast acknowledge it once
+// they've passed it to their listeners. 0 restores the default, under which
+// a handle is done once its broadcast has been emitted as many times as it's
+// meant to be.
+func SetBroadcastAckPercent(val int) {
+	defaultCluster.SetBroadcastAckPercent(val)
 }
@@ -16,42 +16,32 @@ limitations under the License.
 
 package smudge
 
-import "sync"
-
-var broadcastListeners = struct {
-	sync.RWMutex
-	s []BroadcastListener
-}{s: make([]BroadcastListener, 0, 16)}
-
-var statusListeners = struct {
-	sync.RWMutex
-	s []StatusListener
-}{s: make([]StatusListener, 0, 16)}
-
 // BroadcastListener is the interface that must be implemented to take advantage
 // of the cluster member status update notification functionality provided by
 // the AddBroadcastListener() function.
 type BroadcastListener interface {
 	// The OnBroadcast() function is called whenever the node is notified of
-	// an incoming broadcast message.
+	// an incoming broadcast message. Listeners added with
+	// AddBroadcastListener() aren't passed topic broadcasts, which only go to
+	// the subscribers of their topic (see SubscribeTopic).
 	OnBroadcast(broadcast *Broadcast)
 }
 
 // AddBroadcastListener allows the submission of a BroadcastListener implementation
 // whose OnChange() function will be called whenever the node is notified of any
 // change in the status of a cluster member.
-func AddBroadcastListener(listener BroadcastListener) {
-	broadcastListeners.Lock()
-	broadcastListeners.s = append(broadcastListeners.s, listener)
-	broadcastListeners.Unlock()
+func (c *Cluster) AddBroadcastListener(listener BroadcastListener) {
+	c.broadcastListeners.Lock()
+	c.broadcastListeners.s = append(c.broadcastListeners.s, listener)
+	c.broadcastListeners.Unlock()
 }
 
-func doBroadcastUpdate(broadcast *Broadcast) {
-	broadcastListeners.RLock()
-	for _, sl := range broadcastListeners.s {
+func (c *Cluster) doBroadcastUpdate(broadcast *Broadcast) {
+	c.broadcastListeners.RLock()
+	for _, sl := range c.broadcastListeners.s {
 		sl.OnBroadcast(broadcast)
 	}
-	broadcastListeners.RUnlock()
+	c.broadcastListeners.RUnlock()
 }
 
 // StatusListener is the interface that must be implemented to take advantage
@@ -66,16 +56,123 @@ type StatusListener interface {
 // AddStatusListener allows the submission of a StatusListener implementation
 // whose OnChange() function will be called whenever the node is notified of any
 // change in the status of a cluster member.
-func AddStatusListener(listener StatusListener) {
-	statusListeners.Lock()
-	statusListeners.s = append(statusListeners.s, listener)
-	statusListeners.Unlock()
+func (c *Cluster) AddStatusListener(listener StatusListener) {
+	c.statusListeners.Lock()
+	c.statusListeners.s = append(c.statusListeners.s, listener)
+	c.statusListeners.Unlock()
 }
 
-func doStatusUpdate(node *Node, status NodeStatus) {
-	statusListeners.RLock()
-	for _, sl := range statusListeners.s {
+func (c *Cluster) doStatusUpdate(node *Node, status NodeStatus) {
+	c.statusListeners.RLock()
+	for _, sl := range c.statusListeners.s {
 		sl.OnChange(node, status)
 	}
-	statusListeners.RUnlock()
+	c.statusListeners.RUnlock()
+}
+
+// AddressListener is the interface that must be implemented to take
+// advantage of the cluster member address change notification functionality
+// provided by the AddAddressListener() function.
+type AddressListener interface {
+	// The OnAddressChange() function is called whenever a known cluster
+	// member (identified by its name) is found at a new address.
+	OnAddressChange(node *Node, oldAddress string)
+}
+
+// AddAddressListener allows the submission of an AddressListener
+// implementation whose OnAddressChange() function will be called whenever a
+// known cluster member (identified by its name) is found at a new address.
+func (c *Cluster) AddAddressListener(listener AddressListener) {
+	c.addressListeners.Lock()
+	c.addressListeners.s = append(c.addressListeners.s, listener)
+	c.addressListeners.Unlock()
+}
+
+func (c *Cluster) doAddressUpdate(node *Node, oldAddress string) {
+	c.addressListeners.RLock()
+	for _, al := range c.addressListeners.s {
+		al.OnAddressChange(node, oldAddress)
+	}
+	c.addressListeners.RUnlock()
+}
+
+// MetaListener is the interface that must be implemented to take advantage
+// of the cluster member metadata update notification functionality provided
+// by the AddMetaListener() function.
+type MetaListener interface {
+	// The OnMetaChange() function is called whenever the node is notified of
+	// new metadata for another cluster member.
+	OnMetaChange(node *Node, meta map[string]string)
+}
+
+// AddMetaListener allows the submission of a MetaListener implementation
+// whose OnMetaChange() function will be called whenever the node is notified
+// of new metadata for another cluster member.
+func (c *Cluster) AddMetaListener(listener MetaListener) {
+	c.metaListeners.Lock()
+	c.metaListeners.s = append(c.metaListeners.s, listener)
+	c.metaListeners.Unlock()
+}
+
+func (c *Cluster) doMetaUpdate(node *Node, meta map[string]string) {
+	c.metaListeners.RLock()
+	for _, ml := range c.metaListeners.s {
+		ml.OnMetaChange(node, meta)
+	}
+	c.metaListeners.RUnlock()
+}
+
+// IncompatibleListener is the interface that must be implemented to take
+// advantage of the incompatible node notification functionality provided by
+// the AddIncompatibleListener() function.
+type IncompatibleListener interface {
+	// The OnIncompatible() function is called whenever a message arrives
+	// from a node that has no protocol version in common with this one. As
+	// the message can't be read, the node is known only by the address the
+	// message came from, and the range of versions it supports.
+	OnIncompatible(address string, minVersion, maxVersion uint8)
+}
+
+// AddIncompatibleListener allows the submission of an IncompatibleListener
+// implementation whose OnIncompatible() function will be called whenever a
+// message arrives from a node that has no protocol version in common with
+// this one.
+func (c *Cluster) AddIncompatibleListener(listener IncompatibleListener) {
+	c.incompatibleListeners.Lock()
+	c.incompatibleListeners.s = append(c.incompatibleListeners.s, listener)
+	c.incompatibleListeners.Unlock()
+}
+
+func (c *Cluster) doIncompatibleUpdate(address string, minVersion, maxVersion uint8) {
+	c.incompatibleListeners.RLock()
+	for _, il := range c.incompatibleListeners.s {
+		il.OnIncompatible(address, minVersion, maxVersion)
+	}
+	c.incompatibleListeners.RUnlock()
+}
+
+// MessageListener is the interface that must be implemented to take
+// advantage of the point-to-point message functionality provided by the
+// AddMessageListener() function.
+type MessageListener interface {
+	// The OnMessage() function is called whenever another node sends this
+	// one a message with SendTo().
+	OnMessage(sender *Node, payload []byte)
+}
+
+// AddMessageListener allows the submission of a MessageListener
+// implementation whose OnMessage() function will be called whenever another
+// node sends this one a message with SendTo().
+func (c *Cluster) AddMessageListener(listener MessageListener) {
+	c.messageListeners.Lock()
+	c.messageListeners.s = append(c.messageListeners.s, listener)
+	c.messageListeners.Unlock()
+}
+
+func (c *Cluster) doMessageUpdate(sender *Node, payload []byte) {
+	c.messageListeners.RLock()
+	for _, ml := range c.messageListeners.s {
+		ml.OnMessage(sender, payload)
+	}
+	c.messageListeners.RUnlock()
 }
@@ -31,17 +31,17 @@ func (l *TestBroadcastListener) OnBroadcast(broadcast *Broadcast) {
 }
 
 func TestBroadcastListeners(t *testing.T) {
-	require.Empty(t, broadcastListeners.s)
+	require.Empty(t, defaultCluster.broadcastListeners.s)
 
 	l := &TestBroadcastListener{}
 
 	AddBroadcastListener(l)
-	require.Equal(t, 1, len(broadcastListeners.s))
+	require.Equal(t, 1, len(defaultCluster.broadcastListeners.s))
 
 	require.Nil(t, l.broadcast)
 
 	bc := testBroadcast()
-	doBroadcastUpdate(bc)
+	defaultCluster.doBroadcastUpdate(bc)
 
 	require.NotNil(t, l.broadcast)
 
@@ -59,12 +59,12 @@ func (l *TestStatusListener) OnChange(node *Node, status NodeStatus) {
 }
 
 func TestStatusListeners(t *testing.T) {
-	require.Empty(t, statusListeners.s)
+	require.Empty(t, defaultCluster.statusListeners.s)
 
 	l := &TestStatusListener{}
 
 	AddStatusListener(l)
-	require.Equal(t, 1, len(statusListeners.s))
+	require.Equal(t, 1, len(defaultCluster.statusListeners.s))
 
 	require.Nil(t, l.node)
 	require.Equal(t, StatusUnknown, l.status)
@@ -72,7 +72,7 @@ func TestStatusListeners(t *testing.T) {
 	n := testNode()
 	s := StatusAlive
 
-	doStatusUpdate(n, s)
+	defaultCluster.doStatusUpdate(n, s)
 
 	require.Equal(t, s, l.status)
 	require.Equal(t, n, l.node)
@@ -0,0 +1,192 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Broadcasts longer than GetMaxBroadcastBytes() are sent as a series of
+// fragments, each of which is a broadcast of its own (with its own index).
+//
+// Fragment broadcast payload
+// Bytes 00-03 Index of the whole broadcast
+// Bytes 04-05 Fragment number (starting at 0)
+// Bytes 06-07 Fragment count
+// Bytes 08-NN Fragment of the whole broadcast's payload
+
+const (
+	// MaxFragmentedBroadcastBytes is the largest broadcast payload that can
+	// be sent, once split into fragments.
+	MaxFragmentedBroadcastBytes = 64 * 1024
+
+	// The length of the header of each fragment.
+	fragmentHeaderSize = 8
+
+	// How long the fragments of a broadcast are kept waiting for the rest,
+	// and how long a reassembled broadcast is remembered, so that late
+	// copies of its fragments don't deliver it twice.
+	fragmentTimeoutMillis = 30000
+)
+
+// fragmentBuffer collects the fragments of one broadcast.
+type fragmentBuffer struct {
+	parts     [][]byte
+	received  int
+	delivered bool
+
+	// When the last fragment arrived, in milliseconds.
+	timestamp uint32
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// queueFragmentedBroadcast splits a payload that is too long for a single
+// broadcast into fragments, and queues them. The handle tracks them all,
+// under the label of the whole broadcast.
+func (c *Cluster) queueFragmentedBroadcast(bytes []byte, handle *BroadcastHandle) {
+	fragmentSize := c.GetMaxBroadcastBytes() - fragmentHeaderSize
+	count := (len(bytes) + fragmentSize - 1) / fragmentSize
+
+	// The whole broadcast takes an index, so that its label is unique.
+	c.broadcasts.Lock()
+	index := c.indexCounter
+	c.indexCounter++
+	c.broadcasts.Unlock()
+
+	handle.register(broadcastLabel(c.thisHost.IP(), c.thisHost.Port(), c.epoch, index))
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * fragmentSize
+		if end > len(bytes) {
+			end = len(bytes)
+		}
+
+		fragment := make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-i*fragmentSize)
+		encodeUint32(index, fragment, 0)
+		encodeUint16(uint16(i), fragment, 4)
+		encodeUint16(uint16(count), fragment, 6)
+		fragment = append(fragment, bytes[i*fragmentSize:end]...)
+
+		c.enqueueBroadcast(&Broadcast{
+			bytes:  fragment,
+			kind:   broadcastFragment,
+			handle: handle})
+	}
+}
+
+// receiveFragment buffers a fragment of a broadcast. Once all of its
+// fragments have arrived, the whole broadcast is passed to the broadcast
+// listeners.
+func (c *Cluster) receiveFragment(fragment *Broadcast) {
+	whole, err := c.addFragment(fragment)
+	if err != nil {
+		logWarn(err)
+		return
+	}
+
+	if whole != nil {
+		logfInfo("Broadcast [%s] reassembled (%d bytes)", whole.Label(), len(whole.bytes))
+
+		c.doBroadcastUpdate(whole)
+		c.ackBroadcast(whole)
+	}
+}
+
+// addFragment adds a fragment to the buffer of its broadcast, and returns
+// the whole broadcast if this was its last missing fragment.
+func (c *Cluster) addFragment(fragment *Broadcast) (*Broadcast, error) {
+	payload := fragment.bytes
+	if len(payload) < fragmentHeaderSize {
+		return nil, errors.New("broadcast fragment too short")
+	}
+
+	index, _ := decodeUint32(payload, 0)
+	number, _ := decodeUint16(payload, 4)
+	count, _ := decodeUint16(payload, 6)
+
+	maxCount := MaxFragmentedBroadcastBytes/(c.GetMaxBroadcastBytes()-fragmentHeaderSize) + 1
+	if number >= count || int(count) > maxCount {
+		return nil, fmt.Errorf("bad broadcast fragment %d of %d", number, count)
+	}
+
+	whole := &Broadcast{
+		origin: fragment.origin,
+		index:  index,
+		epoch:  fragment.epoch,
+		kind:   broadcastUser,
+
+		ackRequested: fragment.ackRequested,
+	}
+
+	label := whole.Label()
+
+	c.fragments.Lock()
+	defer c.fragments.Unlock()
+
+	buffer, ok := c.fragments.m[label]
+	if !ok {
+		buffer = &fragmentBuffer{parts: make([][]byte, count)}
+		c.fragments.m[label] = buffer
+	}
+
+	buffer.timestamp = GetNowInMillis()
+
+	if buffer.delivered || int(count) != len(buffer.parts) || buffer.parts[number] != nil {
+		// Already delivered, inconsistent, or a duplicate.
+		return nil, nil
+	}
+
+	buffer.parts[number] = payload[fragmentHeaderSize:]
+	buffer.received++
+
+	if buffer.received < len(buffer.parts) {
+		return nil, nil
+	}
+
+	for _, part := range buffer.parts {
+		whole.bytes = append(whole.bytes, part...)
+	}
+
+	// Keep the buffer, emptied, to remember that it has been delivered.
+	buffer.parts = nil
+	buffer.delivered = true
+
+	return whole, nil
+}
+
+// pruneFragments drops broadcasts whose fragments haven't all arrived in
+// time, and forgets reassembled broadcasts after the same delay.
+func (c *Cluster) pruneFragments() {
+	now := GetNowInMillis()
+
+	c.fragments.Lock()
+	for label, buffer := range c.fragments.m {
+		if now-buffer.timestamp > fragmentTimeoutMillis {
+			if !buffer.delivered {
+				logfDebug("Dropping broadcast [%s]: %d of %d fragments arrived",
+					label, buffer.received, len(buffer.parts))
+			}
+
+			delete(c.fragments.m, label)
+		}
+	}
+	c.fragments.Unlock()
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+	sender := NewCluster()
+	sender.thisHost = &Node{ip: net.IPv4(10, 0, 23, 1), port: 9999}
+
+	payload := bytes.Repeat([]byte("0123456789"), 300)
+	_, err := sender.BroadcastBytes(payload)
+	require.NoError(t, err)
+
+	fragments := sender.getBroadcastsToEmit()
+	require.Len(t, fragments, 13)
+
+	for _, f := range fragments {
+		require.Equal(t, broadcastFragment, f.kind)
+		require.LessOrEqual(t, len(f.bytes), sender.GetMaxBroadcastBytes())
+	}
+
+	receiver := NewCluster()
+
+	var whole *Broadcast
+
+	// Fragments arrive in any order, some of them twice.
+	for i := len(fragments) - 1; i >= 0; i-- {
+		for j := 0; j < 2; j++ {
+			b, err := receiver.addFragment(fragments[i])
+			require.NoError(t, err)
+
+			if b != nil {
+				require.Nil(t, whole, "delivered twice")
+				whole = b
+			}
+		}
+	}
+
+	require.NotNil(t, whole)
+	require.Equal(t, payload, whole.Bytes())
+	require.Equal(t, broadcastUser, whole.kind)
+	require.Equal(t, sender.thisHost, whole.Origin())
+
+	// A late copy doesn't deliver it again.
+	b, err := receiver.addFragment(fragments[0])
+	require.NoError(t, err)
+	require.Nil(t, b)
+}
+
+func TestIncompleteFragmentsPruned(t *testing.T) {
+	sender := NewCluster()
+	sender.thisHost = &Node{ip: net.IPv4(10, 0, 23, 1), port: 9999}
+	_, err := sender.BroadcastBytes(make([]byte, 1000))
+	require.NoError(t, err)
+
+	receiver := NewCluster()
+
+	b, err := receiver.addFragment(sender.getBroadcastsToEmit()[0])
+	require.NoError(t, err)
+	require.Nil(t, b)
+	require.Len(t, receiver.fragments.m, 1)
+
+	for _, buffer := range receiver.fragments.m {
+		buffer.timestamp -= fragmentTimeoutMillis + 1
+	}
+
+	receiver.pruneFragments()
+	require.Empty(t, receiver.fragments.m)
+}
+
+func TestBadFragmentRejected(t *testing.T) {
+	c := NewCluster()
+	origin := &Node{ip: net.IPv4(10, 0, 23, 1), port: 9999}
+
+	fragment := make([]byte, fragmentHeaderSize)
+	encodeUint16(3, fragment, 4)
+	encodeUint16(3, fragment, 6)
+
+	_, err := c.addFragment(&Broadcast{origin: origin, bytes: fragment})
+	require.Error(t, err)
+
+	_, err = c.addFragment(&Broadcast{origin: origin, bytes: fragment[:4]})
+	require.Error(t, err)
+}
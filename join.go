@@ -0,0 +1,209 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The longest that Join() waits between attempts to reach its seeds.
+const maxJoinBackoffMillis = 10000
+
+// joinAttempt tracks the seeds of a Join() call, and which of them have
+// answered.
+type joinAttempt struct {
+	sync.Mutex
+
+	seeds map[*Node]bool
+
+	// Signalled whenever a seed answers.
+	answer chan struct{}
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Join adds the given seeds (as IP or IP:PORT) to the known nodes, and
+// exchanges membership state with them until at least one has answered. Seeds
+// that don't answer are retried with an exponential backoff. It returns the
+// number of seeds that answered, or an error if none of them did before ctx
+// was done.
+//
+// Join must be called while the node is running (see BeginContext); if it
+// hasn't started yet, Join waits for it.
+func (c *Cluster) Join(ctx context.Context, seeds ...string) (int, error) {
+	if len(seeds) == 0 {
+		return 0, errors.New("cannot join: no seeds given")
+	}
+
+	for !c.isRunning() {
+		if !sleepContext(ctx, time.Millisecond*10) {
+			return 0, fmt.Errorf("cannot join: node not started: %w", ctx.Err())
+		}
+	}
+
+	attempt := &joinAttempt{
+		seeds:  make(map[*Node]bool),
+		answer: make(chan struct{}, 1),
+	}
+
+	for _, address := range seeds {
+		ip, port, err := c.parseNodeAddress(address)
+		if err != nil {
+			return 0, fmt.Errorf("cannot join: bad seed %q: %w", address, err)
+		}
+
+		node := c.resolveNode("", ip, port, false)
+		if node == c.thisHost {
+			continue
+		}
+
+		if !c.knownNodes.contains(node) {
+			c.AddNode(node)
+		}
+
+		attempt.seeds[node] = false
+	}
+
+	if len(attempt.seeds) == 0 {
+		return 0, errors.New("cannot join: no seeds other than this node")
+	}
+
+	c.joins.Lock()
+	c.joins.m[attempt] = true
+	c.joins.Unlock()
+
+	defer func() {
+		c.joins.Lock()
+		delete(c.joins.m, attempt)
+		c.joins.Unlock()
+	}()
+
+	backoff := c.GetHeartbeatMillis()
+
+	for {
+		for _, seed := range attempt.pending() {
+			err := c.transmitPushPull(seed, verbSync)
+			if err != nil {
+				logInfo("Failure to sync with seed", seed.Address(), "->", err)
+			}
+		}
+
+		// Wait for all of the seeds, or for the end of this round.
+		timer := time.NewTimer(time.Millisecond * time.Duration(backoff))
+
+	Wait:
+		for len(attempt.pending()) > 0 {
+			select {
+			case <-attempt.answer:
+			case <-timer.C:
+				break Wait
+			case <-ctx.Done():
+				timer.Stop()
+
+				if answered := attempt.answered(); answered > 0 {
+					return answered, nil
+				}
+
+				return 0, fmt.Errorf("could not join the cluster: %w", ctx.Err())
+			}
+		}
+
+		timer.Stop()
+
+		if answered := attempt.answered(); answered > 0 {
+			logfInfo("Joined the cluster (%d of %d seeds answered)",
+				answered, len(attempt.seeds))
+
+			return answered, nil
+		}
+
+		backoff *= 2
+		if backoff > maxJoinBackoffMillis {
+			backoff = maxJoinBackoffMillis
+		}
+
+		logfDebug("No seed answered: retrying in %d ms", backoff)
+	}
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// noteJoinReply records that the sender of msg has answered, if it's a seed
+// that a Join() is waiting for.
+func (c *Cluster) noteJoinReply(msg message) {
+	if msg.verb != verbAck && msg.verb != verbSync && msg.verb != verbSyncData {
+		return
+	}
+
+	c.joins.Lock()
+	defer c.joins.Unlock()
+
+	for attempt := range c.joins.m {
+		attempt.Lock()
+
+		if answered, ok := attempt.seeds[msg.sender]; ok && !answered {
+			attempt.seeds[msg.sender] = true
+
+			select {
+			case attempt.answer <- struct{}{}:
+			default:
+			}
+		}
+
+		attempt.Unlock()
+	}
+}
+
+// pending returns the seeds that haven't answered yet.
+func (a *joinAttempt) pending() []*Node {
+	a.Lock()
+	defer a.Unlock()
+
+	nodes := make([]*Node, 0, len(a.seeds))
+
+	for n, answered := range a.seeds {
+		if !answered {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes
+}
+
+// answered returns the number of seeds that have answered.
+func (a *joinAttempt) answered() int {
+	a.Lock()
+	defer a.Unlock()
+
+	count := 0
+
+	for _, answered := range a.seeds {
+		if answered {
+			count++
+		}
+	}
+
+	return count
+}
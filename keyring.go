@@ -0,0 +1,314 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Encrypted packet contents
+// Byte  00    Encryption version (always 0)
+// Bytes 01-12 Nonce
+// Bytes 13-NN Encrypted packet, followed by the 16 byte GCM tag
+
+const (
+	encryptionVersion byte = 0
+
+	nonceSize = 12
+
+	// The number of bytes that encryption adds to a packet.
+	encryptionOverhead = 1 + nonceSize + 16
+)
+
+// Keyring holds the AES keys that gossip is encrypted with. Packets are
+// encrypted with the primary key, and decrypted with whichever installed key
+// works. To rotate keys without downtime, install the new key on every node,
+// then make it the primary everywhere, and then remove the old key.
+type Keyring struct {
+	lock sync.RWMutex
+
+	// The installed keys. The first is the primary key.
+	keys [][]byte
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// NewKeyring returns a keyring with the given keys installed, and primaryKey
+// (which is installed as well, if it isn't among keys) as its primary key.
+// Keys must be 16, 24 or 32 bytes long, to select AES-128, AES-192 or
+// AES-256.
+func NewKeyring(keys [][]byte, primaryKey []byte) (*Keyring, error) {
+	k := &Keyring{}
+
+	err := k.AddKey(primaryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		err = k.AddKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// AddKey installs key, so that packets encrypted with it can be decrypted.
+// Installing a key that is already installed does nothing.
+func (k *Keyring) AddKey(key []byte) error {
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.indexOf(key) >= 0 {
+		return nil
+	}
+
+	k.keys = append(k.keys, copyKey(key))
+
+	return nil
+}
+
+// UseKey makes an installed key the primary key, which packets are encrypted
+// with.
+func (k *Keyring) UseKey(key []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	i := k.indexOf(key)
+	if i < 0 {
+		return errors.New("key is not installed")
+	}
+
+	k.keys[0], k.keys[i] = k.keys[i], k.keys[0]
+
+	return nil
+}
+
+// RemoveKey uninstalls key. The primary key can't be removed.
+func (k *Keyring) RemoveKey(key []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	i := k.indexOf(key)
+	if i == 0 {
+		return errors.New("the primary key can't be removed")
+	}
+
+	if i > 0 {
+		k.keys = append(k.keys[:i], k.keys[i+1:]...)
+	}
+
+	return nil
+}
+
+// GetKeys returns copies of the installed keys, starting with the primary
+// key.
+func (k *Keyring) GetKeys() [][]byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	keys := make([][]byte, len(k.keys))
+	for i, key := range k.keys {
+		keys[i] = copyKey(key)
+	}
+
+	return keys
+}
+
+// GetPrimaryKey returns a copy of the key that packets are encrypted with.
+func (k *Keyring) GetPrimaryKey() []byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	return copyKey(k.keys[0])
+}
+
+// GetKeyring returns the keyring that gossip is encrypted with, or nil if
+// gossip isn't encrypted. If no keyring has been set, one is made from the
+// base64-encoded key in SMUDGE_GOSSIP_KEY (if any).
+func (c *Cluster) GetKeyring() *Keyring {
+	c.keyring.Lock()
+	defer c.keyring.Unlock()
+
+	if c.keyring.k == nil && !c.keyring.fromEnv {
+		c.keyring.fromEnv = true
+
+		encoded := getStringVar(EnvVarGossipKey, DefaultGossipKey)
+		if encoded == "" {
+			return nil
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			c.keyring.k, err = NewKeyring(nil, key)
+		}
+
+		if err != nil {
+			logfError("Invalid %s: %v", EnvVarGossipKey, err)
+		}
+	}
+
+	return c.keyring.k
+}
+
+// SetKeyring sets the keyring that gossip is encrypted with. Once it is set,
+// every packet sent is encrypted with its primary key, and packets that
+// can't be decrypted with any of its keys (plaintext ones included) are
+// dropped. All nodes of a cluster need a key in common. Keys can be rotated
+// through the keyring while the node is running.
+func (c *Cluster) SetKeyring(keyring *Keyring) {
+	c.keyring.Lock()
+	c.keyring.k = keyring
+	c.keyring.Unlock()
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// encodePacket encodes msg in the protocol version set on it, and seals it
+// (see sealPacket).
+func (c *Cluster) encodePacket(msg *message) ([]byte, error) {
+	return c.sealPacket(msg.encode(c.ipLen, c.clusterID()))
+}
+
+// sealPacket signs packet, if we have a message secret, and then encrypts it
+// with the primary key, if we have a keyring.
+func (c *Cluster) sealPacket(packet []byte) ([]byte, error) {
+	packet = c.signPacket(packet)
+
+	keyring := c.GetKeyring()
+	if keyring == nil {
+		return packet, nil
+	}
+
+	return encryptPacket(keyring.GetPrimaryKey(), packet)
+}
+
+// openPacket undoes sealPacket: it decrypts packet with any installed key, if
+// we have a keyring, and then checks its signature, if we have a message
+// secret.
+func (c *Cluster) openPacket(packet []byte) ([]byte, error) {
+	keyring := c.GetKeyring()
+	if keyring != nil {
+		var err error
+
+		packet, err = decryptPacket(keyring.GetKeys(), packet)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.verifyPacket(packet)
+}
+
+func encryptPacket(key []byte, packet []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 1+nonceSize, encryptionOverhead+len(packet))
+	sealed[0] = encryptionVersion
+
+	_, err = rand.Read(sealed[1 : 1+nonceSize])
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(sealed, sealed[1:1+nonceSize], packet, nil), nil
+}
+
+func decryptPacket(keys [][]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < encryptionOverhead {
+		return nil, errors.New("encrypted packet too short")
+	}
+
+	if sealed[0] != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", sealed[0])
+	}
+
+	nonce := sealed[1 : 1+nonceSize]
+	ciphertext := sealed[1+nonceSize:]
+
+	for _, key := range keys {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+
+		packet, err := gcm.Open(nil, nonce, ciphertext, nil)
+		if err == nil {
+			return packet, nil
+		}
+	}
+
+	return nil, errors.New("no installed key can decrypt the packet")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key must be 16, 24 or 32 bytes long, not %d", len(key))
+	}
+}
+
+// indexOf returns the position of key in the keyring, or -1. The caller must
+// hold the lock.
+func (k *Keyring) indexOf(key []byte) int {
+	for i, installed := range k.keys {
+		if bytes.Equal(installed, key) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func copyKey(key []byte) []byte {
+	cp := make([]byte, len(key))
+	copy(cp, key)
+
+	return cp
+}
@@ -0,0 +1,408 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Keyring operation broadcast payload
+// Byte  00    Operation (one of the keyring* constants below)
+// Bytes 01-08 Operation ID
+// Bytes 09-NN Key (none for keyringList)
+//
+// Keyring reply broadcast payload
+// Bytes 00-07 Operation ID
+// Byte  08    0 if the operation was applied, 1 if it failed
+// Bytes 09-NN If it failed, the error message. Otherwise, for keyringList,
+//             the installed keys (primary first), each preceded by a byte
+//             holding its length.
+
+const (
+	keyringInstall byte = iota + 1
+	keyringUse
+	keyringRemove
+	keyringList
+)
+
+// KeyringResult is the outcome of a cluster-wide keyring operation on one
+// node.
+type KeyringResult struct {
+	// The node that the result is from.
+	Node *Node
+
+	// Nil if the node applied the operation. If it didn't reply in time, this
+	// wraps the error of the context.
+	Err error
+
+	// The keys installed on the node, primary first. Only set by ListKeys.
+	Keys [][]byte
+}
+
+// KeyringSummary collects the results of a cluster-wide keyring operation:
+// one for this node, and one for every node that was healthy when the
+// operation started.
+type KeyringSummary struct {
+	Results []KeyringResult
+}
+
+// keyringOp tracks a cluster-wide keyring operation started by this node,
+// and the nodes that haven't replied to it yet.
+type keyringOp struct {
+	sync.Mutex
+
+	// The nodes we're waiting on, by key (their name, which stays the same
+	// if they move to another address).
+	waiting map[string]*Node
+
+	// The results so far, and the keys of the nodes they're from.
+	results []KeyringResult
+	replied map[string]bool
+
+	// Signalled whenever a node replies.
+	reply chan struct{}
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Applied returns the nodes that applied the operation.
+func (s *KeyringSummary) Applied() []*Node {
+	nodes := make([]*Node, 0, len(s.Results))
+
+	for _, r := range s.Results {
+		if r.Err == nil {
+			nodes = append(nodes, r.Node)
+		}
+	}
+
+	return nodes
+}
+
+// Failed returns the results of the nodes that failed to apply the
+// operation, or didn't reply in time.
+func (s *KeyringSummary) Failed() []KeyringResult {
+	failed := make([]KeyringResult, 0)
+
+	for _, r := range s.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+// InstallKey installs key in the keyring of every node in the cluster,
+// starting with this one. The change is spread as a broadcast (repeated with
+// a backoff until every node has replied), and each node replies with its
+// outcome. InstallKey returns once every node that was healthy has replied,
+// or ctx is done, with a summary of which nodes applied the change. An error
+// is returned if any of them failed or didn't reply.
+func (c *Cluster) InstallKey(ctx context.Context, key []byte) (*KeyringSummary, error) {
+	err := validateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.keyringOperation(ctx, keyringInstall, key)
+}
+
+// UseKey makes key, which must already be installed everywhere, the primary
+// key of every node in the cluster. It reports its outcome as InstallKey
+// does.
+func (c *Cluster) UseKey(ctx context.Context, key []byte) (*KeyringSummary, error) {
+	return c.keyringOperation(ctx, keyringUse, key)
+}
+
+// RemoveKey removes key from the keyring of every node in the cluster. Nodes
+// that use it as their primary key refuse to remove it. It reports its
+// outcome as InstallKey does.
+func (c *Cluster) RemoveKey(ctx context.Context, key []byte) (*KeyringSummary, error) {
+	return c.keyringOperation(ctx, keyringRemove, key)
+}
+
+// ListKeys collects the keys installed on every node in the cluster; each
+// result holds the keys of one node. It reports its outcome as InstallKey
+// does.
+func (c *Cluster) ListKeys(ctx context.Context) (*KeyringSummary, error) {
+	return c.keyringOperation(ctx, keyringList, nil)
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// keyringOperation applies a keyring operation here, broadcasts it to the
+// rest of the cluster, and waits for the healthy nodes to reply.
+func (c *Cluster) keyringOperation(ctx context.Context, op byte, key []byte) (*KeyringSummary, error) {
+	if c.GetKeyring() == nil {
+		return nil, errors.New("gossip isn't encrypted: no keyring is set")
+	}
+
+	if !c.isRunning() {
+		return nil, errors.New("node not started")
+	}
+
+	id := rand.Uint64()
+
+	pending := &keyringOp{
+		waiting: make(map[string]*Node),
+		replied: make(map[string]bool),
+		reply:   make(chan struct{}, 1),
+	}
+
+	for _, node := range c.HealthyNodes() {
+		if node != c.thisHost {
+			pending.waiting[node.key()] = node
+		}
+	}
+
+	keys, err := c.applyKeyringOp(op, key)
+	pending.results = append(pending.results,
+		KeyringResult{Node: c.thisHost, Err: err, Keys: keys})
+
+	c.keyringOps.Lock()
+	c.keyringOps.m[id] = pending
+	c.keyringOps.Unlock()
+
+	defer func() {
+		c.keyringOps.Lock()
+		delete(c.keyringOps.m, id)
+		c.keyringOps.Unlock()
+	}()
+
+	payload := make([]byte, 9, 9+len(key))
+	payload[0] = op
+	encodeUint64(id, payload, 1)
+	payload = append(payload, key...)
+
+	// Broadcasts aren't guaranteed to reach everybody, so the operation is
+	// broadcast again until every node has replied. Applying it twice does
+	// no harm.
+	backoff := c.GetHeartbeatMillis() * (c.emitCount() + 1)
+
+Broadcast:
+	for pending.remaining() > 0 {
+		c.queueBroadcast(broadcastKeyringOp, payload)
+
+		timer := time.NewTimer(time.Millisecond * time.Duration(backoff))
+
+	Wait:
+		for pending.remaining() > 0 {
+			select {
+			case <-pending.reply:
+			case <-timer.C:
+				break Wait
+			case <-ctx.Done():
+				timer.Stop()
+				break Broadcast
+			}
+		}
+
+		timer.Stop()
+
+		backoff *= 2
+		if backoff > maxJoinBackoffMillis {
+			backoff = maxJoinBackoffMillis
+		}
+	}
+
+	pending.Lock()
+	defer pending.Unlock()
+
+	// A copy, as late replies may still be appended to pending.results.
+	summary := &KeyringSummary{
+		Results: append([]KeyringResult(nil), pending.results...),
+	}
+
+	for _, node := range pending.waiting {
+		summary.Results = append(summary.Results,
+			KeyringResult{Node: node, Err: fmt.Errorf("no reply: %w", ctx.Err())})
+	}
+
+	if failed := len(summary.Failed()); failed > 0 {
+		return summary, fmt.Errorf("keyring operation failed on %d of %d nodes",
+			failed, len(summary.Results))
+	}
+
+	return summary, nil
+}
+
+// applyKeyringOp applies a keyring operation to this node's keyring. For
+// keyringList, it returns the installed keys.
+func (c *Cluster) applyKeyringOp(op byte, key []byte) ([][]byte, error) {
+	keyring := c.GetKeyring()
+	if keyring == nil {
+		return nil, errors.New("no keyring is set")
+	}
+
+	switch op {
+	case keyringInstall:
+		return nil, keyring.AddKey(key)
+	case keyringUse:
+		return nil, keyring.UseKey(key)
+	case keyringRemove:
+		return nil, keyring.RemoveKey(key)
+	case keyringList:
+		return keyring.GetKeys(), nil
+	default:
+		return nil, fmt.Errorf("unknown keyring operation %d", op)
+	}
+}
+
+// receiveKeyringOp applies a keyring operation broadcast by another node,
+// and broadcasts our outcome in reply.
+func (c *Cluster) receiveKeyringOp(broadcast *Broadcast) {
+	payload := broadcast.bytes
+	if len(payload) < 9 {
+		logWarn("Received a truncated keyring operation from", broadcast.Origin().Address())
+		return
+	}
+
+	op := payload[0]
+	id, _ := decodeUint64(payload, 1)
+
+	keys, err := c.applyKeyringOp(op, payload[9:])
+	if err != nil {
+		logfWarn("Keyring operation from %s failed: %v", broadcast.Origin().Address(), err)
+	} else {
+		logfInfo("Applied keyring operation %d from %s", op, broadcast.Origin().Address())
+	}
+
+	c.queueBroadcast(broadcastKeyringReply, c.encodeKeyringReply(id, keys, err))
+}
+
+// encodeKeyringReply composes the payload of a reply to a keyring operation.
+// It is kept within the maximum broadcast length.
+func (c *Cluster) encodeKeyringReply(id uint64, keys [][]byte, err error) []byte {
+	max := c.GetMaxBroadcastBytes()
+
+	reply := make([]byte, 9, max)
+	encodeUint64(id, reply, 0)
+
+	if err == nil {
+		for _, key := range keys {
+			if len(reply)+1+len(key) > max {
+				err = errors.New("too many keys to list")
+				break
+			}
+
+			reply = append(reply, byte(len(key)))
+			reply = append(reply, key...)
+		}
+	}
+
+	if err != nil {
+		reply = reply[:9]
+		reply[8] = 1
+
+		msg := err.Error()
+		if len(msg) > max-9 {
+			msg = msg[:max-9]
+		}
+
+		reply = append(reply, msg...)
+	}
+
+	return reply
+}
+
+// decodeKeyringReply reads the payload of a reply to a keyring operation.
+func decodeKeyringReply(reply []byte) (uint64, [][]byte, error) {
+	if len(reply) < 9 {
+		return 0, nil, errors.New("keyring reply too short")
+	}
+
+	id, p := decodeUint64(reply, 0)
+
+	if reply[p] != 0 {
+		return id, nil, errors.New(string(reply[p+1:]))
+	}
+
+	var keys [][]byte
+
+	for p++; p < len(reply); {
+		length := int(reply[p])
+		p++
+
+		if p+length > len(reply) {
+			return id, nil, errors.New("keyring reply truncated")
+		}
+
+		keys = append(keys, copyKey(reply[p:p+length]))
+		p += length
+	}
+
+	return id, keys, nil
+}
+
+// receiveKeyringReply records a node's reply to a keyring operation, if it
+// is one that this node started.
+func (c *Cluster) receiveKeyringReply(broadcast *Broadcast) {
+	id, keys, err := decodeKeyringReply(broadcast.bytes)
+
+	c.keyringOps.Lock()
+	pending, ok := c.keyringOps.m[id]
+	c.keyringOps.Unlock()
+
+	if !ok {
+		return
+	}
+
+	key := broadcast.Origin().key()
+
+	pending.Lock()
+
+	if pending.replied[key] {
+		// A reply to a repeat of the operation.
+		pending.Unlock()
+		return
+	}
+
+	node, waiting := pending.waiting[key]
+	if waiting {
+		delete(pending.waiting, key)
+	} else {
+		// A node that wasn't healthy (or known) when the operation started.
+		node = broadcast.Origin()
+	}
+
+	pending.replied[key] = true
+	pending.results = append(pending.results, KeyringResult{Node: node, Err: err, Keys: keys})
+
+	pending.Unlock()
+
+	select {
+	case pending.reply <- struct{}{}:
+	default:
+	}
+}
+
+// remaining returns the number of nodes that haven't replied yet.
+func (o *keyringOp) remaining() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return len(o.waiting)
+}
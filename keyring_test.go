@@ -0,0 +1,130 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeyringRejectsBadKeys(t *testing.T) {
+	_, err := NewKeyring(nil, []byte("too short"))
+	require.Error(t, err)
+
+	_, err = NewKeyring([][]byte{make([]byte, 15)}, make([]byte, 16))
+	require.Error(t, err)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 16)
+	key2 := bytes.Repeat([]byte{2}, 24)
+
+	k, err := NewKeyring([][]byte{key1}, key1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{key1}, k.GetKeys())
+
+	require.Error(t, k.UseKey(key2))
+
+	require.NoError(t, k.AddKey(key2))
+	require.Equal(t, key1, k.GetPrimaryKey())
+
+	require.NoError(t, k.UseKey(key2))
+	require.Equal(t, key2, k.GetPrimaryKey())
+	require.Equal(t, [][]byte{key2, key1}, k.GetKeys())
+
+	require.Error(t, k.RemoveKey(key2))
+	require.NoError(t, k.RemoveKey(key1))
+	require.Equal(t, [][]byte{key2}, k.GetKeys())
+}
+
+func TestEncryptDecryptPacket(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 16)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	packet := []byte("a message of some kind")
+
+	sealed, err := encryptPacket(key1, packet)
+	require.NoError(t, err)
+	require.Len(t, sealed, len(packet)+encryptionOverhead)
+	require.NotContains(t, string(sealed), string(packet))
+
+	// Any installed key will do.
+	opened, err := decryptPacket([][]byte{key2, key1}, sealed)
+	require.NoError(t, err)
+	require.Equal(t, packet, opened)
+
+	_, err = decryptPacket([][]byte{key2}, sealed)
+	require.Error(t, err)
+
+	// Tampering is detected.
+	sealed[len(sealed)-1] ^= 0xFF
+	_, err = decryptPacket([][]byte{key1}, sealed)
+	require.Error(t, err)
+
+	_, err = decryptPacket([][]byte{key1}, packet[:4])
+	require.Error(t, err)
+}
+
+func TestKeyringReplyEncoding(t *testing.T) {
+	c := NewCluster()
+	keys := [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32)}
+
+	id, decodedKeys, err := decodeKeyringReply(c.encodeKeyringReply(42, keys, nil))
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), id)
+	require.Equal(t, keys, decodedKeys)
+
+	id, _, err = decodeKeyringReply(c.encodeKeyringReply(43, nil, errors.New("nope")))
+	require.EqualError(t, err, "nope")
+	require.Equal(t, uint64(43), id)
+
+	// Too many keys to fit in a broadcast.
+	many := make([][]byte, 0)
+	for i := 0; i < 20; i++ {
+		many = append(many, bytes.Repeat([]byte{byte(i)}, 32))
+	}
+
+	reply := c.encodeKeyringReply(44, many, nil)
+	require.LessOrEqual(t, len(reply), c.GetMaxBroadcastBytes())
+
+	_, _, err = decodeKeyringReply(reply)
+	require.Error(t, err)
+}
+
+func TestKeyringReplyFromMovedNode(t *testing.T) {
+	c := NewCluster()
+	node := &Node{name: "b", ip: net.IPv4(10, 0, 31, 2), port: 9999}
+
+	pending := &keyringOp{
+		waiting: map[string]*Node{node.key(): node},
+		replied: make(map[string]bool),
+		reply:   make(chan struct{}, 1),
+	}
+
+	c.keyringOps.m[7] = pending
+
+	// The node has moved since the operation started.
+	moved := &Node{name: "b", ip: net.IPv4(10, 0, 31, 3), port: 9999}
+	c.receiveKeyringReply(&Broadcast{origin: moved, bytes: c.encodeKeyringReply(7, nil, nil)})
+
+	require.Zero(t, pending.remaining())
+	require.Len(t, pending.results, 1)
+	require.Same(t, node, pending.results[0].Node)
+}
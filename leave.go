@@ -0,0 +1,205 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// How long a node that has left is remembered. During this time, gossip
+// about the node that is older than its departure is ignored, so that it
+// isn't brought back to life by stale messages still making the rounds.
+const leftNodeRetentionMillis = 60000
+
+// leftNode records the departure of a node that has left the cluster.
+type leftNode struct {
+	heartbeat uint32
+	timestamp uint32
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Leave announces to the cluster that this node is leaving on purpose. It
+// sends a LEAVE to other healthy nodes until enough of them (as many as a
+// status update is normally gossiped to) have acknowledged it, and then
+// returns. Peers remove the node right away, without suspecting it first,
+// and notify their status listeners with StatusLeft.
+//
+// This node stops pinging once Leave has been called. It is still running,
+// though: cancel the context passed to BeginContext to shut it down. If ctx
+// is done before the departure has spread, its error is returned.
+func (c *Cluster) Leave(ctx context.Context) error {
+	if c.thisHost == nil {
+		return errors.New("cannot leave: node has not been started")
+	}
+
+	c.leave.Lock()
+	first := c.leave.acked == nil
+	if first {
+		c.leave.heartbeat = c.currentHeartbeat.Add(1)
+		c.leave.acked = make(map[string]bool)
+	}
+	c.leave.Unlock()
+
+	if first {
+		c.updateNodeStatus(c.thisHost, StatusLeft, c.currentHeartbeat.Load(), c.thisHost)
+	}
+
+	peers := c.knownNodes.getRandomNodes(0, c.thisHost)
+
+	want := c.emitCount()
+	if want > len(peers) {
+		want = len(peers)
+	}
+
+	for {
+		sent := 0
+
+		c.leave.Lock()
+		acked := len(c.leave.acked)
+		targets := make([]*Node, 0, len(peers))
+
+		for _, n := range peers {
+			if !c.leave.acked[n.key()] && n.Status() == StatusAlive {
+				targets = append(targets, n)
+			}
+		}
+		c.leave.Unlock()
+
+		if acked >= want || len(targets) == 0 {
+			logfInfo("Left the cluster (%d of %d peers acknowledged)", acked, len(peers))
+
+			return nil
+		}
+
+		for _, n := range targets {
+			if sent >= want-acked {
+				break
+			}
+
+			err := c.transmitVerbLeave(n)
+			if err != nil {
+				logInfo("Failure to send leave to", n.Address(), "->", err)
+				continue
+			}
+
+			sent++
+		}
+
+		if !sleepContext(ctx, time.Millisecond*time.Duration(c.GetHeartbeatMillis())) {
+			return ctx.Err()
+		}
+	}
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// isLeaving returns true once Leave() has been called on the current run.
+func (c *Cluster) isLeaving() bool {
+	c.leave.Lock()
+	defer c.leave.Unlock()
+
+	return c.leave.acked != nil
+}
+
+// noteLeaveAck records an ACK of our LEAVE, if that is what msg is.
+func (c *Cluster) noteLeaveAck(msg message) {
+	c.leave.Lock()
+	defer c.leave.Unlock()
+
+	if c.leave.acked != nil && msg.senderHeartbeat == c.leave.heartbeat {
+		c.leave.acked[msg.sender.key()] = true
+	}
+}
+
+// nodeLeft removes a node that has left the cluster, and remembers its
+// departure so that older gossip about it can be told apart.
+func (c *Cluster) nodeLeft(node *Node, heartbeat uint32, statusSource *Node) {
+	if c.knownNodes.contains(node) {
+		c.updateNodeStatus(node, StatusLeft, heartbeat, statusSource)
+		c.RemoveNode(node)
+	}
+
+	// Whatever we were waiting to hear from it won't come.
+	c.pendingAcks.Lock()
+	for k, pack := range c.pendingAcks.m {
+		if pack.node.key() == node.key() {
+			delete(c.pendingAcks.m, k)
+		}
+	}
+	c.pendingAcks.Unlock()
+
+	c.leftNodes.Lock()
+	c.leftNodes.m[node.key()] = leftNode{heartbeat: heartbeat, timestamp: GetNowInMillis()}
+	c.leftNodes.Unlock()
+}
+
+// hasLeft returns true if node is known to have left the cluster at or after
+// heartbeat.
+func (c *Cluster) hasLeft(node *Node, heartbeat uint32) bool {
+	c.leftNodes.RLock()
+	defer c.leftNodes.RUnlock()
+
+	left, ok := c.leftNodes.m[node.key()]
+
+	return ok && heartbeat <= left.heartbeat
+}
+
+// forgetLeftNode drops the record of a node's departure; for example,
+// because it has come back.
+func (c *Cluster) forgetLeftNode(node *Node) {
+	c.leftNodes.Lock()
+	delete(c.leftNodes.m, node.key())
+	c.leftNodes.Unlock()
+}
+
+// pruneLeftNodes forgets departures older than leftNodeRetentionMillis.
+func (c *Cluster) pruneLeftNodes() {
+	now := GetNowInMillis()
+
+	c.leftNodes.Lock()
+	for k, left := range c.leftNodes.m {
+		if now-left.timestamp > leftNodeRetentionMillis {
+			delete(c.leftNodes.m, k)
+		}
+	}
+	c.leftNodes.Unlock()
+}
+
+// transmitVerbLeave tells node that we're leaving. A leaving node answers
+// pings this way as well, rather than with an ACK.
+func (c *Cluster) transmitVerbLeave(node *Node) error {
+	c.leave.Lock()
+	heartbeat := c.leave.heartbeat
+	c.leave.Unlock()
+
+	return c.transmitVerbGeneric(node, nil, verbLeave, heartbeat)
+}
+
+func (c *Cluster) receiveVerbLeave(msg message) error {
+	logInfo(msg.sender.Address(), "is leaving the cluster")
+
+	c.nodeLeft(msg.sender, msg.senderHeartbeat, msg.sender)
+
+	return c.transmitVerbAck(msg.sender, msg.senderHeartbeat)
+}
@@ -19,10 +19,10 @@ package smudge
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	"net"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/andyollylarkin/smudge-custom-transport/transport"
@@ -40,158 +40,139 @@ const defaultIPv4MulticastAddress = "224.0.0.0"
 
 const defaultIPv6MulticastAddress = "[ff02::1]"
 
-var currentHeartbeat uint32
-
-var pendingAcks = struct {
-	sync.RWMutex
-	m map[string]*pendingAck
-}{m: make(map[string]*pendingAck)}
-
-var thisHostAddress string
-
-var thisHost *Node
-
-var ipLen = net.IPv4len
-
-// This flag is set whenever a known node is added or removed.
-var knownNodesModifiedFlag = false
-
-var pingdata = newPingData(GetPingHistoryFrontload(), 50)
-
-var transportImpl transport.Transport
-
 /******************************************************************************
  * Exported functions (for public consumption)
  *****************************************************************************/
 
-// Begin starts the server by opening a UDP port and beginning the heartbeat.
-// Note that this is a blocking function, so act appropriately.
-
-func SetTransport(trns transport.Transport) {
-	transportImpl = trns
+// SetTransport sets the transport used to exchange messages with other
+// nodes. If no transport is set, UDP is used. It has no effect once Begin()
+// has been called.
+func (c *Cluster) SetTransport(trns transport.Transport) {
+	c.transportImpl = trns
 }
 
-func setDefaultTransport() {
-	if transportImpl == nil {
+func (c *Cluster) setDefaultTransport() {
+	if c.transportImpl == nil {
 		logInfo("No transport set. Set UDP transport as default")
 
-		transportImpl = &udptransport.UDPTransport{}
+		c.transportImpl = &udptransport.UDPTransport{}
+	}
+}
+
+// Begin starts the server by opening a UDP port and beginning the heartbeat.
+// Note that this is a blocking function, so act appropriately.
+func (c *Cluster) Begin() {
+	err := c.BeginContext(context.Background())
+	if err != nil {
+		logError(err)
 	}
 }
 
-func Begin() {
+// BeginContext is like Begin, but the node runs only until ctx is done. At
+// that point the heartbeat stops, the listening connection is closed, and
+// BeginContext returns once every background goroutine has exited. An error
+// is returned if the listening connection can't be opened.
+func (c *Cluster) BeginContext(ctx context.Context) error {
 	// Add this host.
-	logfInfo("Using listen IP: %s", listenIP)
+	logfInfo("Using listen IP: %s", c.GetListenIP())
 
 	// Use IPv6 address length if the listen IP is not an IPv4 address
-	if GetListenIP().To4() == nil {
-		ipLen = net.IPv6len
+	if c.GetListenIP().To4() == nil {
+		c.ipLen = net.IPv6len
 	}
 
-	setDefaultTransport()
+	err := checkNodeName(c.GetNodeName())
+	if err != nil {
+		return err
+	}
+
+	c.setDefaultTransport()
+
+	// Transports that can check the cluster of their peers when connecting
+	// do so; the others rely on the cluster ID in each message.
+	if ca, ok := c.transportImpl.(transport.ClusterAware); ok {
+		ca.SetClusterID(c.clusterID())
+	}
+
+	conn, err := c.openListener(c.GetListenPort())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.setRunContext(ctx)
+
+	c.leave.Lock()
+	c.leave.acked = nil
+	c.leave.Unlock()
+
+	c.suspicions.Lock()
+	c.suspicions.m = make(map[string]*suspicion)
+	c.suspicions.Unlock()
+
+	// A previous run may have left our old self in the registry.
+	if c.thisHost != nil {
+		c.knownNodes.delete(c.thisHost)
+	}
 
-	initGlobalHostEnvironment()
+	c.initHostEnvironment()
 
-	logInfo("My host address:", thisHostAddress)
+	c.localMeta.Lock()
+	c.applyLocalMeta(c.thisHost)
+	c.localMeta.Unlock()
+
+	logInfo("My host address:", c.thisHostAddress)
 
 	// Add this node's status. Don't update any other node's statuses: they'll
 	// report those back to us.
-	updateNodeStatus(thisHost, StatusAlive, 0, thisHost)
-	AddNode(thisHost)
+	c.updateNodeStatus(c.thisHost, StatusAlive, 0, c.thisHost)
+	c.AddNode(c.thisHost)
 
-	go listen(GetListenPort())
+	c.goBackground(func() { c.listen(ctx, conn) })
 
 	// Add initial hosts as specified by the SMUDGE_INITIAL_HOSTS property
-	for _, address := range GetInitialHosts() {
-		n, err := CreateNodeByAddress(address)
+	for _, address := range c.GetInitialHosts() {
+		n, err := c.CreateNodeByAddress(address)
 		if err != nil {
 			logfError("Could not create node %s: %v", address, err)
 		} else {
-			AddNode(n)
+			c.AddNode(n)
 		}
 	}
 
 	// not all transport implementations may support multicast
-	if GetMulticastEnabled() && transportImpl.AllowMulticast() {
-		go listenMulticast(GetMulticastPort())
-		go multicastAnnounce(GetMulticastAddress())
+	if c.GetMulticastEnabled() && c.transportImpl.AllowMulticast() {
+		c.goBackground(func() { c.listenMulticast(ctx, c.GetMulticastPort()) })
+		c.goBackground(func() { c.multicastAnnounce(ctx, c.GetMulticastAddress()) })
 	}
 
-	go startTimeoutCheckLoop()
-
-	// Loop over a randomized list of all known nodes (except for this host
-	// node), pinging one at a time. If the knownNodesModifiedFlag is set to
-	// true by AddNode() or RemoveNode(), the we get a fresh list and start
-	// again.
-
-	for {
-		var randomAllNodes = knownNodes.getRandomNodes(0, thisHost)
-		var pingCounter int
-
-		for _, node := range randomAllNodes {
-			// Exponential backoff of dead nodes, until such time as they are removed.
-			if node.status == StatusDead {
-				var dnc *deadNodeCounter
-				var ok bool
-
-				deadNodeRetries.Lock()
-				if dnc, ok = deadNodeRetries.m[node.Address()]; !ok {
-					dnc = &deadNodeCounter{retry: 1, retryCountdown: 2}
-					deadNodeRetries.m[node.Address()] = dnc
-				}
-				deadNodeRetries.Unlock()
-
-				dnc.retryCountdown--
-
-				if dnc.retryCountdown <= 0 {
-					dnc.retry++
-					dnc.retryCountdown = int(math.Pow(2.0, float64(dnc.retry)))
-
-					if dnc.retry > maxDeadNodeRetries {
-						logDebug("Forgetting dead node", node.Address())
+	c.goBackground(func() { c.startTimeoutCheckLoop(ctx) })
+	c.goBackground(func() { c.pushPullLoop(ctx) })
 
-						deadNodeRetries.Lock()
-						delete(deadNodeRetries.m, node.Address())
-						deadNodeRetries.Unlock()
+	c.setRunning(true)
 
-						RemoveNode(node)
-						continue
-					}
-				} else {
-					continue
-				}
-			}
+	c.probeLoop(ctx)
 
-			currentHeartbeat++
-
-			logfTrace("%d - hosts=%d (announce=%d forward=%d)",
-				currentHeartbeat,
-				len(randomAllNodes),
-				emitCount(),
-				pingRequestCount())
+	c.setRunning(false)
 
-			PingNode(node)
-			pingCounter++
+	cancel()
+	c.background.Wait()
 
-			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
+	c.pendingAcks.Lock()
+	c.pendingAcks.m = make(map[string]*pendingAck)
+	c.pendingAcks.Unlock()
 
-			if knownNodesModifiedFlag {
-				knownNodesModifiedFlag = false
-				break
-			}
-		}
+	logInfo("Stopped host:", c.thisHostAddress)
 
-		if pingCounter == 0 {
-			logTrace("No nodes to ping. So lonely. :(")
-			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
-		}
-	}
+	return nil
 }
 
 // PingNode can be used to explicitly ping a node. Calls the low-level
 // doPingNode(), and outputs a message (and returns an error) if it fails.
-func PingNode(node *Node) error {
-	err := transmitVerbPing(node, currentHeartbeat)
+func (c *Cluster) PingNode(node *Node) error {
+	err := c.transmitVerbPing(node, c.currentHeartbeat.Load())
 	if err != nil {
 		logInfo("Failure to ping", node.Address(), "->", err)
 	}
@@ -208,6 +189,10 @@ func PingNode(node *Node) error {
 // Bytes 1 to N - Cluster name bytes
 // Bytes N+1... - A message (without members)
 func decodeMulticastAnnounceBytes(bytes []byte) (string, []byte, error) {
+	if len(bytes) == 0 {
+		return "", nil, errors.New("Invalid multicast message received")
+	}
+
 	nameBytesLen := int(bytes[0])
 
 	if nameBytesLen+1 > len(bytes) {
@@ -221,13 +206,15 @@ func decodeMulticastAnnounceBytes(bytes []byte) (string, []byte, error) {
 	return name, msgBytes, nil
 }
 
-func doForwardOnTimeout(pack *pendingAck) {
-	filteredNodes := getTargetNodes(pingRequestCount(), thisHost, pack.node)
+func (c *Cluster) doForwardOnTimeout(pack *pendingAck) {
+	filteredNodes := c.getTargetNodes(c.pingRequestCount(), c.thisHost, pack.node)
 
 	if len(filteredNodes) == 0 {
-		logDebug(thisHost.Address(), "Cannot forward ping request: no more nodes")
+		logDebug(c.thisHost.Address(), "Cannot forward ping request: no more nodes")
 
-		updateNodeStatus(pack.node, StatusDead, currentHeartbeat, thisHost)
+		if pack.node.Status() == StatusAlive {
+			c.updateNodeStatus(pack.node, StatusSuspected, c.currentHeartbeat.Load(), c.thisHost)
+		}
 	} else {
 		for i, n := range filteredNodes {
 			logfDebug("(%d/%d) Requesting indirect ping of %s via %s",
@@ -236,15 +223,15 @@ func doForwardOnTimeout(pack *pendingAck) {
 				pack.node.Address(),
 				n.Address())
 
-			transmitVerbForwardUDP(n, pack.node, currentHeartbeat)
+			c.transmitVerbForwardUDP(n, pack.node, c.currentHeartbeat.Load())
 		}
 	}
 }
 
 // The number of times any node's new status should be emitted after changes.
 // Currently set to (lambda * log(node count)).
-func emitCount() int {
-	logn := math.Log(float64(knownNodes.length()))
+func (c *Cluster) emitCount() int {
+	logn := math.Log(float64(c.knownNodes.length()))
 	mult := (lambda * logn) + 0.5
 
 	return int(mult)
@@ -254,8 +241,8 @@ func emitCount() int {
 // Byte  0      - 1 byte character byte length N
 // Bytes 1 to N - Cluster name bytes
 // Bytes N+1... - A message (without members)
-func encodeMulticastAnnounceBytes() []byte {
-	nameBytes := []byte(GetClusterName())
+func (c *Cluster) encodeMulticastAnnounceBytes() []byte {
+	nameBytes := []byte(c.GetClusterName())
 	nameBytesLen := len(nameBytes)
 
 	if nameBytesLen > 0xFF {
@@ -264,8 +251,8 @@ func encodeMulticastAnnounceBytes() []byte {
 			" bytes (max 254)")
 	}
 
-	msg := newMessage(verbPing, thisHost, currentHeartbeat)
-	msgBytes := msg.encode()
+	msg := newMessage(verbPing, c.thisHost, c.currentHeartbeat.Load())
+	msgBytes := msg.encode(c.ipLen, c.clusterID())
 	msgBytesLen := len(msgBytes)
 
 	totalByteCount := 1 + nameBytesLen + msgBytesLen
@@ -284,22 +271,25 @@ func encodeMulticastAnnounceBytes() []byte {
 	return bytes
 }
 
-func guessMulticastAddress() string {
-	if multicastAddress == "" {
-		if ipLen == net.IPv6len {
-			multicastAddress = defaultIPv6MulticastAddress
-		} else if ipLen == net.IPv4len {
-			multicastAddress = defaultIPv4MulticastAddress
+func (c *Cluster) guessMulticastAddress() string {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.multicastAddress == "" {
+		if c.ipLen == net.IPv6len {
+			c.multicastAddress = defaultIPv6MulticastAddress
+		} else if c.ipLen == net.IPv4len {
+			c.multicastAddress = defaultIPv4MulticastAddress
 		} else {
 			logFatal("Failed to determine IPv4/IPv6")
 		}
 	}
 
-	return multicastAddress
+	return c.multicastAddress
 }
 
 // getListenInterface gets the network interface for the listen IP
-func getListenInterface() (*net.Interface, error) {
+func (c *Cluster) getListenInterface() (*net.Interface, error) {
 	ifaces, err := net.Interfaces()
 	if err == nil {
 		for _, iface := range ifaces {
@@ -313,7 +303,7 @@ func getListenInterface() (*net.Interface, error) {
 				if err != nil {
 					continue
 				}
-				if ip.String() == GetListenIP().String() {
+				if ip.String() == c.GetListenIP().String() {
 					logfInfo("Found interface with listen IP: %s", iface.Name)
 					return &iface, nil
 				}
@@ -325,8 +315,8 @@ func getListenInterface() (*net.Interface, error) {
 
 // Returns a random slice of valid ping/forward request targets; i.e., not
 // this node, and not dead.
-func getTargetNodes(count int, exclude ...*Node) []*Node {
-	randomNodes := knownNodes.getRandomNodes(0, exclude...)
+func (c *Cluster) getTargetNodes(count int, exclude ...*Node) []*Node {
+	randomNodes := c.knownNodes.getRandomNodes(0, exclude...)
 	filteredNodes := make([]*Node, 0, count)
 
 	for _, n := range randomNodes {
@@ -334,7 +324,7 @@ func getTargetNodes(count int, exclude ...*Node) []*Node {
 			break
 		}
 
-		if n.status == StatusDead {
+		if n.Status() == StatusDead {
 			continue
 		}
 
@@ -344,50 +334,68 @@ func getTargetNodes(count int, exclude ...*Node) []*Node {
 	return filteredNodes
 }
 
-func initGlobalHostEnvironment() {
-	thisHost = &Node{
-		ip:         GetListenIP(),
-		port:       uint16(GetListenPort()),
+func (c *Cluster) initHostEnvironment() {
+	host := &Node{
+		name:       c.GetNodeName(),
+		ip:         c.GetListenIP(),
+		port:       uint16(c.GetListenPort()),
 		timestamp:  GetNowInMillis(),
 		pingMillis: PingNoData,
 	}
 
-	thisHostAddress = thisHost.Address()
+	c.run.Lock()
+	c.thisHost = host
+	c.run.Unlock()
+
+	c.thisHostAddress = host.Address()
 }
 
-func listen(port int) error {
-	listenAddress, err := transportImpl.ResolveAddr(transportImpl.Network(), ":"+strconv.FormatInt(int64(port), 10))
+// openListener opens the connection that listen() reads from.
+func (c *Cluster) openListener(port int) (transport.GenericConn, error) {
+	listenAddress, err := c.transportImpl.ResolveAddr(c.transportImpl.Network(), ":"+strconv.FormatInt(int64(port), 10))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	/* Now listen at selected port */
-	c, err := transportImpl.Listen(transportImpl.Network(), listenAddress)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
+	return c.transportImpl.Listen(c.transportImpl.Network(), listenAddress)
+}
+
+// listen reads messages from conn until ctx is done, at which point conn is
+// closed.
+func (c *Cluster) listen(ctx context.Context, conn transport.GenericConn) {
+	c.goBackground(func() {
+		<-ctx.Done()
+		conn.Close()
+	})
 
 	for {
 		buf := make([]byte, ReadBufSize) // big enough to fit 1280 IPv6 UDP message
-		n, addr, err := c.ReadFrom(buf)
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
 			logError("read error: ", err)
+			continue
 		}
 
-		go func(addr transport.SockAddr, msg []byte) {
-			err = receiveMessage(addr, buf[0:n])
+		msg := buf[0:n]
+
+		c.goBackground(func() {
+			err := c.receiveMessage(addr, msg)
 			if err != nil {
 				logError(err)
 			}
-		}(addr, buf[0:n])
+		})
 	}
 }
 
-func listenMulticast(port int) error {
-	addr := GetMulticastAddress()
+func (c *Cluster) listenMulticast(ctx context.Context, port int) error {
+	addr := c.GetMulticastAddress()
 	if addr == "" {
-		addr = guessMulticastAddress()
+		addr = c.guessMulticastAddress()
 	}
 
 	// TODO: replace with generic transport
@@ -397,60 +405,90 @@ func listenMulticast(port int) error {
 	}
 
 	/* Now listen at selected port */
-	iface, err := getListenInterface()
+	iface, err := c.getListenInterface()
 	if err != nil {
 		return err
 	}
-	c, err := net.ListenMulticastUDP("udp", iface, listenAddress)
+	conn, err := net.ListenMulticastUDP("udp", iface, listenAddress)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+
+	c.goBackground(func() {
+		<-ctx.Done()
+		conn.Close()
+	})
 
 	for {
 		buf := make([]byte, 2048) // big enough to fit 1280 IPv6 UDP message
-		n, addr, err := c.ReadFromUDP(buf)
+		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
 			logError("UDP read error:", err)
+			continue
 		}
 
-		go func(addr *net.UDPAddr, bytes []byte) {
-			name, msgBytes, err := decodeMulticastAnnounceBytes(bytes)
+		packet := buf[0:n]
 
+		c.goBackground(func() {
+			err := c.receiveMulticast(addr, packet)
 			if err != nil {
-				logDebug("Ignoring unexpected multicast message.")
-			} else {
-				if GetClusterName() == name {
-					msg, err := decodeMessage(addr.IP, msgBytes)
-					if err == nil {
-						logfTrace("Got multicast %v from %v code=%d",
-							msg.verb,
-							msg.sender.Address(),
-							msg.senderHeartbeat)
-
-						// Update statuses of the sender.
-						updateStatusesFromMessage(msg)
-					} else {
-						logError(err)
-					}
-				}
+				logDebug("Rejected a multicast message:", err)
 			}
-		}(addr, buf[0:n])
+		})
 	}
 }
 
+// receiveMulticast handles a multicast announcement. Those that fail
+// verification or can't be decoded are counted like unicast messages.
+func (c *Cluster) receiveMulticast(addr *net.UDPAddr, packet []byte) error {
+	bytes, err := c.openPacket(packet)
+	if err != nil {
+		c.rejectedMessages.Add(1)
+		return err
+	}
+
+	name, msgBytes, err := decodeMulticastAnnounceBytes(bytes)
+	if err != nil {
+		c.rejectedMessages.Add(1)
+		return err
+	}
+
+	if c.GetClusterName() != name {
+		return nil
+	}
+
+	msg, err := c.decodeMessage(addr.IP, msgBytes)
+	if err != nil {
+		return c.noteUndecodable(addr.String(), err)
+	}
+
+	logfTrace("Got multicast %v from %v code=%d",
+		msg.verb,
+		msg.sender.Address(),
+		msg.senderHeartbeat)
+
+	// Update statuses of the sender.
+	c.updateStatusesFromMessage(msg)
+
+	return nil
+}
+
 // multicastAnnounce is called when the server first starts to broadcast its
 // presence to all listening servers within the specified subnet and continues
 // to broadcast its presence every multicastAnnounceIntervalSeconds in case
 // this value is larger than zero.
-func multicastAnnounce(addr string) error {
+func (c *Cluster) multicastAnnounce(ctx context.Context, addr string) error {
 	if addr == "" {
-		addr = guessMulticastAddress()
+		addr = c.guessMulticastAddress()
 	}
 
 	// TODO: replace with generic transport
 
-	fullAddr := addr + ":" + strconv.FormatInt(int64(GetMulticastPort()), 10)
+	fullAddr := addr + ":" + strconv.FormatInt(int64(c.GetMulticastPort()), 10)
 
 	logInfo("Announcing presence on", fullAddr)
 
@@ -460,18 +498,25 @@ func multicastAnnounce(addr string) error {
 		return err
 	}
 	laddr := &net.UDPAddr{
-		IP:   GetListenIP(),
+		IP:   c.GetListenIP(),
 		Port: 0,
 	}
 	for {
-		c, err := net.DialUDP("udp", laddr, address)
+		conn, err := net.DialUDP("udp", laddr, address)
 		if err != nil {
 			logError(err)
 			return err
 		}
 		// Compose and send the multicast announcement
-		msgBytes := encodeMulticastAnnounceBytes()
-		_, err = c.Write(msgBytes)
+		packet, err := c.sealPacket(c.encodeMulticastAnnounceBytes())
+		if err != nil {
+			conn.Close()
+			logError(err)
+			return err
+		}
+
+		_, err = conn.Write(packet)
+		conn.Close()
 		if err != nil {
 			logError(err)
 			return err
@@ -479,27 +524,112 @@ func multicastAnnounce(addr string) error {
 
 		logfTrace("Sent announcement multicast from %v to %v", laddr, fullAddr)
 
-		if GetMulticastAnnounceIntervalSeconds() > 0 {
-			time.Sleep(time.Second * time.Duration(GetMulticastAnnounceIntervalSeconds()))
-		} else {
+		if c.GetMulticastAnnounceIntervalSeconds() <= 0 {
+			return nil
+		}
+
+		if !sleepContext(ctx, time.Second*time.Duration(c.GetMulticastAnnounceIntervalSeconds())) {
 			return nil
 		}
 	}
 }
 
+// probeLoop loops over a randomized list of all known nodes (except for
+// this host node), pinging one at a time, until ctx is done. If the
+// knownNodesModifiedFlag is set to true by AddNode() or RemoveNode(), the we
+// get a fresh list and start again.
+func (c *Cluster) probeLoop(ctx context.Context) {
+	for {
+		var randomAllNodes = c.knownNodes.getRandomNodes(0, c.thisHost)
+		var pingCounter int
+
+		for _, node := range randomAllNodes {
+			// Exponential backoff of dead nodes, until such time as they are removed.
+			if node.Status() == StatusDead {
+				var dnc *deadNodeCounter
+				var ok bool
+
+				c.deadNodeRetries.Lock()
+				if dnc, ok = c.deadNodeRetries.m[node.key()]; !ok {
+					dnc = &deadNodeCounter{retry: 1, retryCountdown: 2}
+					c.deadNodeRetries.m[node.key()] = dnc
+				}
+				c.deadNodeRetries.Unlock()
+
+				dnc.retryCountdown--
+
+				if dnc.retryCountdown <= 0 {
+					dnc.retry++
+					dnc.retryCountdown = int(math.Pow(2.0, float64(dnc.retry)))
+
+					if dnc.retry > maxDeadNodeRetries {
+						logDebug("Forgetting dead node", node.Address())
+
+						c.deadNodeRetries.Lock()
+						delete(c.deadNodeRetries.m, node.key())
+						c.deadNodeRetries.Unlock()
+
+						c.RemoveNode(node)
+						continue
+					}
+				} else {
+					continue
+				}
+			}
+
+			heartbeat := c.currentHeartbeat.Add(1)
+
+			logfTrace("%d - hosts=%d (announce=%d forward=%d)",
+				heartbeat,
+				len(randomAllNodes),
+				c.emitCount(),
+				c.pingRequestCount())
+
+			// Once we're leaving, we no longer ping anybody: the pings would
+			// tell the others that we're still alive.
+			if !c.isLeaving() {
+				c.PingNode(node)
+			}
+			pingCounter++
+
+			if !sleepContext(ctx, time.Millisecond*time.Duration(c.GetHeartbeatMillis())) {
+				return
+			}
+
+			if c.knownNodesModifiedFlag.CompareAndSwap(true, false) {
+				break
+			}
+		}
+
+		if pingCounter == 0 {
+			logTrace("No nodes to ping. So lonely. :(")
+
+			if !sleepContext(ctx, time.Millisecond*time.Duration(c.GetHeartbeatMillis())) {
+				return
+			}
+		}
+	}
+}
+
 // The number of nodes to send a PINGREQ to when a PING times out.
 // Currently set to (lambda * log(node count)).
-func pingRequestCount() int {
-	logn := math.Log(float64(knownNodes.length()))
+func (c *Cluster) pingRequestCount() int {
+	logn := math.Log(float64(c.knownNodes.length()))
 	mult := (lambda * logn) + 0.5
 
 	return int(mult)
 }
 
-func receiveMessage(addr transport.SockAddr, msgBytes []byte) error {
-	msg, err := decodeMessage(addr.GetIPAddr(), msgBytes)
+func (c *Cluster) receiveMessage(addr transport.SockAddr, packet []byte) error {
+	msgBytes, err := c.openPacket(packet)
 	if err != nil {
-		return err
+		c.rejectedMessages.Add(1)
+		return fmt.Errorf("rejected a packet from %v: %w", addr, err)
+	}
+
+	msg, err := c.decodeMessage(addr.GetIPAddr(), msgBytes)
+	if err != nil {
+		return c.noteUndecodable(addr.String(), err)
 	}
 
 	logfTrace("Got %v from %v code=%d",
@@ -508,30 +638,54 @@ func receiveMessage(addr transport.SockAddr, msgBytes []byte) error {
 		msg.senderHeartbeat)
 
 	// Synchronize heartbeats
-	if msg.senderHeartbeat > 0 && msg.senderHeartbeat-1 > currentHeartbeat {
-		logfTrace("Heartbeat advanced from %d to %d",
-			currentHeartbeat,
-			msg.senderHeartbeat-1)
+	for msg.senderHeartbeat > 0 {
+		current := c.currentHeartbeat.Load()
+		if msg.senderHeartbeat-1 <= current {
+			break
+		}
+
+		if c.currentHeartbeat.CompareAndSwap(current, msg.senderHeartbeat-1) {
+			logfTrace("Heartbeat advanced from %d to %d",
+				current,
+				msg.senderHeartbeat-1)
 
-		currentHeartbeat = msg.senderHeartbeat - 1
+			break
+		}
 	}
 
 	// Update statuses of the sender and any members the message includes.
-	updateStatusesFromMessage(msg)
+	c.updateStatusesFromMessage(msg)
 
-	// If there are broadcast bytes in the message, handle them here.
-	receiveBroadcast(msg.broadcast)
+	// The sender may be a seed that a Join() is waiting for.
+	c.noteJoinReply(msg)
+
+	// If there are broadcasts in the message, handle them here.
+	for _, broadcast := range msg.broadcasts {
+		c.receiveBroadcast(broadcast)
+	}
 
 	// Handle the verb.
 	switch msg.verb {
 	case verbPing:
-		err = receiveVerbPing(msg)
+		err = c.receiveVerbPing(msg)
 	case verbAck:
-		err = receiveVerbAck(msg)
+		err = c.receiveVerbAck(msg)
 	case verbPingRequest:
-		err = receiveVerbForward(msg)
+		err = c.receiveVerbForward(msg)
 	case verbNonForwardingPing:
-		err = receiveVerbNonForwardPing(msg)
+		err = c.receiveVerbNonForwardPing(msg)
+	case verbLeave:
+		err = c.receiveVerbLeave(msg)
+	case verbSync:
+		err = c.receiveVerbSync(msg)
+	case verbUser:
+		err = c.receiveVerbUser(msg)
+	case verbQueryResponse:
+		err = c.receiveVerbQueryResponse(msg)
+	case verbBroadcastSync:
+		err = c.receiveVerbBroadcastSync(msg)
+	case verbBroadcastAck:
+		err = c.receiveVerbBroadcastAck(msg)
 	}
 
 	if err != nil {
@@ -541,53 +695,83 @@ func receiveMessage(addr transport.SockAddr, msgBytes []byte) error {
 	return nil
 }
 
-func receiveVerbAck(msg message) error {
-	key := msg.sender.Address() + ":" + strconv.FormatInt(int64(msg.senderHeartbeat), 10)
+// noteUndecodable counts a message from addr that couldn't be decoded under
+// its cause, and returns the error to report, if any: messages from another
+// cluster, or in a version this node doesn't support, aren't errors.
+func (c *Cluster) noteUndecodable(addr string, err error) error {
+	var versionErr *unsupportedVersionError
+
+	if errors.Is(err, errBadChecksum) {
+		c.rejectedMessages.Add(1)
+
+		return err
+	} else if errors.Is(err, errForeignCluster) {
+		c.foreignMessages.Add(1)
+		logfDebug("Dropped a message from %v: it's from another cluster", addr)
+
+		return nil
+	} else if errors.As(err, &versionErr) {
+		c.noteUnsupportedVersion(addr, versionErr)
+
+		return nil
+	}
+
+	return err
+}
+
+func (c *Cluster) receiveVerbAck(msg message) error {
+	key := msg.sender.key() + ":" + strconv.FormatInt(int64(msg.senderHeartbeat), 10)
 
-	pendingAcks.RLock()
-	_, ok := pendingAcks.m[key]
-	pendingAcks.RUnlock()
+	c.pendingAcks.RLock()
+	_, ok := c.pendingAcks.m[key]
+	c.pendingAcks.RUnlock()
 
 	if ok {
 		msg.sender.Touch()
 
-		pendingAcks.Lock()
+		c.pendingAcks.Lock()
 
-		if pack, ok := pendingAcks.m[key]; ok {
+		if pack, ok := c.pendingAcks.m[key]; ok {
 			// If this is a response to a requested ping, respond to the
 			// callback node
 			if pack.callback != nil {
-				go transmitVerbAck(pack.callback, pack.callbackCode)
+				callback, code := pack.callback, pack.callbackCode
+				c.goBackground(func() { c.transmitVerbAck(callback, code) })
 			} else {
 				// Note the ping response time.
-				notePingResponseTime(pack)
+				c.notePingResponseTime(pack)
 			}
 		}
 
-		delete(pendingAcks.m, key)
-		pendingAcks.Unlock()
+		delete(c.pendingAcks.m, key)
+		c.pendingAcks.Unlock()
+	} else {
+		c.noteLeaveAck(msg)
 	}
 
 	return nil
 }
 
-func notePingResponseTime(pack *pendingAck) {
+func (c *Cluster) notePingResponseTime(pack *pendingAck) {
 	// Note the elapsed time
 	elapsedMillis := pack.elapsed()
 
-	pack.node.pingMillis = int(elapsedMillis)
+	pack.node.setPingMillis(int(elapsedMillis))
+
+	// We're keeping up.
+	c.adjustLocalHealth(-1)
 
 	// For the purposes of timeout tolerance, we treat all pings less than
 	// the ping lower bound as that lower bound.
-	minMillis := uint32(GetMinPingTime())
+	minMillis := uint32(c.GetMinPingTime())
 	if elapsedMillis < minMillis {
 		elapsedMillis = minMillis
 	}
 
-	pingdata.add(elapsedMillis)
+	c.pingdata.add(elapsedMillis)
 
-	mean, stddev := pingdata.data()
-	sigmas := pingdata.nSigma(timeoutToleranceSigmas)
+	mean, stddev := c.pingdata.data()
+	sigmas := c.pingdata.nSigma(timeoutToleranceSigmas)
 
 	logfTrace("Got ACK in %dms (mean=%.02f stddev=%.02f sigmas=%.02f)",
 		elapsedMillis,
@@ -596,7 +780,12 @@ func notePingResponseTime(pack *pendingAck) {
 		sigmas)
 }
 
-func receiveVerbForward(msg message) error {
+func (c *Cluster) receiveVerbForward(msg message) error {
+	// A leaving node doesn't vouch for anybody.
+	if c.isLeaving() {
+		return nil
+	}
+
 	// We don't forward to a node that we don't know.
 
 	if len(msg.members) >= 0 &&
@@ -605,7 +794,7 @@ func receiveVerbForward(msg message) error {
 		member := msg.members[0]
 		node := member.node
 		code := member.heartbeat
-		key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
+		key := node.key() + ":" + strconv.FormatInt(int64(code), 10)
 
 		pack := pendingAck{
 			node:         node,
@@ -614,30 +803,44 @@ func receiveVerbForward(msg message) error {
 			callbackCode: code,
 			packType:     packNFP}
 
-		pendingAcks.Lock()
-		pendingAcks.m[key] = &pack
-		pendingAcks.Unlock()
+		c.pendingAcks.Lock()
+		c.pendingAcks.m[key] = &pack
+		c.pendingAcks.Unlock()
 
-		return transmitVerbGeneric(node, nil, verbNonForwardingPing, code)
+		return c.transmitVerbGeneric(node, nil, verbNonForwardingPing, code)
 	}
 
 	return nil
 }
 
-func receiveVerbPing(msg message) error {
-	return transmitVerbAck(msg.sender, msg.senderHeartbeat)
+func (c *Cluster) receiveVerbPing(msg message) error {
+	if c.isLeaving() {
+		return c.transmitVerbLeave(msg.sender)
+	}
+
+	return c.transmitVerbAck(msg.sender, msg.senderHeartbeat)
 }
 
-func receiveVerbNonForwardPing(msg message) error {
-	return transmitVerbAck(msg.sender, msg.senderHeartbeat)
+func (c *Cluster) receiveVerbNonForwardPing(msg message) error {
+	if c.isLeaving() {
+		return c.transmitVerbLeave(msg.sender)
+	}
+
+	return c.transmitVerbAck(msg.sender, msg.senderHeartbeat)
 }
 
-func startTimeoutCheckLoop() {
+func (c *Cluster) startTimeoutCheckLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
 	for {
-		pendingAcks.Lock()
-		for k, pack := range pendingAcks.m {
+		c.pendingAcks.Lock()
+		for k, pack := range c.pendingAcks.m {
 			elapsed := pack.elapsed()
-			timeoutMillis := uint32(pingdata.nSigma(timeoutToleranceSigmas))
+			timeoutMillis := uint32(c.pingdata.nSigma(timeoutToleranceSigmas))
+
+			// If we're not doing well ourselves, we give others more time.
+			timeoutMillis *= uint32(c.localHealthMultiplier())
 
 			// Ping requests are expected to take quite a bit longer.
 			// Just call it 2x for now.
@@ -650,114 +853,167 @@ func startTimeoutCheckLoop() {
 			if elapsed > timeoutMillis {
 				switch pack.packType {
 				case packPing:
-					go doForwardOnTimeout(pack)
+					// A missed ACK may just as well be our own fault.
+					c.adjustLocalHealth(1)
+
+					pack := pack
+					c.goBackground(func() { c.doForwardOnTimeout(pack) })
 				case packPingReq:
 					logDebug(k, "timed out after", timeoutMillis, "milliseconds (dropped PINGREQ)")
 
-					if knownNodes.contains(pack.callback) {
-						switch pack.callback.Status() {
-						case StatusDead:
-							break
-						case StatusSuspected:
-							updateNodeStatus(pack.callback, StatusDead, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
-						default:
-							updateNodeStatus(pack.callback, StatusSuspected, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
+					// A suspected node is only declared dead once its
+					// suspicion times out; see checkSuspicions().
+					if c.knownNodes.contains(pack.callback) {
+						if pack.callback.Status() == StatusAlive {
+							c.updateNodeStatus(pack.callback, StatusSuspected, c.currentHeartbeat.Load(), c.thisHost)
+							pack.callback.setPingMillis(PingTimedOut)
 						}
 					}
 				case packNFP:
 					logDebug(k, "timed out after", timeoutMillis, "milliseconds (dropped NFP)")
 
-					if knownNodes.contains(pack.node) {
-						switch pack.node.Status() {
-						case StatusDead:
-							break
-						case StatusSuspected:
-							updateNodeStatus(pack.node, StatusDead, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
-						default:
-							updateNodeStatus(pack.node, StatusSuspected, currentHeartbeat, thisHost)
-							pack.callback.pingMillis = PingTimedOut
+					if c.knownNodes.contains(pack.node) {
+						if pack.node.Status() == StatusAlive {
+							c.updateNodeStatus(pack.node, StatusSuspected, c.currentHeartbeat.Load(), c.thisHost)
+							pack.callback.setPingMillis(PingTimedOut)
 						}
 					}
 				}
 
-				delete(pendingAcks.m, k)
+				delete(c.pendingAcks.m, k)
 			}
 		}
-		pendingAcks.Unlock()
+		c.pendingAcks.Unlock()
+
+		c.checkSuspicions()
+		c.pruneLeftNodes()
+		c.pruneFragments()
+		c.pruneRetainedBroadcasts()
+		c.pruneNamedBroadcasts()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-		time.Sleep(time.Millisecond * 100)
+func (c *Cluster) transmitVerbGeneric(node *Node, forwardTo *Node, verb messageVerb, code uint32) error {
+	msg := newMessage(verb, c.thisHost, code)
+
+	if forwardTo != nil {
+		msg.addMember(forwardTo, StatusForwardTo, code, forwardTo.StatusSource())
 	}
+
+	return c.transmitMessage(node, &msg)
 }
 
-func transmitVerbGeneric(node *Node, forwardTo *Node, verb messageVerb, code uint32) error {
-	// Transmit the ACK
-	remoteAddr, err := transportImpl.ResolveAddr(transportImpl.Network(), node.Address())
+// transmitMessage fills msg with as much gossip as fits, and sends it to
+// node.
+func (c *Cluster) transmitMessage(node *Node, msg *message) error {
+	remoteAddr, err := c.transportImpl.ResolveAddr(c.transportImpl.Network(), node.Address())
+	if err != nil {
+		return err
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, cancel := context.WithTimeout(c.runContext(), time.Second*30)
 	defer cancel()
 
-	c, err := transportImpl.Dial(ctx, nil, remoteAddr)
+	conn, err := c.transportImpl.Dial(ctx, nil, remoteAddr)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	defer conn.Close()
 
-	msg := newMessage(verb, thisHost, code)
-
-	if forwardTo != nil {
-		msg.addMember(forwardTo, StatusForwardTo, code, forwardTo.statusSource)
+	msg.version, err = c.protocolVersionFor(node)
+	if err != nil {
+		return err
 	}
 
-	// Add members for update.
-	nodes := getRandomUpdatedNodes(pingRequestCount(), node, thisHost)
+	// The message is filled with as many member updates and broadcasts as
+	// fit in a packet, in order of emit counter.
+	max := c.maxMessageBytes()
+
+	// Add members for update. This host is one of them if it has news about
+	// itself, such as a refutation of suspicion.
+	nodes := c.getRandomUpdatedNodes(c.updatedNodes.length(), node)
 
 	// No updates to distribute? Send out a few updates on other known nodes.
 	if len(nodes) == 0 {
-		nodes = knownNodes.getRandomNodes(pingRequestCount(), node, thisHost)
+		nodes = c.knownNodes.getRandomNodes(c.pingRequestCount(), node, c.thisHost)
 	}
 
 	for _, n := range nodes {
-		err = msg.addMember(n, n.status, n.heartbeat, n.statusSource)
-		if err != nil {
-			return err
+		status, heartbeat, source := n.gossip()
+		if !msg.tryAddMember(n, status, heartbeat, source, c.ipLen, max) {
+			break
 		}
 
-		n.emitCounter--
+		n.emitted()
+	}
+
+	// If we have metadata, we always mention ourselves, so that it reaches
+	// every node sooner or later; late joiners included.
+	if c.thisHost.MetaVersion() > 0 && !containsNode(nodes, c.thisHost) {
+		status, heartbeat, _ := c.thisHost.gossip()
+		msg.tryAddMember(c.thisHost, status, heartbeat, c.thisHost, c.ipLen, max)
 	}
 
 	// Emit counters for broadcasts can be less than 0. We transmit positive
 	// numbers, and decrement all the others. At some value < 0, the broadcast
-	// is removed from the map all together.
-	broadcast := getBroadcastToEmit()
-	if broadcast != nil {
-		if broadcast.emitCounter > 0 {
-			msg.addBroadcast(broadcast)
+	// is removed from the map all together. A broadcast that doesn't fit
+	// keeps its count for the next message, unless it wouldn't even fit in
+	// an empty one.
+	empty := newMessage(verbPing, c.thisHost, 0)
+	room := max - empty.encodedSize(c.ipLen)
+
+	for _, broadcast := range c.getBroadcastsToEmit() {
+		c.broadcasts.RLock()
+		pending := broadcast.emitCounter > 0
+		c.broadcasts.RUnlock()
+
+		if pending && !msg.tryAddBroadcast(broadcast, c.ipLen, max) {
+			if size := broadcast.encodedSize(c.ipLen); size > room {
+				c.dropBroadcast(broadcast, fmt.Errorf("broadcast %s too long to send: %d bytes (max %d)",
+					broadcast.Label(), size, room))
+			}
+
+			continue
 		}
 
+		c.broadcasts.Lock()
 		broadcast.emitCounter--
+		c.broadcasts.Unlock()
+
+		if broadcast.handle != nil {
+			broadcast.handle.check()
+		}
 	}
 
-	logTrace("Write to: ", c.RemoteAddr().String())
-	_, err = c.Write(msg.encode())
+	packet, err := c.encodePacket(msg)
+	if err != nil {
+		return err
+	}
+
+	logTrace("Write to: ", conn.RemoteAddr().String())
+	_, err = conn.Write(packet)
 	if err != nil {
 		return err
 	}
 
 	// Decrement the update counters on those nodes
 	for _, m := range msg.members {
-		m.node.emitCounter--
+		m.node.emitted()
 	}
 
-	logfTrace("Sent %v to %v", verb, node.Address())
+	logfTrace("Sent %v to %v", msg.verb, node.Address())
 
 	return nil
 }
 
-func transmitVerbForwardUDP(node *Node, downstream *Node, code uint32) error {
-	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
+func (c *Cluster) transmitVerbForwardUDP(node *Node, downstream *Node, code uint32) error {
+	key := node.key() + ":" + strconv.FormatInt(int64(code), 10)
 
 	pack := pendingAck{
 		node:      node,
@@ -765,70 +1021,155 @@ func transmitVerbForwardUDP(node *Node, downstream *Node, code uint32) error {
 		callback:  downstream,
 		packType:  packPingReq}
 
-	pendingAcks.Lock()
-	pendingAcks.m[key] = &pack
-	pendingAcks.Unlock()
+	c.pendingAcks.Lock()
+	c.pendingAcks.m[key] = &pack
+	c.pendingAcks.Unlock()
 
-	return transmitVerbGeneric(node, downstream, verbPingRequest, code)
+	return c.transmitVerbGeneric(node, downstream, verbPingRequest, code)
 }
 
-func transmitVerbAck(node *Node, code uint32) error {
-	return transmitVerbGeneric(node, nil, verbAck, code)
+func (c *Cluster) transmitVerbAck(node *Node, code uint32) error {
+	return c.transmitVerbGeneric(node, nil, verbAck, code)
 }
 
-func transmitVerbPing(node *Node, code uint32) error {
-	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
+func (c *Cluster) transmitVerbPing(node *Node, code uint32) error {
+	key := node.key() + ":" + strconv.FormatInt(int64(code), 10)
 	pack := pendingAck{
 		node:      node,
 		startTime: GetNowInMillis(),
 		packType:  packPing}
 
-	pendingAcks.Lock()
-	pendingAcks.m[key] = &pack
-	pendingAcks.Unlock()
+	c.pendingAcks.Lock()
+	c.pendingAcks.m[key] = &pack
+	c.pendingAcks.Unlock()
 
-	return transmitVerbGeneric(node, nil, verbPing, code)
+	return c.transmitVerbGeneric(node, nil, verbPing, code)
 }
 
-func updateStatusesFromMessage(msg message) {
+func (c *Cluster) updateStatusesFromMessage(msg message) {
 	for _, m := range msg.members {
+		// The FORWARD_TO status isn't useful here, so we ignore those.
+		if m.status == StatusForwardTo {
+			continue
+		}
+
+		// Don't tell ME I'm suspected or dead: I know better, and I'll say
+		// so with a new incarnation.
+		if m.node.key() == c.thisHost.key() {
+			if (m.status == StatusSuspected || m.status == StatusDead) &&
+				m.incarnation >= c.thisHost.Incarnation() && !c.isLeaving() {
+				c.refuteSuspicion(m.incarnation)
+			}
+
+			continue
+		}
+
+		// Gossip that predates a node's departure is no longer news.
+		if !c.knownNodes.contains(m.node) && c.hasLeft(m.node, m.heartbeat) {
+			continue
+		}
+
+		// Metadata is versioned separately, so it may be news even when the
+		// status isn't.
+		if c.knownNodes.contains(m.node) {
+			c.updateNodeMeta(m.node, m.metaVersion, m.meta)
+		}
+
+		m.node.lock.Lock()
+		incarnation, lastHeartbeat := m.node.incarnation, m.node.heartbeat
+
+		// Gossip about an older incarnation of the node than the one we know
+		// of has been overridden, and we drop it.
+		if m.incarnation < incarnation {
+			m.node.lock.Unlock()
+
+			logfDebug("Message is about an old incarnation (%d vs %d): dropping",
+				incarnation, m.incarnation)
+
+			continue
+		}
+
 		// If the heartbeat in the message is less then the heartbeat
-		// associated with the last known status, then we conclude that the
-		// message is old and we drop it.
-		if m.heartbeat < m.node.heartbeat {
+		// associated with the last known status of the same incarnation,
+		// then we conclude that the message is old and we drop it.
+		if m.incarnation == incarnation && m.heartbeat < lastHeartbeat {
+			m.node.lock.Unlock()
+
 			logfDebug("Message is old (%d vs %d): dropping",
-				m.node.heartbeat, m.heartbeat)
+				lastHeartbeat, m.heartbeat)
 
 			continue
 		}
 
+		m.node.incarnation = m.incarnation
+		m.node.lock.Unlock()
+
+		// A newer incarnation wins even with an older heartbeat, but we never
+		// move a node's heartbeat backwards.
+		heartbeat := m.heartbeat
+		if heartbeat < lastHeartbeat {
+			heartbeat = lastHeartbeat
+		}
+
 		switch m.status {
-		case StatusForwardTo:
-			// The FORWARD_TO status isn't useful here, so we ignore those.
-			continue
-		case StatusDead:
-			// Don't tell ME I'm dead.
-			if m.node.Address() != thisHost.Address() {
-				updateNodeStatus(m.node, m.status, m.heartbeat, m.source)
-				AddNode(m.node)
-			}
+		case StatusLeft:
+			c.nodeLeft(m.node, heartbeat, m.source)
 		default:
-			updateNodeStatus(m.node, m.status, m.heartbeat, m.source)
-			AddNode(m.node)
+			c.updateNodeStatus(m.node, m.status, heartbeat, m.source)
+			c.AddNode(m.node)
+			c.updateNodeMeta(m.node, m.metaVersion, m.meta)
+
+			if m.status == StatusSuspected {
+				c.confirmSuspicion(m.node, m.source)
+			}
 		}
 	}
 
+	// A leaving sender is handled by receiveVerbLeave().
+	if msg.verb == verbLeave {
+		return
+	}
+
+	// The sender may be coming back after having left.
+	c.forgetLeftNode(msg.sender)
+
 	// Obviously, we know the sender is alive. Report it as such.
-	if msg.senderHeartbeat > msg.sender.heartbeat {
-		updateNodeStatus(msg.sender, StatusAlive, msg.senderHeartbeat, thisHost)
+	if msg.senderHeartbeat > msg.sender.lastHeartbeat() {
+		c.updateNodeStatus(msg.sender, StatusAlive, msg.senderHeartbeat, c.thisHost)
 	}
 
 	// Finally, if we don't know the sender we add it to the known hosts map.
-	if !knownNodes.contains(msg.sender) {
-		AddNode(msg.sender)
+	if !c.knownNodes.contains(msg.sender) {
+		c.AddNode(msg.sender)
 	}
 }
 
+// refuteSuspicion answers gossip that this node is suspected or dead, as of
+// the given incarnation, by moving to a newer incarnation and gossiping that
+// it's alive.
+func (c *Cluster) refuteSuspicion(incarnation uint32) {
+	emitCount := int8(c.emitCount())
+
+	c.thisHost.lock.Lock()
+	c.thisHost.incarnation = incarnation + 1
+	c.thisHost.heartbeat = c.currentHeartbeat.Load()
+	c.thisHost.emitCounter = emitCount
+	c.thisHost.lock.Unlock()
+
+	c.thisHost.Touch()
+
+	// Being suspected by others suggests that we may be the problem.
+	c.adjustLocalHealth(1)
+
+	if !c.updatedNodes.contains(c.thisHost) {
+		c.updatedNodes.add(c.thisHost)
+	}
+
+	logfInfo("Refuting suspicion of %s with incarnation %d",
+		c.thisHost.Address(),
+		incarnation+1)
+}
+
 // pendingAckType represents an expectation of a response to a previously
 // emitted PING, PINGREQ, or NFP.
 type pendingAck struct {
@@ -17,6 +17,7 @@ limitations under the License.
 package smudge
 
 import (
+	"net"
 	"os"
 	"testing"
 
@@ -30,9 +31,57 @@ func TestInitGlobalHostEnvironment(t *testing.T) {
 	defer os.Unsetenv(EnvVarListenIP)
 	require.Nil(t, err)
 
-	initGlobalHostEnvironment()
+	defaultCluster.initHostEnvironment()
 
-	require.Equal(t, thisHostAddress, thisHost.Address())
-	require.Equal(t, "0.0.0.0:9999", thisHost.Address())
-	require.Equal(t, uint16(9999), thisHost.Port())
+	require.Equal(t, defaultCluster.thisHostAddress, defaultCluster.thisHost.Address())
+	require.Equal(t, "0.0.0.0:9999", defaultCluster.thisHost.Address())
+	require.Equal(t, uint16(9999), defaultCluster.thisHost.Port())
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	c, peers := newTestClusterWithPeers(t, 1)
+	peer := peers[0]
+
+	msg := newMessage(verbAck, peer, 1)
+	msg.addMember(c.thisHost, StatusSuspected, 10, peer)
+
+	c.updateStatusesFromMessage(msg)
+
+	require.Equal(t, StatusAlive, c.thisHost.Status())
+	require.Equal(t, uint32(1), c.thisHost.Incarnation())
+	require.True(t, c.updatedNodes.contains(c.thisHost))
+
+	// Gossip about the incarnation we've already refuted changes nothing.
+	c.updateStatusesFromMessage(msg)
+	require.Equal(t, uint32(1), c.thisHost.Incarnation())
+}
+
+func TestIncarnationOverridesSuspicion(t *testing.T) {
+	c, peers := newTestClusterWithPeers(t, 1)
+	peer := peers[0]
+
+	suspect, err := CreateNodeByIP(net.IPv4(10, 0, 3, 3), 9999)
+	require.NoError(t, err)
+	c.AddNode(suspect)
+	c.updateNodeStatus(suspect, StatusSuspected, 50, c.thisHost)
+
+	// The suspect refutes with a newer incarnation, but an older heartbeat.
+	msg := newMessage(verbAck, peer, 1)
+	msg.addMember(suspect, StatusAlive, 10, suspect)
+	msg.members[0].incarnation = 1
+
+	c.updateStatusesFromMessage(msg)
+
+	require.Equal(t, StatusAlive, suspect.Status())
+	require.Equal(t, uint32(1), suspect.Incarnation())
+	require.Equal(t, uint32(50), suspect.heartbeat)
+
+	// Later suspicion of the old incarnation is stale, whatever its heartbeat.
+	msg = newMessage(verbAck, peer, 1)
+	msg.addMember(suspect, StatusSuspected, 100, peer)
+	msg.members[0].incarnation = 0
+
+	c.updateStatusesFromMessage(msg)
+
+	require.Equal(t, StatusAlive, suspect.Status())
 }
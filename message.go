@@ -19,34 +19,78 @@ package smudge
 import (
 	"errors"
 	"fmt"
-	"hash/adler32"
+	"hash/crc32"
 	"net"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
 )
 
-// Message contents
-// ---[ Base message (11 bytes)]---
-// Bytes 00-03 Checksum (32-bit)
-// Bytes 04    Verb (one of {PING|ACK|PINGREQ|NFPING})
-// Bytes 05-06 Sender response port
-// Bytes 07-10 Sender current heartbeat
-// ---[ Per member (23 bytes)]---
+// Message layout
+//
+// The first 7 bytes keep their places in every protocol version; the rest is
+// as of protocol version 1. IP addresses take 16 bytes, or 4 in a cluster
+// that uses IPv4 (the offsets for IPv4 are in parentheses).
+//
+// ---[ Base message (23+N bytes) ]---
+// Bytes 00-03 Checksum (CRC-32C of bytes 04-NN)
+// Bytes 04    Protocol version of this message
+// Bytes 05    Lowest protocol version the sender supports
+// Bytes 06    Highest protocol version the sender supports
+// Bytes 07-10 Cluster ID (hash of the cluster name)
+// Bytes 11    Verb (one of {PING|ACK|PINGREQ|NFPING|LEAVE|SYNC|SYNCDATA|USER|
+//             QRESP|BSYNC|BACK})
+// Bytes 12-13 Member count
+// Bytes 14-15 Broadcast count
+// Bytes 16-17 Sender response port
+// Bytes 18-21 Sender current heartbeat (ID code)
+// Bytes 22    Sender name length N
+// Bytes 23-NN Sender name
+// ---[ Per member (52+M+N bytes, 28+M+N for IPv4) ]---
 // Bytes 00    Member status byte
-// Bytes 01-16 Member host IP (01-04 for IPv4)
-// Bytes 17-18 Member host response port (05-06 for IPv4)
-// Bytes 19-22 Sender current heartbeat (07-10 for IPv4)
-// ---[ Per broadcast (1 allowed) (23+N bytes) ]
-// Bytes 00-15 Origin IP (00-03 for IPv4)
-// Bytes 16-17 Origin response port (04-05 for IPv4)
-// Bytes 18-21 Origin broadcast counter (06-09 for IPv4)
-// Bytes 22-23 Payload length (bytes) (10-11 for IPv4)
-// Bytes 24-NN Payload (12-NN for IPv4)
+// Bytes 01-16 Member host IP (01-04)
+// Bytes 17-18 Member host response port (05-06)
+// Bytes 19-22 Member heartbeat (07-10)
+// Bytes 23-26 Member incarnation (11-14)
+// Bytes 27-42 Gossip source IP (15-18)
+// Bytes 43-44 Gossip source response port (19-20)
+// Bytes 45-48 Member metadata version (21-24)
+// Bytes 49-50 Member metadata length M (25-26)
+// Bytes 51-NN Member metadata (27-NN)
+// Byte  NN+1  Member name length N
+// Bytes NN+2… Member name
+// ---[ Per broadcast (33+N bytes, 21+N for IPv4) ]---
+// Bytes 00-15 Origin IP (00-03)
+// Bytes 16-17 Origin response port (04-05)
+// Bytes 18-25 Origin epoch (06-13)
+// Bytes 26-29 Origin broadcast counter (14-17)
+// Bytes 30-31 Payload length N (18-19)
+// Bytes 32    Broadcast kind; high bit set to ask for acks (20)
+// Bytes 33-NN Payload (21-NN)
+// ---[ Payload (USER, QRESP, BSYNC and BACK messages only) (2+N bytes) ]---
+// Bytes 00-01 Payload length N
+// Bytes 02-NN Payload
+
+// errForeignCluster is returned when decoding a message that was sent by a
+// node of another cluster.
+var errForeignCluster = errors.New("message is from another cluster")
+
+// errBadChecksum is returned when decoding a message whose checksum doesn't
+// match its contents.
+var errBadChecksum = errors.New("checksum failure")
+
+// The CRC-32 (Castagnoli) table that message checksums are computed with.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
 
 type message struct {
+	version         uint8
 	sender          *Node
 	senderHeartbeat uint32
 	verb            messageVerb
 	members         []*messageMember
-	broadcast       *Broadcast
+	broadcasts      []*Broadcast
+
+	// The user's payload of a USER message.
+	payload []byte
 }
 
 // Represents a "member" of a message; i.e., a node that the sender knows
@@ -58,8 +102,17 @@ type messageMember struct {
 	// The last known heartbeat of node.
 	heartbeat uint32
 
-	// The subject of the gossip.
+	// The incarnation of node that the status applies to.
+	incarnation uint32
+
+	// The version of node's metadata, and the metadata itself (encoded).
+	metaVersion uint32
+	meta        []byte
+
+	// The subject of the gossip, and its name when the gossip was composed
+	// (or received).
 	node *Node
+	name string
 
 	// The status that the gossip is conveying.
 	status NodeStatus
@@ -68,88 +121,117 @@ type messageMember struct {
 // Convenience function. Creates a new message instance.
 func newMessage(verb messageVerb, sender *Node, senderHeartbeat uint32) message {
 	return message{
+		version:         ProtocolVersionMax,
 		sender:          sender,
 		senderHeartbeat: senderHeartbeat,
 		verb:            verb,
 	}
 }
 
-// Adds a broadcast to this message. Only one broadcast is allowed; subsequent
-// calls will replace an existing broadcast.
-func (m *message) addBroadcast(broadcast *Broadcast) {
-	m.broadcast = broadcast
+// Adds a broadcast to this message.
+func (m *message) addBroadcast(broadcast *Broadcast) error {
+	if len(m.broadcasts) >= 0xFFFF {
+		return errors.New("broadcast list overflow")
+	}
+
+	m.broadcasts = append(m.broadcasts, broadcast)
+
+	return nil
+}
+
+// Adds a broadcast to this message if the message, once encoded, still fits
+// in max bytes. Returns true if it was added.
+func (m *message) tryAddBroadcast(broadcast *Broadcast, ipLen int, max int) bool {
+	if m.encodedSize(ipLen)+broadcast.encodedSize(ipLen) > max {
+		return false
+	}
+
+	return m.addBroadcast(broadcast) == nil
 }
 
-// Adds a member status update to this message. The maximum number of allowed
-// members is 2^6 - 1 = 63, though it is incredibly unlikely that this maximum
-// will be reached without an absurdly high lambda. There aren't yet many
-// 88 billion node clusters (assuming lambda of 2.5).
+// Adds a member status update to this message. Members are limited only by
+// the size of the packet (see tryAddMember), up to 65535.
 func (m *message) addMember(node *Node, status NodeStatus, heartbeat uint32, gossipSource *Node) error {
 	if m.members == nil {
 		m.members = make([]*messageMember, 0, 32)
-	} else if len(m.members) >= 63 {
+	} else if len(m.members) >= 0xFFFF {
 		return errors.New("member list overflow")
 	}
 
+	node.lock.RLock()
 	messageMember := messageMember{
-		heartbeat: heartbeat,
-		node:      node,
-		status:    status,
-		source:    gossipSource,
+		heartbeat:   heartbeat,
+		incarnation: node.incarnation,
+		metaVersion: node.metaVersion,
+		meta:        node.metaBytes,
+		node:        node,
+		name:        node.name,
+		status:      status,
+		source:      gossipSource,
 	}
+	node.lock.RUnlock()
 
 	m.members = append(m.members, &messageMember)
 
 	return nil
 }
 
-// Message contents
-// ---[ Base message (12 bytes)]---
-// Bytes 00-03 Checksum (32-bit)
-// Bytes 04    Verb (one of {PING|ACK|PINGREQ|NFPING})
-// Bytes 05-06 Sender response port
-// Bytes 07-10 Sender ID Code
-// ---[ Per member (23 bytes, 17 bytes for IPv4)]---
-// Bytes 00    Member status byte
-// Bytes 01-16 Member host IP (01-04 for IPv4)
-// Bytes 17-18 Member host response port (05-06 for IPv4)
-// Bytes 19-22 Member heartbeat (07-10 for IPv4)
-// Bytes 23-38 Gossip source IP (11-14 fit IPv4)
-// Bytes 39-40 Gossip source response port (15-16 for IPv4)
-
-func (m *message) encode() []byte {
-	// Pre-calculate the message size. Each message prefix is 11 bytes.
-	// Each member has a constant size of 9 bytes, plus 2 times the length of
-	// the IP (4 for IPv4, 16 for IPv6).
-	size := 11 + (len(m.members) * (9 + ipLen + ipLen))
-
-	if m.broadcast != nil {
-		size += 8 + ipLen + len(m.broadcast.bytes)
+// Adds a member status update to this message if the message, once encoded,
+// still fits in max bytes. Returns true if it was added.
+func (m *message) tryAddMember(node *Node, status NodeStatus, heartbeat uint32, gossipSource *Node, ipLen int, max int) bool {
+	node.lock.RLock()
+	size := memberEncodedSize(ipLen, node.metaBytes, node.name)
+	node.lock.RUnlock()
+
+	if m.encodedSize(ipLen)+size > max {
+		return false
 	}
 
+	return m.addMember(node, status, heartbeat, gossipSource) == nil
+}
+
+// Encodes the message in its protocol version (see the message layout at the
+// top of this file).
+func (m *message) encode(ipLen int, clusterID uint32) []byte {
+	size := m.encodedSize(ipLen)
+
 	bytes := make([]byte, size, size)
 
 	// An index pointer (start at 4 to accommodate checksum)
 	p := 4
 
-	// Byte 00
-	// Rightmost 2 bits: verb (one of {P|A|F|N})
-	// Leftmost 6 bits: number of members in payload
-	verbByte := byte(len(m.members))
-	verbByte = (verbByte << 2) | byte(m.verb)
-	p += encodeByte(verbByte, bytes, p)
+	// Bytes 04-06 Protocol version, and the versions we support
+	p += encodeByte(m.version, bytes, p)
+	p += encodeByte(ProtocolVersionMin, bytes, p)
+	p += encodeByte(ProtocolVersionMax, bytes, p)
+
+	// Bytes 07-10 Cluster ID
+	p += encodeUint32(clusterID, bytes, p)
 
-	// Bytes 01-02 Sender response port
+	// Byte 11 Verb (one of {PING|ACK|PINGREQ|NFPING|LEAVE|SYNC|SYNCDATA|USER|
+	// QRESP|BSYNC|BACK})
+	p += encodeByte(byte(m.verb), bytes, p)
+
+	// Bytes 12-15 Member and broadcast counts
+	p += encodeUint16(uint16(len(m.members)), bytes, p)
+	p += encodeUint16(uint16(len(m.broadcasts)), bytes, p)
+
+	// Bytes 16-17 Sender response port
 	p += encodeUint16(m.sender.port, bytes, p)
 
-	// Bytes 03-06 ID Code
+	// Bytes 18-21 ID Code
 	p += encodeUint32(m.senderHeartbeat, bytes, p)
 
-	// Each member data requires 23 bytes (11 for IPv4).
+	// Byte 22 and on: Sender name
+	p += encodeName(m.sender.name, bytes, p)
+
+	// Each member data requires 52 bytes (28 for IPv4), plus metadata and
+	// name.
 	for _, member := range m.members {
 		mnode := member.node
 		mstatus := member.status
 		mcode := member.heartbeat
+		mincarnation := member.incarnation
 		snode := member.source
 
 		// Byte p + 00
@@ -162,9 +244,9 @@ func (m *message) encode() []byte {
 		// IPv4: Bytes (p + 01) to (p + 04)
 		// IPv6: Bytes (p + 01) to (p + 16)
 		if ipLen == net.IPv4len {
-			ipb = mnode.ip.To4()
+			ipb = mnode.IP().To4()
 		} else if ipLen == net.IPv6len {
-			ipb = mnode.ip.To16()
+			ipb = mnode.IP().To16()
 		}
 
 		for i := 0; i < ipLen; i++ {
@@ -175,21 +257,26 @@ func (m *message) encode() []byte {
 		// Member host response port
 		// IPv4: Bytes (p + 05) to (p + 06)
 		// IPv6: Bytes (p + 17) to (p + 18)
-		p += encodeUint16(mnode.port, bytes, p)
+		p += encodeUint16(mnode.Port(), bytes, p)
 
 		// Member heartbeat
 		// IPv4: Bytes (p + 07) to (p + 10)
 		// IPv6: Bytes (p + 19) to (p + 22)
 		p += encodeUint32(mcode, bytes, p)
 
+		// Member incarnation
+		// IPv4: Bytes (p + 11) to (p + 14)
+		// IPv6: Bytes (p + 23) to (p + 26)
+		p += encodeUint32(mincarnation, bytes, p)
+
 		if snode != nil {
 			// Gossip source host IP
-			// IPv4: Bytes (p + 11) to (p + 14)
-			// IPv6: Bytes (p + 23) to (p + 39)
+			// IPv4: Bytes (p + 15) to (p + 18)
+			// IPv6: Bytes (p + 27) to (p + 42)
 			if ipLen == net.IPv4len {
-				ipb = snode.ip.To4()
+				ipb = snode.IP().To4()
 			} else if ipLen == net.IPv6len {
-				ipb = snode.ip.To16()
+				ipb = snode.IP().To16()
 			}
 
 			for i := 0; i < ipLen; i++ {
@@ -199,27 +286,63 @@ func (m *message) encode() []byte {
 			p += ipLen
 
 			// Gossip source host response port
-			// IPv4: Bytes (p + 15) to (p + 16)
-			// IPv6: Bytes (p + 40) to (p + 41)
-			p += encodeUint16(snode.port, bytes, p)
+			// IPv4: Bytes (p + 19) to (p + 20)
+			// IPv6: Bytes (p + 43) to (p + 44)
+			p += encodeUint16(snode.Port(), bytes, p)
 		} else {
 			p += ipLen + 2
 		}
+
+		// Member metadata version, length, and metadata
+		p += encodeUint32(member.metaVersion, bytes, p)
+		p += encodeUint16(uint16(len(member.meta)), bytes, p)
+		p += copy(bytes[p:], member.meta)
+
+		// Member name
+		p += encodeName(member.name, bytes, p)
 	}
 
-	if m.broadcast != nil {
-		bbytes := m.broadcast.encode()
-		for i, v := range bbytes {
-			bytes[p+i] = v
-		}
+	for _, broadcast := range m.broadcasts {
+		p += copy(bytes[p:], broadcast.encode(ipLen))
+	}
+
+	if m.verb.hasPayload() {
+		p += encodeUint16(uint16(len(m.payload)), bytes, p)
+		p += copy(bytes[p:], m.payload)
 	}
 
-	checksum := adler32.Checksum(bytes[4:])
-	encodeUint32(checksum, bytes, 0)
+	encodeUint32(checksum(bytes[4:]), bytes, 0)
 
 	return bytes
 }
 
+// Returns the length of this message once encoded.
+func (m *message) encodedSize(ipLen int) int {
+	// Each message prefix is 23 bytes, plus the sender's name.
+	size := 23 + len(m.sender.name)
+
+	for _, member := range m.members {
+		size += memberEncodedSize(ipLen, member.meta, member.name)
+	}
+
+	for _, broadcast := range m.broadcasts {
+		size += broadcast.encodedSize(ipLen)
+	}
+
+	if m.verb.hasPayload() {
+		size += 2 + len(m.payload)
+	}
+
+	return size
+}
+
+// Returns the length of a member update once encoded: a constant size of 20
+// bytes, plus 2 times the length of the IP (4 for IPv4, 16 for IPv6), plus
+// the member's metadata and name.
+func memberEncodedSize(ipLen int, meta []byte, name string) int {
+	return 20 + ipLen + ipLen + len(meta) + len(name)
+}
+
 // If members exist on this message, and that message has the "forward to"
 // status, this function returns it; otherwise it returns nil.
 func (m *message) getForwardTo() *messageMember {
@@ -234,85 +357,172 @@ func (m *message) getForwardTo() *messageMember {
 // If the address:port from the message can't be associated with a known
 // (live) node, then an instance of message.sender will be created from
 // available data but not explicitly added to the known nodes.
-func decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
+func (c *Cluster) decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
 	var err error
 
-	// An index pointer
-	p := 0
+	// An index pointer (start at 4; the checksum is checked once we know
+	// the version)
+	p := 4
+
+	if len(bytes) < 7 {
+		return newMessage(255, nil, 0), errors.New("message too short")
+	}
+
+	// Bytes 04-06 Protocol version, and the versions the sender supports.
+	// They keep their places in every version, so they're read before the
+	// checksum, which other versions may compute differently. Past these, a
+	// message in a version we don't support can't be read.
+	version, p := decodeByte(bytes, p)
+	minVersion, p := decodeByte(bytes, p)
+	maxVersion, p := decodeByte(bytes, p)
+
+	if version < ProtocolVersionMin || version > ProtocolVersionMax {
+		return newMessage(255, nil, 0),
+			&unsupportedVersionError{version: version, min: minVersion, max: maxVersion}
+	}
+
+	// Nothing else can be read unless the whole fixed header (23 bytes) is
+	// there.
+	if len(bytes) < 23 {
+		return newMessage(255, nil, 0), errors.New("message too short")
+	}
 
 	// Bytes 00-03 Checksum (32-bit)
-	checksumStated, p := decodeUint32(bytes, p)
-	checksumCalculated := adler32.Checksum(bytes[4:])
+	checksumStated, _ := decodeUint32(bytes, 0)
+	checksumCalculated := checksum(bytes[4:])
 	if checksumCalculated != checksumStated {
 		return newMessage(255, nil, 0),
-			fmt.Errorf("checksum failure from %s. calculated checksum %d, stated: %d", sourceIP.String(),
-				checksumCalculated, checksumStated)
+			fmt.Errorf("%w from %s. calculated checksum %d, stated: %d", errBadChecksum,
+				sourceIP.String(), checksumCalculated, checksumStated)
 	}
 
-	// Byte 04
-	// Rightmost 2 bits: verb (one of {P|A|F|N})
-	// Leftmost 6 bits: number of members in payload
+	// Bytes 07-10 Cluster ID. Messages from other clusters are dropped
+	// before they can touch our view of the membership.
+	clusterID, p := decodeUint32(bytes, p)
+	if clusterID != c.clusterID() {
+		return newMessage(255, nil, 0), errForeignCluster
+	}
+
+	// Byte 11 Verb (one of {PING|ACK|PINGREQ|NFPING|LEAVE|SYNC|SYNCDATA|USER|
+	// QRESP|BSYNC|BACK})
 	v, p := decodeByte(bytes, p)
-	verb := messageVerb(v & 0x03)
+	verb := messageVerb(v)
 
-	memberCount := int(v >> 2)
+	// Bytes 12-15 Member and broadcast counts
+	memberCount, p := decodeUint16(bytes, p)
+	broadcastCount, p := decodeUint16(bytes, p)
 
-	// Bytes 05-06 Sender response port
+	// Bytes 16-17 Sender response port
 	senderPort, p := decodeUint16(bytes, p)
 
-	// Bytes 07-10 Sender ID Code
+	// Bytes 18-21 Sender ID Code
 	senderHeartbeat, p := decodeUint32(bytes, p)
 
-	// Now that we have the IP and port, we can find the Node.
-	sender := knownNodes.getByIP(sourceIP, senderPort)
-
-	// We don't know this node, so create a new one!
-	if sender == nil {
-		sender, _ = CreateNodeByIP(sourceIP, senderPort)
+	// Byte 22 and on: Sender name
+	senderName, p, err := decodeName(bytes, p)
+	if err != nil {
+		return newMessage(255, nil, 0), err
 	}
 
+	// Now that we have the name, IP and port, we can find the Node. The
+	// sender is the authority on its own address.
+	sender := c.resolveNode(senderName, sourceIP, senderPort, true)
+
+	// Now we know which versions the sender supports.
+	sender.lock.Lock()
+	sender.protocolMin = minVersion
+	sender.protocolMax = maxVersion
+	sender.lock.Unlock()
+
 	// Now that we have the verb, node, and code, we can build the mesage
 	m := newMessage(verb, sender, senderHeartbeat)
+	m.version = version
+
+	if memberCount > 0 {
+		var n int
+
+		m.members, n, err = c.decodeMembers(int(memberCount), bytes[p:])
+		if err != nil {
+			return m, err
+		}
+
+		p += n
+	}
 
-	memberLastIndex := p + (memberCount * (9 + ipLen + ipLen))
+	for i := 0; i < int(broadcastCount); i++ {
+		broadcast, err := c.decodeBroadcast(bytes[p:])
+		if err != nil {
+			return m, err
+		}
 
-	if len(bytes) > p {
-		m.members = decodeMembers(memberCount, bytes[p:memberLastIndex])
+		m.broadcasts = append(m.broadcasts, broadcast)
+		p += broadcast.encodedSize(c.ipLen)
 	}
 
-	if len(bytes) > memberLastIndex {
-		m.broadcast, err = decodeBroadcast(bytes[memberLastIndex:])
+	if verb.hasPayload() {
+		if len(bytes) < p+2 {
+			return m, errors.New("message payload truncated")
+		}
+
+		var length uint16
+		length, p = decodeUint16(bytes, p)
+
+		if len(bytes) < p+int(length) {
+			return m, errors.New("message payload truncated")
+		}
+
+		m.payload = bytes[p : p+int(length)]
 	}
 
-	return m, err
+	return m, nil
 }
 
-func decodeMembers(memberCount int, bytes []byte) []*messageMember {
+// Decodes memberCount members from the start of bytes, and returns them
+// along with the number of bytes that they took up.
+func (c *Cluster) decodeMembers(memberCount int, bytes []byte) ([]*messageMember, int, error) {
 	// Bytes 00    Member status byte
 	// Bytes 01-16 Member host IP (01-04 for IPv4)
 	// Bytes 17-18 Member host response port (05-06 for IPv4)
 	// Bytes 19-22 Member heartbeat (07-10 for IPv4)
+	// Bytes 23-26 Member incarnation (11-14 for IPv4)
+	// Bytes 27-42 Gossip source IP (15-18 for IPv4)
+	// Bytes 43-44 Gossip source response port (19-20 for IPv4)
+	// Bytes 45-48 Member metadata version (21-24 for IPv4)
+	// Bytes 49-50 Member metadata length M (25-26 for IPv4)
+	// Bytes 51-NN Member metadata (27-NN for IPv4)
+	// Byte  NN+1  Member name length N
+	// Bytes NN+2… Member name
 
-	members := make([]*messageMember, 0, 1)
+	members := make([]*messageMember, 0, memberCount)
 
 	// An index pointer
 	p := 0
 
-	for p < len(bytes) {
+	for len(members) < memberCount {
+		if len(bytes)-p < 20+c.ipLen+c.ipLen {
+			return members, p, errors.New("member list truncated")
+		}
+
 		var mstatus NodeStatus
 		var mip net.IP
 		var mport uint16
 		var mcode uint32
+		var mincarnation uint32
 		var mnode *Node
 		var sip net.IP
 		var sport uint16
 		var snode *Node
+		var metaVersion uint32
+		var metaLen uint16
+		var meta []byte
+		var mname string
+		var err error
 
 		// Byte 00 Member status byte
 		mstatus = NodeStatus(bytes[p])
 		p++
 
-		if ipLen == net.IPv6len {
+		if c.ipLen == net.IPv6len {
 			// Bytes 01-16 member IP
 			mip = make(net.IP, net.IPv6len)
 			copy(mip, bytes[p:p+16])
@@ -320,7 +530,7 @@ func decodeMembers(memberCount int, bytes []byte) []*messageMember {
 			// Bytes 01-04 member IPv4
 			mip = net.IPv4(bytes[p+0], bytes[p+1], bytes[p+2], bytes[p+3])
 		}
-		p += ipLen
+		p += c.ipLen
 
 		// Bytes 17-18 member response port
 		mport, p = decodeUint16(bytes, p)
@@ -328,17 +538,10 @@ func decodeMembers(memberCount int, bytes []byte) []*messageMember {
 		// Bytes 19-22 member heartbeat
 		mcode, p = decodeUint32(bytes, p)
 
-		if len(mip) > 0 {
-			// Find the sender by the address associated with the message
-			mnode = knownNodes.getByIP(mip, mport)
-
-			// We still don't know this node, so create a new one!
-			if mnode == nil {
-				mnode, _ = CreateNodeByIP(mip, mport)
-			}
-		}
+		// Bytes 23-26 member incarnation
+		mincarnation, p = decodeUint32(bytes, p)
 
-		if ipLen == net.IPv6len {
+		if c.ipLen == net.IPv6len {
 			// Bytes 01-16 member IP
 			sip = make(net.IP, net.IPv6len)
 			copy(sip, bytes[p:p+16])
@@ -346,14 +549,14 @@ func decodeMembers(memberCount int, bytes []byte) []*messageMember {
 			// Bytes 01-04 member IPv4
 			sip = net.IPv4(bytes[p+0], bytes[p+1], bytes[p+2], bytes[p+3])
 		}
-		p += ipLen
+		p += c.ipLen
 
 		// Bytes 17-18 member response port
 		sport, p = decodeUint16(bytes, p)
 
 		if len(sip) > 0 {
 			// Find the sender by the address associated with the message
-			snode = knownNodes.getByIP(sip, sport)
+			snode = c.getKnownNodeByIP(sip, sport)
 
 			// We still don't know this node, so create a new one!
 			if snode == nil {
@@ -361,15 +564,96 @@ func decodeMembers(memberCount int, bytes []byte) []*messageMember {
 			}
 		}
 
+		// Member metadata version, length, and metadata
+		metaVersion, p = decodeUint32(bytes, p)
+		metaLen, p = decodeUint16(bytes, p)
+
+		if len(bytes)-p < int(metaLen) {
+			return members, p, errors.New("member metadata truncated")
+		}
+
+		if metaLen > 0 {
+			meta = make([]byte, metaLen)
+			p += copy(meta, bytes[p:p+int(metaLen)])
+		}
+
+		// Member name
+		mname, p, err = decodeName(bytes, p)
+		if err != nil {
+			return members, p, err
+		}
+
+		// Find the member by its name or address, or create a new one.
+		mnode = c.resolveNode(mname, mip, mport, false)
+
 		member := messageMember{
-			heartbeat: mcode,
-			node:      mnode,
-			source:    snode,
-			status:    mstatus,
+			heartbeat:   mcode,
+			incarnation: mincarnation,
+			metaVersion: metaVersion,
+			meta:        meta,
+			node:        mnode,
+			name:        mname,
+			source:      snode,
+			status:      mstatus,
 		}
 
 		members = append(members, &member)
 	}
 
-	return members
+	return members, p, nil
+}
+
+// Encodes a node name as its length (1 byte) followed by its bytes.
+func encodeName(name string, bytes []byte, startIndex int) int {
+	p := startIndex + encodeByte(byte(len(name)), bytes, startIndex)
+	p += copy(bytes[p:], name)
+
+	return p - startIndex
+}
+
+// Decodes a node name encoded by encodeName().
+func decodeName(bytes []byte, startIndex int) (string, int, error) {
+	if startIndex >= len(bytes) {
+		return "", startIndex, errors.New("node name truncated")
+	}
+
+	n, p := decodeByte(bytes, startIndex)
+	if p+int(n) > len(bytes) {
+		return "", startIndex, errors.New("node name truncated")
+	}
+
+	return string(bytes[p : p+int(n)]), p + int(n), nil
+}
+
+// checksum returns the CRC-32C checksum of bytes.
+func checksum(bytes []byte) uint32 {
+	return crc32.Checksum(bytes, castagnoliTable)
+}
+
+// maxPacketSize returns the largest packet that may be sent: the transport's
+// limit, if it has one, but never more than the receiver's read buffer.
+func (c *Cluster) maxPacketSize() int {
+	if limited, ok := c.transportImpl.(transport.PacketSizeLimited); ok {
+		if size := limited.MaxPacketSize(); size > 0 && size < ReadBufSize {
+			return size
+		}
+	}
+
+	return ReadBufSize
+}
+
+// maxMessageBytes returns how long an encoded message may be if its packet,
+// once signed and encrypted, is to fit in maxPacketSize().
+func (c *Cluster) maxMessageBytes() int {
+	max := c.maxPacketSize()
+
+	if c.GetKeyring() != nil {
+		max -= encryptionOverhead
+	}
+
+	if c.GetMessageSecret() != "" {
+		max -= signatureSize
+	}
+
+	return max
 }
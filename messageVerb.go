@@ -35,8 +35,43 @@ const (
 	// If the ping times out, the host does not follow up with a ping request
 	// to any other hosts.
 	verbNonForwardingPing
+
+	// VerbLeave announces that the sender is leaving the cluster on purpose.
+	// It is acknowledged like a ping.
+	verbLeave
+
+	// VerbSync starts a push-pull exchange: it carries (the first part of)
+	// the sender's membership table, and asks for the receiver's in return.
+	verbSync
+
+	// VerbSyncData carries (part of) a membership table in a push-pull
+	// exchange, without asking for anything in return.
+	verbSyncData
+
+	// VerbUser carries a payload from a user of the library to this node
+	// alone (see SendTo).
+	verbUser
+
+	// VerbQueryResponse carries a node's acknowledgement of, or response to,
+	// a query (see Query) back to the node that asked it.
+	verbQueryResponse
+
+	// VerbBroadcastSync offers, asks for, or carries broadcasts kept for
+	// nodes that missed them (see reliableBroadcast.go).
+	verbBroadcastSync
+
+	// VerbBroadcastAck acknowledges broadcasts to the node that sent them,
+	// when it asks for that (see broadcastHandle.go).
+	verbBroadcastAck
 )
 
+// hasPayload returns true for the verbs whose messages end with a payload
+// section.
+func (v messageVerb) hasPayload() bool {
+	return v == verbUser || v == verbQueryResponse || v == verbBroadcastSync ||
+		v == verbBroadcastAck
+}
+
 func (v messageVerb) String() string {
 	switch v {
 	case verbPing:
@@ -47,6 +82,20 @@ func (v messageVerb) String() string {
 		return "PINGREQ"
 	case verbNonForwardingPing:
 		return "NFPING"
+	case verbLeave:
+		return "LEAVE"
+	case verbSync:
+		return "SYNC"
+	case verbSyncData:
+		return "SYNCDATA"
+	case verbUser:
+		return "USER"
+	case verbQueryResponse:
+		return "QRESP"
+	case verbBroadcastSync:
+		return "BSYNC"
+	case verbBroadcastAck:
+		return "BACK"
 	default:
 		return "UNDEFINED"
 	}
@@ -84,21 +84,24 @@ func TestEncodeDecodeBasic(t *testing.T) {
 	timestamp := uint32(87878787)
 
 	sender := Node{
-		ip:         net.IP([]byte{127, 0, 0, 1}),
-		port:       1234,
-		timestamp:  timestamp,
-		pingMillis: PingNoData,
+		ip:          net.IP([]byte{127, 0, 0, 1}),
+		port:        1234,
+		timestamp:   timestamp,
+		pingMillis:  PingNoData,
+		protocolMin: ProtocolVersionMin,
+		protocolMax: ProtocolVersionMax,
 	}
 
 	message := message{
+		version:         ProtocolVersionMax,
 		sender:          &sender,
 		senderHeartbeat: 255,
 		verb:            verbPing}
 
 	ip := net.IP([]byte{127, 0, 0, 1})
-	bytes := message.encode()
+	bytes := message.encode(defaultCluster.ipLen, defaultCluster.clusterID())
 
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 
 	if err != nil {
@@ -121,21 +124,24 @@ func TestEncodeDecodeBasicIPv6(t *testing.T) {
 	timestamp := uint32(87878787)
 
 	sender := Node{
-		ip:         net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
-		port:       1234,
-		timestamp:  timestamp,
-		pingMillis: PingNoData,
+		ip:          net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
+		port:        1234,
+		timestamp:   timestamp,
+		pingMillis:  PingNoData,
+		protocolMin: ProtocolVersionMin,
+		protocolMax: ProtocolVersionMax,
 	}
 
 	message := message{
+		version:         ProtocolVersionMax,
 		sender:          &sender,
 		senderHeartbeat: 255,
 		verb:            verbPing}
 
-	ipLen = net.IPv6len // encode IPv6
+	defaultCluster.ipLen = net.IPv6len // encode IPv6
 	ip := net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
-	bytes := message.encode()
-	decoded, err := decodeMessage(ip, bytes)
+	bytes := message.encode(defaultCluster.ipLen, defaultCluster.clusterID())
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 
 	if err != nil {
@@ -151,7 +157,7 @@ func TestEncodeDecodeBasicIPv6(t *testing.T) {
 		t.Log("Output node:", decoded.sender)
 	}
 
-	ipLen = net.IPv4len // reset to IPv4
+	defaultCluster.ipLen = net.IPv4len // reset to IPv4
 }
 
 // Endode and decode a simple message with one member, and see if
@@ -160,10 +166,12 @@ func TestEncodeDecode1Member(t *testing.T) {
 	timestamp := uint32(87878787)
 
 	sender := Node{
-		ip:         net.IP([]byte{127, 0, 0, 1}),
-		port:       1234,
-		timestamp:  timestamp,
-		pingMillis: PingNoData,
+		ip:          net.IP([]byte{127, 0, 0, 1}),
+		port:        1234,
+		timestamp:   timestamp,
+		pingMillis:  PingNoData,
+		protocolMin: ProtocolVersionMin,
+		protocolMax: ProtocolVersionMax,
 	}
 
 	member := Node{
@@ -174,6 +182,7 @@ func TestEncodeDecode1Member(t *testing.T) {
 	}
 
 	message := message{
+		version:         ProtocolVersionMax,
 		sender:          &sender,
 		senderHeartbeat: 255,
 		verb:            verbPing}
@@ -184,13 +193,13 @@ func TestEncodeDecode1Member(t *testing.T) {
 	}
 
 	ip := net.IP([]byte{127, 0, 0, 1})
-	bytes := message.encode()
-	if len(bytes) != 28 {
+	bytes := message.encode(defaultCluster.ipLen, defaultCluster.clusterID())
+	if len(bytes) != 51 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 28 but found: ", len(bytes))
+		t.Log("Should be 51 but found: ", len(bytes))
 	}
 
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 	decoded.members[0].node.timestamp = timestamp
 	decoded.members[0].source.timestamp = timestamp
@@ -223,10 +232,12 @@ func TestEncodeDecode1MemberIPv6(t *testing.T) {
 	timestamp := uint32(87878787)
 
 	sender := Node{
-		ip:         net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
-		port:       1234,
-		timestamp:  timestamp,
-		pingMillis: PingNoData,
+		ip:          net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50},
+		port:        1234,
+		timestamp:   timestamp,
+		pingMillis:  PingNoData,
+		protocolMin: ProtocolVersionMin,
+		protocolMax: ProtocolVersionMax,
 	}
 
 	member := Node{
@@ -237,6 +248,7 @@ func TestEncodeDecode1MemberIPv6(t *testing.T) {
 	}
 
 	message := message{
+		version:         ProtocolVersionMax,
 		sender:          &sender,
 		senderHeartbeat: 255,
 		verb:            verbPing}
@@ -246,15 +258,15 @@ func TestEncodeDecode1MemberIPv6(t *testing.T) {
 		t.Error("No member in the input members list!")
 	}
 
-	ipLen = net.IPv6len // encode for IPv6
+	defaultCluster.ipLen = net.IPv6len // encode for IPv6
 	ip := net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
-	bytes := message.encode()
-	if len(bytes) != 52 {
+	bytes := message.encode(defaultCluster.ipLen, defaultCluster.clusterID())
+	if len(bytes) != 75 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 52 but found: ", len(bytes))
+		t.Log("Should be 75 but found: ", len(bytes))
 	}
 
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 	decoded.members[0].node.timestamp = timestamp
 	decoded.members[0].source.timestamp = timestamp
@@ -278,7 +290,7 @@ func TestEncodeDecode1MemberIPv6(t *testing.T) {
 		t.Log("Output source:", decoded.members[0].source)
 	}
 
-	ipLen = net.IPv4len // reset to IPv4 for next test
+	defaultCluster.ipLen = net.IPv4len // reset to IPv4 for next test
 }
 
 // Endode and decode a simple message with one member and message, and see if
@@ -299,6 +311,7 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 		pingMillis: PingNoData}
 
 	message := message{
+		version:         ProtocolVersionMax,
 		sender:          &sender,
 		senderHeartbeat: 255,
 		verb:            verbPing}
@@ -310,18 +323,18 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 		index:  42}
 	message.addBroadcast(&broadcast)
 
-	if message.broadcast == nil {
+	if len(message.broadcasts) != 1 {
 		t.Error("Broadcast not set properly")
 	}
 
 	ip := net.IP([]byte{127, 0, 0, 1})
-	bytes := message.encode()
-	if len(bytes) != 57 {
+	bytes := message.encode(defaultCluster.ipLen, defaultCluster.clusterID())
+	if len(bytes) != 89 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 57 but found: ", len(bytes))
+		t.Log("Should be 89 but found: ", len(bytes))
 	}
 
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 	decoded.members[0].node.timestamp = timestamp
 	decoded.members[0].source.timestamp = timestamp
@@ -330,17 +343,17 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 		t.Error(err)
 	}
 
-	if decoded.broadcast == nil {
+	if len(decoded.broadcasts) != 1 {
 		t.Error("Broadcast not decoded")
 	}
 
-	message.broadcast.origin = nil
-	decoded.broadcast.origin = nil
+	message.broadcasts[0].origin = nil
+	decoded.broadcasts[0].origin = nil
 
-	if !reflect.DeepEqual(message.broadcast, decoded.broadcast) {
+	if !reflect.DeepEqual(message.broadcasts, decoded.broadcasts) {
 		t.Error("Broadcasts do not match:")
-		t.Error(" Input bcast:", message.broadcast)
-		t.Error("Output bcast:", decoded.broadcast)
+		t.Error(" Input bcast:", message.broadcasts)
+		t.Error("Output bcast:", decoded.broadcasts)
 	}
 }
 
@@ -362,6 +375,7 @@ func TestEncodeDecode1MemberBroadcastIPv6(t *testing.T) {
 		pingMillis: PingNoData}
 
 	message := message{
+		version:         ProtocolVersionMax,
 		sender:          &sender,
 		senderHeartbeat: 255,
 		verb:            verbPing}
@@ -373,19 +387,19 @@ func TestEncodeDecode1MemberBroadcastIPv6(t *testing.T) {
 		index:  42}
 	message.addBroadcast(&broadcast)
 
-	if message.broadcast == nil {
+	if len(message.broadcasts) != 1 {
 		t.Error("Broadcast not set properly")
 	}
 
-	ipLen = net.IPv6len // encode for IPv6
+	defaultCluster.ipLen = net.IPv6len // encode for IPv6
 	ip := net.IP{255, 254, 253, 252, 251, 250, 240, 230, 220, 210, 200, 10, 20, 30, 40, 50}
-	bytes := message.encode()
-	if len(bytes) != 93 {
+	bytes := message.encode(defaultCluster.ipLen, defaultCluster.clusterID())
+	if len(bytes) != 125 {
 		t.Error("Encoded message length is invalid.")
-		t.Log("Should be 93 but found: ", len(bytes))
+		t.Log("Should be 125 but found: ", len(bytes))
 	}
 
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 	decoded.members[0].node.timestamp = timestamp
 	decoded.members[0].source.timestamp = timestamp
@@ -394,18 +408,128 @@ func TestEncodeDecode1MemberBroadcastIPv6(t *testing.T) {
 		t.Error(err)
 	}
 
-	if decoded.broadcast == nil {
+	if len(decoded.broadcasts) != 1 {
 		t.Error("Broadcast not decoded")
 	}
 
-	message.broadcast.origin = nil
-	decoded.broadcast.origin = nil
+	message.broadcasts[0].origin = nil
+	decoded.broadcasts[0].origin = nil
 
-	if !reflect.DeepEqual(message.broadcast, decoded.broadcast) {
+	if !reflect.DeepEqual(message.broadcasts, decoded.broadcasts) {
 		t.Error("Broadcasts do not match:")
-		t.Error(" Input bcast:", message.broadcast)
-		t.Error("Output bcast:", decoded.broadcast)
+		t.Error(" Input bcast:", message.broadcasts)
+		t.Error("Output bcast:", decoded.broadcasts)
+	}
+
+	defaultCluster.ipLen = net.IPv4len
+}
+
+func TestMessagePacking(t *testing.T) {
+	sender := &Node{ip: net.IPv4(10, 0, 22, 1), port: 9999, name: "sender"}
+	msg := newMessage(verbPing, sender, 1)
+
+	max := 200
+
+	added := 0
+	for i := 0; i < 100; i++ {
+		n := &Node{ip: net.IPv4(10, 0, 22, byte(i)), port: 9999, name: "member"}
+		if !msg.tryAddMember(n, StatusAlive, 1, sender, net.IPv4len, max) {
+			break
+		}
+		added++
 	}
 
-	ipLen = net.IPv4len
+	if added == 0 || added == 100 {
+		t.Errorf("Expected some but not all members to fit, but %d did", added)
+	}
+
+	if size := len(msg.encode(net.IPv4len, 0)); size > max {
+		t.Errorf("Encoded message is %d bytes, more than %d", size, max)
+	}
+
+	// A broadcast that doesn't fit isn't added.
+	big := &Broadcast{origin: sender, bytes: make([]byte, max)}
+	if msg.tryAddBroadcast(big, net.IPv4len, max) {
+		t.Error("Broadcast added past the maximum size")
+	}
+
+	// With room to spare, many broadcasts ride on one message.
+	msg = newMessage(verbPing, sender, 1)
+	for i := 0; i < 10; i++ {
+		bc := &Broadcast{origin: sender, index: uint32(i), bytes: []byte("hello")}
+		if !msg.tryAddBroadcast(bc, net.IPv4len, ReadBufSize) {
+			t.Fatal("Broadcast not added")
+		}
+	}
+
+	c := NewCluster()
+	c.SetClusterName(defaultCluster.GetClusterName())
+	decoded, err := c.decodeMessage(sender.ip, msg.encode(c.ipLen, c.clusterID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.broadcasts) != 10 {
+		t.Errorf("Expected 10 broadcasts, found %d", len(decoded.broadcasts))
+	}
+
+	for i, bc := range decoded.broadcasts {
+		if bc.index != uint32(i) || string(bc.bytes) != "hello" {
+			t.Errorf("Broadcast %d decoded as %d=%q", i, bc.index, bc.bytes)
+		}
+	}
+}
+
+// Encode and decode a USER message, and see if its payload survives.
+func TestEncodeDecodeUserMessage(t *testing.T) {
+	sender := &Node{ip: net.IPv4(10, 0, 22, 1), port: 9999, name: "sender"}
+	msg := newMessage(verbUser, sender, 1)
+	msg.payload = []byte("hello, node")
+	msg.addMember(sender, StatusAlive, 1, sender)
+
+	c := NewCluster()
+	c.SetClusterName(defaultCluster.GetClusterName())
+
+	bytes := msg.encode(c.ipLen, c.clusterID())
+	if len(bytes) != msg.encodedSize(c.ipLen) {
+		t.Errorf("Encoded %d bytes, expected %d", len(bytes), msg.encodedSize(c.ipLen))
+	}
+
+	decoded, err := c.decodeMessage(sender.ip, bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.verb != verbUser || string(decoded.payload) != "hello, node" {
+		t.Errorf("Decoded %v with payload %q", decoded.verb, decoded.payload)
+	}
+
+	if len(decoded.members) != 1 {
+		t.Errorf("Expected 1 member, found %d", len(decoded.members))
+	}
+
+	// A truncated payload is an error.
+	if _, err := c.decodeMessage(sender.ip, bytes[:len(bytes)-1]); err == nil {
+		t.Error("Expected an error decoding a truncated payload")
+	}
+}
+
+func TestDecodeShortMessage(t *testing.T) {
+	sender, _ := CreateNodeByIP(net.IPv4(127, 0, 0, 1), 1234)
+	sender.name = "sender"
+
+	c := NewCluster()
+	msg := newMessage(verbPing, sender, 1)
+	bytes := msg.encode(c.ipLen, c.clusterID())
+
+	// Packets too short for the fixed header are errors, even with a valid
+	// checksum.
+	for n := 7; n < 23; n++ {
+		short := append([]byte(nil), bytes[:n]...)
+		encodeUint32(checksum(short[4:]), short, 0)
+
+		if _, err := c.decodeMessage(sender.ip, short); err == nil {
+			t.Errorf("Expected an error decoding a %d byte message", n)
+		}
+	}
 }
@@ -0,0 +1,229 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxMetaBytes is the largest that a node's metadata may be once encoded.
+// The metadata travels with every mention of the node in a message, so it
+// needs to stay small. Each key and value is encoded as its length (1 byte)
+// followed by its bytes.
+const MaxMetaBytes = 256
+
+// Metadata encoding
+// Byte  0      - Number of entries N
+// Then, for each of the N entries, sorted by key:
+// Byte  0      - Key length K
+// Bytes 1 to K - Key bytes
+// Byte  K+1    - Value length V
+// Bytes K+2... - Value bytes
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// SetLocalMeta sets the metadata of this node: a small set of key/value pairs
+// (role, zone, version, and so on) that is gossiped to the rest of the
+// cluster along with the node's status. Each call replaces the previous
+// metadata with a newer version. An error is returned if the metadata is
+// too large to be encoded; see MaxMetaBytes.
+func (c *Cluster) SetLocalMeta(meta map[string]string) error {
+	metaBytes, err := encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	c.localMeta.Lock()
+	defer c.localMeta.Unlock()
+
+	// The version is time based, so that the metadata of a restarted node
+	// still replaces what the others remember from its previous run.
+	version := uint32(time.Now().Unix())
+	if version <= c.localMeta.version {
+		version = c.localMeta.version + 1
+	}
+
+	c.localMeta.meta = copyMeta(meta)
+	c.localMeta.bytes = metaBytes
+	c.localMeta.version = version
+
+	if host := c.ThisHost(); host != nil {
+		c.applyLocalMeta(host)
+	}
+
+	return nil
+}
+
+// Meta returns a copy of this node's metadata, as last heard. It is empty if
+// the node has none.
+func (n *Node) Meta() map[string]string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return copyMeta(n.meta)
+}
+
+// MetaVersion returns the version of this node's metadata, as last heard. A
+// node's metadata is replaced only by a higher version.
+func (n *Node) MetaVersion() uint32 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.metaVersion
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// applyLocalMeta copies the local metadata onto host, which is thisHost. The
+// caller must hold c.localMeta.
+func (c *Cluster) applyLocalMeta(host *Node) {
+	host.lock.Lock()
+	host.meta = c.localMeta.meta
+	host.metaBytes = c.localMeta.bytes
+	host.metaVersion = c.localMeta.version
+	host.lock.Unlock()
+}
+
+// updateNodeMeta replaces the metadata of node if the given version is newer
+// than the one we know, and notifies the meta listeners.
+func (c *Cluster) updateNodeMeta(node *Node, version uint32, metaBytes []byte) {
+	if version <= node.MetaVersion() {
+		return
+	}
+
+	meta, err := decodeMeta(metaBytes)
+	if err != nil {
+		logfError("Invalid metadata for %s: %v", node.Address(), err)
+		return
+	}
+
+	// Checked again under the lock, in case a newer version arrived while
+	// this one was being decoded.
+	node.lock.Lock()
+	if version <= node.metaVersion {
+		node.lock.Unlock()
+		return
+	}
+
+	node.meta = meta
+	node.metaBytes = metaBytes
+	node.metaVersion = version
+	node.lock.Unlock()
+
+	logfDebug("Updating metadata of %s to version %d", node.Address(), version)
+
+	c.doMetaUpdate(node, copyMeta(meta))
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	cp := make(map[string]string, len(meta))
+
+	for k, v := range meta {
+		cp[k] = v
+	}
+
+	return cp
+}
+
+func encodeMeta(meta map[string]string) ([]byte, error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+
+	if len(meta) > 0xFF {
+		return nil, fmt.Errorf("too many metadata entries: %d (max 255)", len(meta))
+	}
+
+	keys := make([]string, 0, len(meta))
+	size := 1
+
+	for k, v := range meta {
+		if k == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		if len(k) > 0xFF || len(v) > 0xFF {
+			return nil, fmt.Errorf("metadata entry %q too long (max 255 bytes per key and value)", k)
+		}
+
+		keys = append(keys, k)
+		size += 2 + len(k) + len(v)
+	}
+
+	if size > MaxMetaBytes {
+		return nil, fmt.Errorf("metadata too large: %d bytes (max %d)", size, MaxMetaBytes)
+	}
+
+	sort.Strings(keys)
+
+	bytes := make([]byte, size)
+	p := encodeByte(byte(len(keys)), bytes, 0)
+
+	for _, k := range keys {
+		v := meta[k]
+
+		p += encodeByte(byte(len(k)), bytes, p)
+		p += copy(bytes[p:], k)
+		p += encodeByte(byte(len(v)), bytes, p)
+		p += copy(bytes[p:], v)
+	}
+
+	return bytes, nil
+}
+
+func decodeMeta(bytes []byte) (map[string]string, error) {
+	meta := make(map[string]string)
+
+	if len(bytes) == 0 {
+		return meta, nil
+	}
+
+	count, p := decodeByte(bytes, 0)
+
+	for i := 0; i < int(count); i++ {
+		if p >= len(bytes) {
+			return nil, errors.New("metadata truncated")
+		}
+
+		var klen, vlen byte
+
+		klen, p = decodeByte(bytes, p)
+		if p+int(klen) >= len(bytes) {
+			return nil, errors.New("metadata truncated")
+		}
+
+		key := string(bytes[p : p+int(klen)])
+		p += int(klen)
+
+		vlen, p = decodeByte(bytes, p)
+		if p+int(vlen) > len(bytes) {
+			return nil, errors.New("metadata truncated")
+		}
+
+		meta[key] = string(bytes[p : p+int(vlen)])
+		p += int(vlen)
+	}
+
+	return meta, nil
+}
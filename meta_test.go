@@ -0,0 +1,114 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeMeta(t *testing.T) {
+	meta := map[string]string{"role": "db", "zone": "eu-west-1a", "empty": ""}
+
+	bytes, err := encodeMeta(meta)
+	require.NoError(t, err)
+
+	decoded, err := decodeMeta(bytes)
+	require.NoError(t, err)
+	require.Equal(t, meta, decoded)
+
+	// The encoding doesn't depend on map ordering.
+	again, err := encodeMeta(decoded)
+	require.NoError(t, err)
+	require.Equal(t, bytes, again)
+
+	_, err = decodeMeta(bytes[:len(bytes)-3])
+	require.Error(t, err)
+}
+
+func TestEncodeMetaLimits(t *testing.T) {
+	_, err := encodeMeta(map[string]string{"": "x"})
+	require.Error(t, err)
+
+	_, err = encodeMeta(map[string]string{"k": strings.Repeat("x", 256)})
+	require.Error(t, err)
+
+	_, err = encodeMeta(map[string]string{
+		"a": strings.Repeat("x", 200),
+		"b": strings.Repeat("x", 200),
+	})
+	require.Error(t, err)
+
+	bytes, err := encodeMeta(nil)
+	require.NoError(t, err)
+	require.Nil(t, bytes)
+}
+
+func TestEncodeDecodeMemberMeta(t *testing.T) {
+	sender := Node{ip: net.IP([]byte{127, 0, 0, 1}), port: 1234}
+	member := Node{ip: net.IP([]byte{127, 0, 0, 2}), port: 9000, metaVersion: 7}
+
+	var err error
+	member.metaBytes, err = encodeMeta(map[string]string{"role": "db"})
+	require.NoError(t, err)
+
+	msg := newMessage(verbPing, &sender, 1)
+	msg.addMember(&member, StatusAlive, 2, &member)
+	msg.addMember(&sender, StatusAlive, 3, &sender)
+
+	c := NewCluster()
+	decoded, err := c.decodeMessage(sender.ip, msg.encode(c.ipLen, c.clusterID()))
+	require.NoError(t, err)
+	require.Len(t, decoded.members, 2)
+
+	require.Equal(t, uint32(7), decoded.members[0].metaVersion)
+	require.Equal(t, member.metaBytes, decoded.members[0].meta)
+	require.Equal(t, uint32(0), decoded.members[1].metaVersion)
+	require.Nil(t, decoded.members[1].meta)
+}
+
+type collectingMetaListener struct {
+	seen []map[string]string
+}
+
+func (l *collectingMetaListener) OnMetaChange(node *Node, meta map[string]string) {
+	l.seen = append(l.seen, meta)
+}
+
+func TestUpdateNodeMetaVersions(t *testing.T) {
+	c := NewCluster()
+	listener := &collectingMetaListener{}
+	c.AddMetaListener(listener)
+
+	node, err := CreateNodeByIP(net.IPv4(10, 0, 6, 1), 9999)
+	require.NoError(t, err)
+
+	v1, _ := encodeMeta(map[string]string{"version": "1"})
+	v2, _ := encodeMeta(map[string]string{"version": "2"})
+
+	c.updateNodeMeta(node, 2, v2)
+	require.Equal(t, map[string]string{"version": "2"}, node.Meta())
+
+	// Older and repeated versions are ignored.
+	c.updateNodeMeta(node, 1, v1)
+	c.updateNodeMeta(node, 2, v2)
+	require.Equal(t, map[string]string{"version": "2"}, node.Meta())
+	require.Len(t, listener.seen, 1)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A named broadcast carries the latest value of something, such as a feature
+// flag. Of the broadcasts of the same name from the same origin, only the
+// latest (the one with the highest index in the latest epoch) counts: every
+// node passes it to its listeners unless it has already seen a newer one,
+// and stops gossiping (and keeping) the older ones as soon as it sees a
+// newer one.
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// BroadcastNamed emits bytes as the latest value of the broadcast called
+// name. It supersedes any earlier broadcast of the same name from this node:
+// those stop being gossiped, here and on every node that receives this one,
+// and listeners aren't passed them once they've been passed a newer one. The
+// name (1 to 255 bytes) and bytes must fit in a single broadcast, as named
+// broadcasts aren't fragmented. The returned handle tells when the broadcast
+// has been spread (see BroadcastHandle).
+func (c *Cluster) BroadcastNamed(name string, bytes []byte) (*BroadcastHandle, error) {
+	if name == "" || len(name) > 0xFF {
+		return nil, errors.New("broadcast name must be 1 to 255 bytes long")
+	}
+
+	if 1+len(name)+len(bytes) > c.GetMaxBroadcastBytes() {
+		return nil, fmt.Errorf("named broadcast length exceeds %d bytes", c.GetMaxBroadcastBytes())
+	}
+
+	handle := c.newBroadcastHandle()
+
+	bcast := &Broadcast{
+		bytes:  bytes,
+		kind:   broadcastNamed,
+		name:   name,
+		handle: handle}
+
+	c.enqueueBroadcast(bcast)
+	c.supersede(bcast)
+
+	handle.start()
+
+	return handle, nil
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// namedBroadcastKey identifies the broadcasts that supersede one another:
+// those of the same name from the same origin, which is known by its name
+// (so that it's the same after moving to another address), or by its
+// address until its name is known.
+func namedBroadcastKey(broadcast *Broadcast) string {
+	return broadcast.origin.key() + "/" + broadcast.name
+}
+
+// receiveNamedBroadcast passes a named broadcast to the broadcast listeners,
+// unless a newer one of the same name has been seen already.
+func (c *Cluster) receiveNamedBroadcast(broadcast *Broadcast) {
+	if !c.supersede(broadcast) {
+		logfDebug("Broadcast [%s] (%s) is stale", broadcast.Label(), broadcast.Name())
+
+		c.silenceBroadcast(broadcast)
+		return
+	}
+
+	logfInfo("Broadcast [%s] %s=%s",
+		broadcast.Label(),
+		broadcast.Name(),
+		string(broadcast.Bytes()))
+
+	c.doBroadcastUpdate(broadcast)
+}
+
+// supersede records broadcast as the latest of its name, and silences the
+// one it replaces, unless a newer one has been recorded already. It returns
+// true if broadcast is the latest.
+func (c *Cluster) supersede(broadcast *Broadcast) bool {
+	key := namedBroadcastKey(broadcast)
+
+	c.named.Lock()
+	defer c.named.Unlock()
+
+	latest, ok := c.named.m[key]
+	if ok && !newerBroadcast(broadcast, latest) {
+		return false
+	}
+
+	c.named.m[key] = broadcast
+
+	if ok {
+		c.silenceBroadcast(latest)
+	}
+
+	return true
+}
+
+// newerBroadcast returns true if a was sent after b, by the same origin.
+func newerBroadcast(a, b *Broadcast) bool {
+	if a.epoch != b.epoch {
+		return a.epoch > b.epoch
+	}
+
+	return a.index > b.index
+}
+
+// silenceBroadcast stops a broadcast from being gossiped, or offered to
+// nodes that missed it. It is still remembered for a while, so that it's
+// known when received again.
+func (c *Cluster) silenceBroadcast(broadcast *Broadcast) {
+	c.broadcasts.Lock()
+	if broadcast.emitCounter > 0 {
+		broadcast.emitCounter = 0
+	}
+	c.broadcasts.Unlock()
+
+	c.retained.Lock()
+	delete(c.retained.m, broadcast.Label())
+	c.retained.Unlock()
+}
+
+// pruneNamedBroadcasts forgets the latest broadcasts of each name once they
+// are neither gossiped nor kept anymore.
+func (c *Cluster) pruneNamedBroadcasts() {
+	c.named.Lock()
+	defer c.named.Unlock()
+
+	for key, broadcast := range c.named.m {
+		label := broadcast.Label()
+
+		c.broadcasts.RLock()
+		_, gossiped := c.broadcasts.m[label]
+		c.broadcasts.RUnlock()
+
+		if !gossiped && !c.isRetained(label) {
+			delete(c.named.m, key)
+		}
+	}
+}
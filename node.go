@@ -19,6 +19,7 @@ package smudge
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -34,6 +35,11 @@ const (
 
 // Node represents a single node in the cluster and its status
 type Node struct {
+	// Guards the fields below, which change as we hear about the node, while
+	// other goroutines read them.
+	lock sync.RWMutex
+
+	name         string
 	ip           net.IP
 	port         uint16
 	timestamp    uint32
@@ -42,13 +48,30 @@ type Node struct {
 	status       NodeStatus
 	emitCounter  int8
 	heartbeat    uint32
+	incarnation  uint32
 	statusSource *Node
+	meta         map[string]string
+	metaBytes    []byte
+	metaVersion  uint32
+	protocolMin  uint8
+	protocolMax  uint8
 }
 
 // Address rReturns the address for this node in string format, which is simply
-// the node's local IP and listen port. This is used as a unique identifier
-// throughout the code base.
+// the node's local IP and listen port. A node's address may change over time;
+// it is identified by its name (see Name()).
 func (n *Node) Address() string {
+	n.lock.RLock()
+	address := n.address
+	n.lock.RUnlock()
+
+	if address != "" {
+		return address
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
 	if n.address == "" {
 		n.address = nodeAddressString(n.ip, n.port)
 	}
@@ -56,19 +79,55 @@ func (n *Node) Address() string {
 	return n.address
 }
 
+// Name returns the name of this node, which identifies it in the cluster
+// regardless of its address. It is empty until we've heard from (or about)
+// the node.
+func (n *Node) Name() string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.name
+}
+
+// key returns the key that identifies this node in a nodeMap: its name if we
+// know it, and otherwise its address.
+func (n *Node) key() string {
+	if name := n.Name(); name != "" {
+		return name
+	}
+
+	return n.Address()
+}
+
 // Age returns the time since we last heard from this node, in milliseconds.
 func (n *Node) Age() uint32 {
-	return GetNowInMillis() - n.timestamp
+	return GetNowInMillis() - n.Timestamp()
 }
 
 // EmitCounter returns the number of times remaining that current status
 // will be emitted by this node to other nodes.
 func (n *Node) EmitCounter() int8 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.emitCounter
 }
 
+// Incarnation returns the last known incarnation number of this node. A node
+// increases its own incarnation number to refute rumors of its death; higher
+// incarnation numbers override anything said about lower ones.
+func (n *Node) Incarnation() uint32 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.incarnation
+}
+
 // IP returns the IP associated with this node.
 func (n *Node) IP() net.IP {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.ip
 }
 
@@ -77,34 +136,95 @@ func (n *Node) IP() net.IP {
 // pinged, this vaue will be PingNoData (-1). If this node's last PING timed
 // out, this value will be PingTimedOut (-2).
 func (n *Node) PingMillis() int {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.pingMillis
 }
 
 // Port returns the port associated with this node.
 func (n *Node) Port() uint16 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.port
 }
 
 // Status returns this node's current status.
 func (n *Node) Status() NodeStatus {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.status
 }
 
 // StatusSource returns a pointer to the node that originally stated this
 // node's Status; the source of the gossip.
 func (n *Node) StatusSource() *Node {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.statusSource
 }
 
 // Timestamp returns the timestamp of this node's last ping or status update,
 // in milliseconds from the epoch
 func (n *Node) Timestamp() uint32 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
 	return n.timestamp
 }
 
 // Touch updates the timestamp to the local time in milliseconds.
 func (n *Node) Touch() {
+	n.lock.Lock()
 	n.timestamp = GetNowInMillis()
+	n.lock.Unlock()
+}
+
+// gossip returns the status of this node to gossip, with the heartbeat it
+// applies to and the node that it came from.
+func (n *Node) gossip() (NodeStatus, uint32, *Node) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.status, n.heartbeat, n.statusSource
+}
+
+// lastHeartbeat returns the heartbeat of this node's last known status.
+func (n *Node) lastHeartbeat() uint32 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.heartbeat
+}
+
+// emitted lowers the emit counter of this node's status, once it has been
+// gossiped.
+func (n *Node) emitted() {
+	n.lock.Lock()
+	n.emitCounter--
+	n.lock.Unlock()
+}
+
+// setPingMillis records the time the last PING to this node took, or
+// PingTimedOut.
+func (n *Node) setPingMillis(millis int) {
+	n.lock.Lock()
+	n.pingMillis = millis
+	n.lock.Unlock()
+}
+
+// containsNode returns true if nodes includes the same node as node.
+func containsNode(nodes []*Node, node *Node) bool {
+	for _, n := range nodes {
+		if n.key() == node.key() {
+			return true
+		}
+	}
+
+	return false
 }
 
 func nodeAddressString(ip net.IP, port uint16) string {
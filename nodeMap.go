@@ -22,47 +22,60 @@ import (
 	"sync"
 )
 
+// nodeMap is a set of nodes, keyed by their names (or their addresses, for
+// nodes whose names we don't know yet). Nodes can also be looked up by
+// address.
 type nodeMap struct {
 	sync.RWMutex
 
 	nodes map[string]*Node
+
+	addresses map[string]*Node
 }
 
 func (m *nodeMap) init() {
 	m.nodes = make(map[string]*Node)
+	m.addresses = make(map[string]*Node)
 }
 
 // Adds a node. Returns key, value.
 // Updates node heartbeat in the process.
 // This is the method called by all Add* functions.
 func (m *nodeMap) add(node *Node) (string, *Node, error) {
-	key := node.Address()
+	key := node.key()
 
 	m.Lock()
-	m.nodes[node.Address()] = node
+	m.nodes[key] = node
+	m.addresses[node.Address()] = node
 	m.Unlock()
 
 	return key, node, nil
 }
 
 func (m *nodeMap) delete(node *Node) (string, *Node, error) {
+	key := node.key()
+
 	m.Lock()
 
-	delete(m.nodes, node.Address())
+	delete(m.nodes, key)
+
+	if m.addresses[node.Address()] == node {
+		delete(m.addresses, node.Address())
+	}
 
 	m.Unlock()
 
-	return node.Address(), node, nil
+	return key, node, nil
 }
 
 func (m *nodeMap) contains(node *Node) bool {
-	return m.containsByAddress(node.Address())
+	return m.containsByKey(node.key())
 }
 
-func (m *nodeMap) containsByAddress(address string) bool {
+func (m *nodeMap) containsByKey(key string) bool {
 	m.RLock()
 
-	_, ok := m.nodes[address]
+	_, ok := m.nodes[key]
 
 	m.RUnlock()
 
@@ -70,21 +83,26 @@ func (m *nodeMap) containsByAddress(address string) bool {
 }
 
 // Returns a pointer to the requested Node
+func (m *nodeMap) getByKey(key string) *Node {
+	m.RLock()
+	node := m.nodes[key]
+	m.RUnlock()
+
+	return node
+}
+
+// Returns a pointer to the Node at the given address, if any.
 func (m *nodeMap) getByAddress(address string) *Node {
 	m.RLock()
-	node, _ := m.nodes[address]
+	node := m.addresses[address]
 	m.RUnlock()
 
 	return node
 }
 
-// Returns a pointer to the requested Node. If port is 0, is uses the value
-// of GetListenPort(). If the Node cannot be found, this returns nil.
+// Returns a pointer to the requested Node. If the Node cannot be found, this
+// returns nil.
 func (m *nodeMap) getByIP(ip net.IP, port uint16) *Node {
-	if port == 0 {
-		port = uint16(GetListenPort())
-	}
-
 	address := nodeAddressString(ip, port)
 
 	return m.getByAddress(address)
@@ -116,7 +134,7 @@ Outer:
 	for _, n := range allNodes {
 		// Is the node in the excluded list?
 		for _, e := range exclude {
-			if n.Address() == e.Address() {
+			if n.key() == e.key() {
 				continue Outer
 			}
 		}
@@ -134,6 +152,9 @@ Outer:
 }
 
 func (m *nodeMap) length() int {
+	m.RLock()
+	defer m.RUnlock()
+
 	return len(m.nodes)
 }
 
@@ -142,7 +163,7 @@ func (m *nodeMap) lengthWithStatus(status NodeStatus) int {
 
 	i := 0
 	for _, v := range m.nodes {
-		if v.status == status {
+		if v.Status() == status {
 			i++
 		}
 	}
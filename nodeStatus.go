@@ -35,6 +35,10 @@ const (
 	// StatusForwardTo is a pseudo status used by message to indicate
 	// the target of a ping request.
 	StatusForwardTo
+
+	// StatusLeft indicates that a node has left the cluster on purpose, as
+	// opposed to having failed.
+	StatusLeft
 )
 
 func (s NodeStatus) String() string {
@@ -49,6 +53,8 @@ func (s NodeStatus) String() string {
 		return "SUSPECTED"
 	case StatusForwardTo:
 		return "FORWARD_TO"
+	case StatusLeft:
+		return "LEFT"
 	default:
 		return "UNDEFINED"
 	}
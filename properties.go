@@ -17,12 +17,15 @@ limitations under the License.
 package smudge
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Provides a series of methods and constants that revolve around the getting
@@ -31,13 +34,12 @@ import (
 
 const (
 	// EnvVarClusterName is the name of the environment variable the defines
-	// the name of the cluster. Multicast messages from differently-named
-	// instances are ignored.
+	// the name of the cluster. Messages (multicast or not) from
+	// differently-named instances are ignored.
 	EnvVarClusterName = "SMUDGE_CLUSTER_NAME"
 
-	// DefaultClusterName is the default name of the cluster for the purposes
-	// of multicast announcements: multicast messages from differently-named
-	// instances are ignored.
+	// DefaultClusterName is the default name of the cluster. Messages
+	// (multicast or not) from differently-named instances are ignored.
 	DefaultClusterName string = "smudge"
 
 	// EnvVarHeartbeatMillis is the name of the environment variable that
@@ -137,259 +139,603 @@ const (
 	// times (in milliseconds). This prevents the system instability and
 	// flapping that can come from consistently small values.
 	DefaultMinPingTime = 150
+
+	// EnvVarNodeName is the name of the environment variable that defines
+	// the name of this node. The name identifies the node in the cluster,
+	// whatever its address, and must be unique. It may be up to 255 bytes.
+	EnvVarNodeName = "SMUDGE_NODE_NAME"
+
+	// DefaultNodeName is the default node name. Empty string indicates a
+	// generated name (see SMUDGE_NODE_NAME_FILE).
+	DefaultNodeName string = ""
+
+	// EnvVarNodeNameFile is the name of the environment variable that
+	// defines the file that a generated node name is kept in, so that the
+	// node keeps its name across restarts. If the file doesn't exist, it is
+	// created.
+	EnvVarNodeNameFile = "SMUDGE_NODE_NAME_FILE"
+
+	// DefaultNodeNameFile is the default node name file. Empty string
+	// indicates that a generated node name isn't kept.
+	DefaultNodeNameFile string = ""
+
+	// EnvVarPushPullIntervalMillis is the name of the environment variable
+	// that defines the interval (in milliseconds) between full state
+	// exchanges with a random node. A negative value disables them, except
+	// on joining.
+	EnvVarPushPullIntervalMillis = "SMUDGE_PUSH_PULL_INTERVAL_MILLIS"
+
+	// DefaultPushPullIntervalMillis is the default interval (in milliseconds)
+	// between full state exchanges with a random node.
+	DefaultPushPullIntervalMillis int = 30000
+
+	// EnvVarBroadcastRetentionMillis is the name of the environment variable
+	// that defines how long (in milliseconds) broadcasts are kept, so that
+	// nodes that missed them can catch up. 0 disables reliable broadcasts.
+	EnvVarBroadcastRetentionMillis = "SMUDGE_BROADCAST_RETENTION_MILLIS"
+
+	// DefaultBroadcastRetentionMillis is the default broadcast retention (in
+	// milliseconds). 0 indicates that broadcasts aren't kept.
+	DefaultBroadcastRetentionMillis int = 0
+
+	// EnvVarBroadcastAckPercent is the name of the environment variable that
+	// defines the percentage of the other healthy nodes that must acknowledge
+	// a broadcast before its handle is done. 0 disables acknowledgements.
+	EnvVarBroadcastAckPercent = "SMUDGE_BROADCAST_ACK_PERCENT"
+
+	// DefaultBroadcastAckPercent is the default broadcast acknowledgement
+	// percentage. 0 indicates that a broadcast handle is done once the
+	// broadcast has been emitted as many times as it's meant to be.
+	DefaultBroadcastAckPercent int = 0
+
+	// EnvVarGossipKey is the name of the environment variable that defines
+	// the base64-encoded AES key (16, 24 or 32 bytes) that gossip is
+	// encrypted with, if no keyring has been set.
+	EnvVarGossipKey = "SMUDGE_GOSSIP_KEY"
+
+	// DefaultGossipKey is the default gossip key. Empty string indicates
+	// that gossip isn't encrypted.
+	DefaultGossipKey string = ""
+
+	// EnvVarMessageSecret is the name of the environment variable that
+	// defines the secret, shared by all nodes of the cluster, that every
+	// message is signed with (HMAC-SHA256).
+	EnvVarMessageSecret = "SMUDGE_MESSAGE_SECRET"
+
+	// DefaultMessageSecret is the default message secret. Empty string
+	// indicates that messages aren't signed.
+	DefaultMessageSecret string = ""
 )
 
-var clusterName string
+const stringListDelimitRegex = "\\s*((,\\s*)|(\\s+))"
+
+// properties holds the configuration of a Cluster. Zero values mean "unset":
+// the corresponding getter falls back to the environment variable, and then
+// to the default.
+type properties struct {
+	// Guards the properties, which getters resolve lazily and which are read
+	// from every goroutine of a running node.
+	lock sync.Mutex
 
-var heartbeatMillis int
+	clusterName string
 
-var listenPort int
+	heartbeatMillis int
 
-var listenIP net.IP
+	listenPort int
 
-var initialHosts []string
+	listenIP net.IP
 
-var maxBroadcastBytes int
+	initialHosts []string
 
-var minPingTime int
+	maxBroadcastBytes int
 
-var multicastEnabledString string
+	minPingTime int
 
-var multicastEnabled = true
+	multicastEnabledString string
 
-var multicastAnnounceIntervalSeconds = 10
+	multicastEnabled bool
 
-var multicastPort int
+	multicastAnnounceIntervalSeconds int
 
-var multicastAddress string
+	multicastPort int
 
-var pingHistoryFrontload int
+	multicastAddress string
 
-const stringListDelimitRegex = "\\s*((,\\s*)|(\\s+))"
+	pingHistoryFrontload int
+
+	nodeName string
+
+	nodeNameFile string
+
+	pushPullIntervalMillis int
+
+	broadcastRetentionMillis int
 
-// GetClusterName gets the name of the cluster for the purposes of
-// multicast announcements: multicast messages from differently-named
-// instances are ignored.
-func GetClusterName() string {
-	if clusterName == "" {
-		clusterName = getStringVar(EnvVarClusterName, DefaultClusterName)
+	broadcastAckPercent int
+
+	messageSecret string
+}
+
+func newProperties() properties {
+	return properties{
+		multicastEnabled:                 true,
+		multicastAnnounceIntervalSeconds: 10,
+	}
+}
+
+// GetClusterName gets the name of the cluster. Messages (multicast or not)
+// from differently-named instances are ignored.
+func (c *Cluster) GetClusterName() string {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.clusterName == "" {
+		c.clusterName = getStringVar(EnvVarClusterName, DefaultClusterName)
 	}
 
-	return clusterName
+	return c.clusterName
 }
 
 // GetHeartbeatMillis gets this host's heartbeat frequency in milliseconds.
-func GetHeartbeatMillis() int {
-	if heartbeatMillis == 0 {
-		heartbeatMillis = getIntVar(EnvVarHeartbeatMillis, DefaultHeartbeatMillis)
+func (c *Cluster) GetHeartbeatMillis() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.heartbeatMillis == 0 {
+		c.heartbeatMillis = getIntVar(EnvVarHeartbeatMillis, DefaultHeartbeatMillis)
 	}
 
-	return heartbeatMillis
+	return c.heartbeatMillis
 }
 
 // GetInitialHosts returns the list of initially known hosts.
-func GetInitialHosts() []string {
-	if initialHosts == nil {
-		initialHosts = getStringArrayVar(EnvVarInitialHosts, DefaultInitialHosts)
+func (c *Cluster) GetInitialHosts() []string {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.initialHosts == nil {
+		c.initialHosts = getStringArrayVar(EnvVarInitialHosts, DefaultInitialHosts)
 	}
 
-	return initialHosts
+	return c.initialHosts
 }
 
 // GetListenPort returns the port that this host will listen on.
-func GetListenPort() int {
-	if listenPort == 0 {
-		listenPort = getIntVar(EnvVarListenPort, DefaultListenPort)
+func (c *Cluster) GetListenPort() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.listenPort == 0 {
+		c.listenPort = getIntVar(EnvVarListenPort, DefaultListenPort)
 	}
 
-	return listenPort
+	return c.listenPort
 }
 
 // GetListenIP returns the IP that this host will listen on.
-func GetListenIP() net.IP {
-	if listenIP == nil {
-		listenIP = net.ParseIP(getStringVar(EnvVarListenIP, DefaultListenIP))
+func (c *Cluster) GetListenIP() net.IP {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.listenIP == nil {
+		c.listenIP = net.ParseIP(getStringVar(EnvVarListenIP, DefaultListenIP))
 	}
 
-	return listenIP
+	return c.listenIP
 }
 
 // GetMaxBroadcastBytes returns the maximum byte length for broadcast payloads.
-func GetMaxBroadcastBytes() int {
-	if maxBroadcastBytes == 0 {
-		maxBroadcastBytes = getIntVar(EnvVarMaxBroadcastBytes, DefaultMaxBroadcastBytes)
+// Longer broadcasts are split into fragments of this size.
+func (c *Cluster) GetMaxBroadcastBytes() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.maxBroadcastBytes == 0 {
+		c.maxBroadcastBytes = getIntVar(EnvVarMaxBroadcastBytes, DefaultMaxBroadcastBytes)
 	}
 
-	return maxBroadcastBytes
+	return c.maxBroadcastBytes
 }
 
 // GetMinPingTime returns the minimum ping response time in milliseconds. Ping
 // response times below this value are recorded as this minimum.
-func GetMinPingTime() int {
-	if minPingTime == 0 {
-		minPingTime = getIntVar(EnvVarMinPingTime, DefaultMinPingTime)
+func (c *Cluster) GetMinPingTime() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.minPingTime == 0 {
+		c.minPingTime = getIntVar(EnvVarMinPingTime, DefaultMinPingTime)
 	}
 
-	return minPingTime
+	return c.minPingTime
 }
 
 // GetMulticastEnabled returns whether multicast announcements are enabled.
-func GetMulticastEnabled() bool {
-	if multicastEnabledString == "" {
-		multicastEnabledString = strings.ToLower(getStringVar(EnvVarMulticastEnabled, DefaultMulticastEnabled))
+func (c *Cluster) GetMulticastEnabled() bool {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.multicastEnabledString == "" {
+		c.multicastEnabledString = strings.ToLower(getStringVar(EnvVarMulticastEnabled, DefaultMulticastEnabled))
 	}
 
-	multicastEnabled = len(multicastEnabledString) > 0 && []rune(multicastEnabledString)[0] == 't'
-	return multicastEnabled
+	c.multicastEnabled = len(c.multicastEnabledString) > 0 && []rune(c.multicastEnabledString)[0] == 't'
+	return c.multicastEnabled
 }
 
 // GetMulticastAnnounceIntervalSeconds returns the amount of seconds to wait between
 // multicast announcements.
-func GetMulticastAnnounceIntervalSeconds() int {
-	if multicastAnnounceIntervalSeconds == 0 {
-		multicastAnnounceIntervalSeconds = getIntVar(EnvVarMulticastAnnounceIntervalSeconds, DefaultMulticastAnnounceIntervalSeconds)
+func (c *Cluster) GetMulticastAnnounceIntervalSeconds() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.multicastAnnounceIntervalSeconds == 0 {
+		c.multicastAnnounceIntervalSeconds = getIntVar(EnvVarMulticastAnnounceIntervalSeconds, DefaultMulticastAnnounceIntervalSeconds)
 	}
-	return multicastAnnounceIntervalSeconds
+	return c.multicastAnnounceIntervalSeconds
 }
 
 // GetMulticastAddress returns the address the will be used for multicast
 // announcements.
-func GetMulticastAddress() string {
-	if multicastAddress == "" {
-		multicastAddress = getStringVar(EnvVarMulticastAddress, DefaultMulticastAddress)
+func (c *Cluster) GetMulticastAddress() string {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.multicastAddress == "" {
+		c.multicastAddress = getStringVar(EnvVarMulticastAddress, DefaultMulticastAddress)
 	}
 
-	return multicastAddress
+	return c.multicastAddress
 }
 
 // GetMulticastPort returns the defined multicast announcement listening port.
-func GetMulticastPort() int {
-	if multicastPort == 0 {
-		multicastPort = getIntVar(EnvVarMulticastPort, DefaultMulticastPort)
+func (c *Cluster) GetMulticastPort() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.multicastPort == 0 {
+		c.multicastPort = getIntVar(EnvVarMulticastPort, DefaultMulticastPort)
 	}
 
-	return multicastPort
+	return c.multicastPort
 }
 
 // GetPingHistoryFrontload returns the value (in milliseconds) used to
 // pre-populate the ping history buffer, which is used to dynamically calculate
 // ping timeouts and is gradually overwritten with real data over time.
-func GetPingHistoryFrontload() int {
-	if pingHistoryFrontload == 0 {
-		pingHistoryFrontload = getIntVar(EnvVarPingHistoryFrontload, DefaultPingHistoryFrontload)
+func (c *Cluster) GetPingHistoryFrontload() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.pingHistoryFrontload == 0 {
+		c.pingHistoryFrontload = getIntVar(EnvVarPingHistoryFrontload, DefaultPingHistoryFrontload)
+	}
+
+	return c.pingHistoryFrontload
+}
+
+// GetNodeName returns the name of this node. If no name has been set, one
+// is generated; see GetNodeNameFile().
+func (c *Cluster) GetNodeName() string {
+	file := c.GetNodeNameFile()
+
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.nodeName == "" {
+		c.nodeName = getStringVar(EnvVarNodeName, DefaultNodeName)
+	}
+
+	if c.nodeName == "" {
+		name, err := loadOrCreateNodeName(file)
+		if err != nil {
+			logfWarn("Could not keep the node name in %s: %v", file, err)
+		}
+
+		c.nodeName = name
+	}
+
+	return c.nodeName
+}
+
+// GetNodeNameFile returns the file that a generated node name is kept in.
+// Empty string indicates that a generated name isn't kept.
+func (c *Cluster) GetNodeNameFile() string {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.nodeNameFile == "" {
+		c.nodeNameFile = getStringVar(EnvVarNodeNameFile, DefaultNodeNameFile)
+	}
+
+	return c.nodeNameFile
+}
+
+// GetMessageSecret returns the secret that messages are signed with. Empty
+// string indicates that messages aren't signed.
+func (c *Cluster) GetMessageSecret() string {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.messageSecret == "" {
+		c.messageSecret = getStringVar(EnvVarMessageSecret, DefaultMessageSecret)
+	}
+
+	return c.messageSecret
+}
+
+// GetPushPullIntervalMillis returns the interval (in milliseconds) between
+// full membership state exchanges with a random node. A negative value means
+// that they're disabled, except on joining.
+func (c *Cluster) GetPushPullIntervalMillis() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.pushPullIntervalMillis == 0 {
+		c.pushPullIntervalMillis = getIntVar(EnvVarPushPullIntervalMillis, DefaultPushPullIntervalMillis)
+	}
+
+	return c.pushPullIntervalMillis
+}
+
+// GetBroadcastRetentionMillis returns how long (in milliseconds) broadcasts
+// are kept, so that nodes that missed them can catch up. 0 means that
+// reliable broadcasts are disabled.
+func (c *Cluster) GetBroadcastRetentionMillis() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.broadcastRetentionMillis == 0 {
+		c.broadcastRetentionMillis = getIntVar(EnvVarBroadcastRetentionMillis, DefaultBroadcastRetentionMillis)
+	}
+
+	return c.broadcastRetentionMillis
+}
+
+// GetBroadcastAckPercent returns the percentage of the other healthy nodes
+// that must acknowledge a broadcast before its handle is done. 0 means that
+// broadcasts aren't acknowledged.
+func (c *Cluster) GetBroadcastAckPercent() int {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if c.broadcastAckPercent == 0 {
+		c.broadcastAckPercent = getIntVar(EnvVarBroadcastAckPercent, DefaultBroadcastAckPercent)
 	}
 
-	return pingHistoryFrontload
+	return c.broadcastAckPercent
 }
 
-// SetClusterName sets the name of the cluster for the purposes of multicast
-// announcements: multicast messages from differently-named instances are
-// ignored.
-func SetClusterName(val string) {
+// SetClusterName sets the name of the cluster. Messages (multicast or not)
+// from differently-named instances are ignored.
+func (c *Cluster) SetClusterName(val string) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == "" {
-		clusterName = DefaultClusterName
+		c.clusterName = DefaultClusterName
 	} else {
-		clusterName = val
+		c.clusterName = val
 	}
 }
 
 // SetHeartbeatMillis sets this nodes heartbeat frequency. Unlike
 // SetListenPort(), calling this function after Begin() has been called will
 // have an effect.
-func SetHeartbeatMillis(val int) {
+func (c *Cluster) SetHeartbeatMillis(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == 0 {
-		heartbeatMillis = DefaultHeartbeatMillis
+		c.heartbeatMillis = DefaultHeartbeatMillis
 	} else {
-		heartbeatMillis = val
+		c.heartbeatMillis = val
 	}
 }
 
 // SetListenPort sets the UDP port to listen on. It has no effect once
 // Begin() has been called.
-func SetListenPort(val int) {
+func (c *Cluster) SetListenPort(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == 0 {
-		listenPort = DefaultListenPort
+		c.listenPort = DefaultListenPort
 	} else {
-		listenPort = val
+		c.listenPort = val
 	}
 }
 
 // SetListenIP sets the IP to listen on. It has no effect once
 // Begin() has been called.
-func SetListenIP(val net.IP) {
-	if len(AllNodes()) > 0 {
-		logWarn("Do not call SetListenIP() after nodes have been added, it may cause unexpected behavior.")
+func (c *Cluster) SetListenIP(val net.IP) {
+	if len(c.AllNodes()) > 0 {
+		logWarn("Do not call c.SetListenIP() after nodes have been added, it may cause unexpected behavior.")
 	}
 
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == nil {
-		listenIP = net.ParseIP(DefaultListenIP)
+		c.listenIP = net.ParseIP(DefaultListenIP)
 	} else {
-		listenIP = val
+		c.listenIP = val
 	}
 }
 
 // SetMaxBroadcastBytes sets the maximum byte length for broadcast payloads.
-// Note that increasing this beyond the default of 256 runs the risk of packet
+// Longer broadcasts are split into fragments of this size. Note that
+// increasing this beyond the default of 256 runs the risk of packet
 // fragmentation and dropped messages.
-func SetMaxBroadcastBytes(val int) {
+func (c *Cluster) SetMaxBroadcastBytes(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == 0 {
-		maxBroadcastBytes = DefaultMaxBroadcastBytes
+		c.maxBroadcastBytes = DefaultMaxBroadcastBytes
 	} else {
-		maxBroadcastBytes = val
+		c.maxBroadcastBytes = val
 	}
 }
 
 // SetMinPingTime sets the minimum ping response time in milliseconds. Ping
 // response times below this value are recorded as this minimum.
-func SetMinPingTime(val int) {
+func (c *Cluster) SetMinPingTime(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == 0 {
-		minPingTime = DefaultMinPingTime
+		c.minPingTime = DefaultMinPingTime
 	} else {
-		minPingTime = val
+		c.minPingTime = val
 	}
 }
 
 // SetMulticastAddress sets the address that will be used for multicast
 // announcements.
-func SetMulticastAddress(val string) {
+func (c *Cluster) SetMulticastAddress(val string) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == "" {
-		multicastAddress = DefaultMulticastAddress
+		c.multicastAddress = DefaultMulticastAddress
 	} else {
-		multicastAddress = val
+		c.multicastAddress = val
 	}
 }
 
 // SetMulticastEnabled sets whether multicast announcements are enabled.
-func SetMulticastEnabled(val bool) {
-	multicastEnabledString = fmt.Sprintf("%v", val)
+func (c *Cluster) SetMulticastEnabled(val bool) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	c.multicastEnabledString = fmt.Sprintf("%v", val)
 }
 
 // SetMulticastAnnounceIntervalSeconds sets the number of seconds between multicast announcements
-func SetMulticastAnnounceIntervalSeconds(val int) {
-	multicastAnnounceIntervalSeconds = val
+func (c *Cluster) SetMulticastAnnounceIntervalSeconds(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	c.multicastAnnounceIntervalSeconds = val
 }
 
 // SetMulticastPort sets multicast announcement listening port.
-func SetMulticastPort(val int) {
+func (c *Cluster) SetMulticastPort(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == 0 {
-		multicastPort = DefaultMulticastPort
+		c.multicastPort = DefaultMulticastPort
 	} else {
-		multicastPort = val
+		c.multicastPort = val
+	}
+}
+
+// SetNodeName sets the name of this node, which identifies it in the
+// cluster whatever its address. It must be unique within the cluster, and
+// may be up to 255 bytes long; a longer name is rejected with an error. It
+// has no effect once Begin() has been called.
+func (c *Cluster) SetNodeName(val string) error {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	err := checkNodeName(val)
+	if err != nil {
+		return err
 	}
+
+	c.nodeName = val
+
+	return nil
+}
+
+// SetNodeNameFile sets the file that a generated node name is kept in, so
+// that the node keeps its name across restarts. If the file doesn't exist,
+// it is created; if it holds a name longer than 255 bytes, it is rejected
+// with an error. It has no effect once Begin() has been called, or if a node
+// name has been set.
+func (c *Cluster) SetNodeNameFile(val string) error {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	if val != "" {
+		if name, err := readNodeName(val); err == nil {
+			err = checkNodeName(name)
+			if err != nil {
+				return fmt.Errorf("%s: %w", val, err)
+			}
+		}
+	}
+
+	c.nodeNameFile = val
+
+	return nil
 }
 
 // SetPingHistoryFrontload sets the value (in milliseconds) used to
 // pre-populate the ping history buffer, which is used to dynamically calculate
 // ping timeouts and is gradually overwritten with real data over time.
 // Setting this to 0 will restore the default value.
-func SetPingHistoryFrontload(val int) {
+func (c *Cluster) SetPingHistoryFrontload(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
 	if val == 0 {
-		pingHistoryFrontload = DefaultPingHistoryFrontload
+		c.pingHistoryFrontload = DefaultPingHistoryFrontload
 	} else {
-		pingHistoryFrontload = val
+		c.pingHistoryFrontload = val
 	}
 }
 
+// SetMessageSecret sets the secret that every message is signed with
+// (HMAC-SHA256), so that nodes that don't know it can't forge statuses.
+// Messages whose signature doesn't match are rejected (see
+// RejectedMessages). All nodes of a cluster must share the secret. Empty
+// string restores the default value.
+func (c *Cluster) SetMessageSecret(val string) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	c.messageSecret = val
+}
+
+// SetPushPullIntervalMillis sets the interval (in milliseconds) between full
+// membership state exchanges with a random node, which speed up convergence
+// after partitions heal. A negative value disables them, except on joining;
+// 0 restores the default value.
+func (c *Cluster) SetPushPullIntervalMillis(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	c.pushPullIntervalMillis = val
+}
+
+// SetBroadcastRetentionMillis sets how long (in milliseconds) broadcasts are
+// kept after they are sent or received. While they are, they're offered to
+// the nodes that this one exchanges state with, so that nodes that join (or
+// come back) within that time catch up on them. 0 restores the default,
+// which disables reliable broadcasts.
+func (c *Cluster) SetBroadcastRetentionMillis(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	c.broadcastRetentionMillis = val
+}
+
+// SetBroadcastAckPercent sets the percentage (1 to 100) of the other healthy
+// nodes that must acknowledge the broadcasts sent from then on before their
+// handles are done. Nodes that receive such a broadcast acknowledge it once
+// they've passed it to their listeners. 0 restores the default, under which
+// a handle is done once its broadcast has been emitted as many times as it's
+// meant to be.
+func (c *Cluster) SetBroadcastAckPercent(val int) {
+	c.properties.lock.Lock()
+	defer c.properties.lock.Unlock()
+
+	c.broadcastAckPercent = val
+}
+
 // Gets an environmental variable "key". If it does not exist, "defaultVal" is
 // returned; if it does, it attempts to convert to an integer, returning
 // "defaultVal" if it fails.
@@ -439,6 +785,70 @@ func getStringVar(key string, defaultVal string) string {
 	return valueString
 }
 
+// Reads the node name kept in path. If there's no such file, a new name is
+// generated and written to it. If path is empty, a new name is generated
+// and not kept. A generated name is returned even if there's an error, such
+// as a kept name that is too long.
+func loadOrCreateNodeName(path string) (string, error) {
+	if path != "" {
+		name, err := readNodeName(path)
+		if err == nil {
+			err = checkNodeName(name)
+		}
+
+		if err != nil {
+			return newNodeName(), err
+		}
+
+		if name != "" {
+			return name, nil
+		}
+	}
+
+	name := newNodeName()
+
+	if path != "" {
+		err := os.WriteFile(path, []byte(name+"\n"), 0o600)
+		if err != nil {
+			return name, err
+		}
+	}
+
+	return name, nil
+}
+
+// Reads the node name kept in path. It is empty if there's no such file.
+func readNodeName(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(bytes)), err
+}
+
+// checkNodeName returns an error if name is too long to be encoded in a
+// message, which gives it a single length byte.
+func checkNodeName(name string) error {
+	if len(name) > 0xFF {
+		return fmt.Errorf("node name too long: %d bytes (max 255)", len(name))
+	}
+
+	return nil
+}
+
+// Generates a random node name.
+func newNodeName() string {
+	bytes := make([]byte, 16)
+
+	_, err := rand.Read(bytes)
+	if err != nil {
+		panic("could not generate a node name: " + err.Error())
+	}
+
+	return hex.EncodeToString(bytes)
+}
+
 // Splits a string on a regular expression.
 func splitDelimmitedString(str string, regex string) []string {
 	var result []string
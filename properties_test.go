@@ -17,7 +17,13 @@ limitations under the License.
 package smudge
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestSplitString0a(t *testing.T) {
@@ -109,3 +115,47 @@ func TestSplitString3c(t *testing.T) {
 		t.Errorf("len=%d contents=%v\n", len(split), split)
 	}
 }
+
+func TestNodeNameFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node-name")
+
+	c := NewCluster()
+	c.SetNodeNameFile(path)
+	name := c.GetNodeName()
+	require.NotEmpty(t, name)
+
+	// A restarted node reads the same name back.
+	c = NewCluster()
+	c.SetNodeNameFile(path)
+	require.Equal(t, name, c.GetNodeName())
+
+	// An explicit name wins.
+	c = NewCluster()
+	c.SetNodeNameFile(path)
+	c.SetNodeName("explicit")
+	require.Equal(t, "explicit", c.GetNodeName())
+}
+
+func TestNodeNameTooLong(t *testing.T) {
+	long := strings.Repeat("n", 256)
+
+	c := NewCluster()
+	require.Error(t, c.SetNodeName(long))
+	require.NoError(t, c.SetNodeName(long[:255]))
+	require.Equal(t, long[:255], c.GetNodeName())
+
+	// A kept name that is too long is rejected too, and never used.
+	path := filepath.Join(t.TempDir(), "node-name")
+	require.NoError(t, os.WriteFile(path, []byte(long+"\n"), 0o600))
+
+	c = NewCluster()
+	require.Error(t, c.SetNodeNameFile(path))
+
+	c = NewCluster()
+	c.nodeNameFile = path
+	require.NotEqual(t, long, c.GetNodeName())
+
+	// As is one from the environment.
+	t.Setenv(EnvVarNodeName, long)
+	require.Error(t, NewCluster().BeginContext(context.Background()))
+}
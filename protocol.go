@@ -0,0 +1,120 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+)
+
+// Every message starts with the protocol version it is encoded in and the
+// range of versions its sender supports (see the layout in message.go).
+// These first bytes keep their places in every version, so that a node can
+// always tell what its peers speak, even when it can't read them. Messages
+// to a node are encoded in the highest version that both ends support.
+const (
+	// ProtocolVersionMin is the lowest protocol version this node can read
+	// and write.
+	ProtocolVersionMin uint8 = 1
+
+	// ProtocolVersionMax is the highest protocol version this node can read
+	// and write.
+	ProtocolVersionMax uint8 = 1
+)
+
+// unsupportedVersionError is returned when decoding a message encoded in a
+// protocol version that we don't support.
+type unsupportedVersionError struct {
+	version, min, max uint8
+}
+
+func (e *unsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d (sender supports %d-%d, we support %d-%d)",
+		e.version, e.min, e.max, ProtocolVersionMin, ProtocolVersionMax)
+}
+
+// compatible returns true if the sender of the message shares a protocol
+// version with us, even though the message itself isn't in one of ours.
+func (e *unsupportedVersionError) compatible() bool {
+	return e.min <= ProtocolVersionMax && e.max >= ProtocolVersionMin
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// ProtocolVersions returns the range of protocol versions that this node
+// supports, as last heard. Both are 0 if we haven't heard from the node yet.
+func (n *Node) ProtocolVersions() (min, max uint8) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.protocolMin, n.protocolMax
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// protocolVersionFor returns the protocol version to encode messages to node
+// in: the highest that both of us support. Until we've heard from the node,
+// that's our lowest, which is the likeliest to be understood.
+func (c *Cluster) protocolVersionFor(node *Node) (uint8, error) {
+	min, max := node.ProtocolVersions()
+	if max == 0 {
+		return ProtocolVersionMin, nil
+	}
+
+	version := ProtocolVersionMax
+	if max < version {
+		version = max
+	}
+
+	if version < ProtocolVersionMin || version < min {
+		return 0, fmt.Errorf("no protocol version in common with %s (it supports %d-%d, we support %d-%d)",
+			node.Address(), min, max,
+			ProtocolVersionMin, ProtocolVersionMax)
+	}
+
+	return version, nil
+}
+
+// noteUnsupportedVersion handles a message from address that is encoded in a
+// protocol version we don't support. If its sender has no version in common
+// with us, the incompatibility listeners are told (once for each address and
+// range of versions).
+func (c *Cluster) noteUnsupportedVersion(address string, e *unsupportedVersionError) {
+	if e.compatible() {
+		// It doesn't know what we speak yet; it will once it hears from us.
+		logfDebug("Dropped a message from %s: %v", address, e)
+		return
+	}
+
+	versions := [2]uint8{e.min, e.max}
+
+	c.incompatibleNodes.Lock()
+	reported := c.incompatibleNodes.m[address] == versions
+	c.incompatibleNodes.m[address] = versions
+	c.incompatibleNodes.Unlock()
+
+	if reported {
+		return
+	}
+
+	logfWarn("Node at %s is incompatible: %v", address, e)
+
+	c.doIncompatibleUpdate(address, e.min, e.max)
+}
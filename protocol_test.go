@@ -0,0 +1,120 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport/memtransport"
+	"github.com/stretchr/testify/require"
+)
+
+type collectingIncompatibleListener struct {
+	sync.Mutex
+	reports []string
+}
+
+func (l *collectingIncompatibleListener) OnIncompatible(address string, minVersion, maxVersion uint8) {
+	l.Lock()
+	l.reports = append(l.reports, address)
+	l.Unlock()
+}
+
+// encodeWithVersions encodes msg as if by a node that supports protocol
+// versions min to max.
+func encodeWithVersions(c *Cluster, msg message, version, min, max uint8) []byte {
+	msg.version = version
+	bytes := msg.encode(c.ipLen, c.clusterID())
+	bytes[5] = min
+	bytes[6] = max
+	encodeUint32(checksum(bytes[4:]), bytes, 0)
+
+	return bytes
+}
+
+func TestDecodeProtocolVersions(t *testing.T) {
+	c := NewCluster()
+	sender := &Node{name: "sender", ip: net.IPv4(10, 0, 17, 2), port: 9999}
+
+	decoded, err := c.decodeMessage(sender.ip, encodeWithVersions(c, newMessage(verbPing, sender, 1), 1, 1, 3))
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersionMax, decoded.version)
+
+	min, max := decoded.sender.ProtocolVersions()
+	require.Equal(t, uint8(1), min)
+	require.Equal(t, uint8(3), max)
+
+	// A version we don't support can't be decoded.
+	_, err = c.decodeMessage(sender.ip, encodeWithVersions(c, newMessage(verbPing, sender, 1), 3, 3, 3))
+
+	var versionErr *unsupportedVersionError
+	require.True(t, errors.As(err, &versionErr))
+	require.False(t, versionErr.compatible())
+
+	// Whatever the rest of it looks like: another version may checksum and
+	// lay out its messages differently.
+	_, err = c.decodeMessage(sender.ip, []byte{0, 0, 0, 0, 3, 3, 3, 0xFF})
+	require.True(t, errors.As(err, &versionErr))
+}
+
+func TestProtocolVersionFor(t *testing.T) {
+	c := NewCluster()
+	node := &Node{ip: net.IPv4(10, 0, 17, 2), port: 9999}
+
+	// Not heard from yet.
+	version, err := c.protocolVersionFor(node)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersionMin, version)
+
+	// A newer node speaks our highest version.
+	node.protocolMin, node.protocolMax = ProtocolVersionMin, ProtocolVersionMax+2
+	version, err = c.protocolVersionFor(node)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersionMax, version)
+
+	// One that has moved on completely can't be spoken to.
+	node.protocolMin, node.protocolMax = ProtocolVersionMax+1, ProtocolVersionMax+2
+	_, err = c.protocolVersionFor(node)
+	require.Error(t, err)
+}
+
+func TestIncompatibleNodeReported(t *testing.T) {
+	c := NewCluster()
+	listener := &collectingIncompatibleListener{}
+	c.AddIncompatibleListener(listener)
+
+	sender := &Node{name: "sender", ip: net.IPv4(10, 0, 17, 2), port: 9999}
+	addr, err := memtransport.NewNetwork().NewTransport(sender.ip).ResolveAddr("udp", sender.Address())
+	require.NoError(t, err)
+
+	// A node that could speak our version is just not reported.
+	compatible := encodeWithVersions(c, newMessage(verbPing, sender, 1), ProtocolVersionMax+1, ProtocolVersionMin, ProtocolVersionMax+1)
+	require.NoError(t, c.receiveMessage(addr, compatible))
+	require.Empty(t, listener.reports)
+
+	// An incompatible one is reported, once.
+	incompatible := encodeWithVersions(c, newMessage(verbPing, sender, 1), ProtocolVersionMax+1, ProtocolVersionMax+1, ProtocolVersionMax+1)
+	require.NoError(t, c.receiveMessage(addr, incompatible))
+	require.NoError(t, c.receiveMessage(addr, incompatible))
+	require.Equal(t, []string{sender.Address()}, listener.reports)
+
+	// And it never makes it into the membership.
+	require.Equal(t, 0, c.knownNodes.length())
+}
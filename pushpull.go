@@ -0,0 +1,156 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"time"
+)
+
+// Gossip only carries a few members per message, so on its own it's slow to
+// tell a new node (or the far side of a healed partition) about a large
+// cluster. To speed things up, nodes periodically exchange their whole
+// membership tables in a push-pull: one node sends its table in a SYNC (split
+// over SYNCDATA messages if it doesn't fit in one), and the other answers
+// with its own table in SYNCDATA messages. Both sides merge what they
+// receive exactly as they merge gossip. If reliable broadcasts are enabled,
+// each side then offers the other the broadcasts it keeps (see
+// reliableBroadcast.go).
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// pushPullLoop exchanges state with every node we know of on joining, and
+// then with a random node every GetPushPullIntervalMillis() until ctx is
+// done.
+func (c *Cluster) pushPullLoop(ctx context.Context) {
+	for _, n := range c.knownNodes.getRandomNodes(0, c.thisHost) {
+		err := c.transmitPushPull(n, verbSync)
+		if err != nil {
+			logInfo("Failure to sync with", n.Address(), "->", err)
+		}
+	}
+
+	for {
+		interval := c.GetPushPullIntervalMillis()
+
+		wait := interval
+		if wait < 0 {
+			wait = c.GetHeartbeatMillis()
+		}
+
+		if !sleepContext(ctx, time.Millisecond*time.Duration(wait)) {
+			return
+		}
+
+		if interval < 0 || c.isLeaving() {
+			continue
+		}
+
+		// Dead nodes are candidates too: if they're on the far side of a
+		// partition that has healed, this is how both sides find out.
+		nodes := c.knownNodes.getRandomNodes(1, c.thisHost)
+		if len(nodes) == 0 {
+			continue
+		}
+
+		err := c.transmitPushPull(nodes[0], verbSync)
+		if err != nil {
+			logInfo("Failure to sync with", nodes[0].Address(), "->", err)
+		}
+	}
+}
+
+// pushPullMessages packs our whole membership table into messages that each
+// fit into a packet (once signed and encrypted, if need be). The first
+// message has the given verb, and the rest are SYNCDATA.
+func (c *Cluster) pushPullMessages(verb messageVerb) []*message {
+	messages := make([]*message, 0, 1)
+
+	msg := newMessage(verb, c.thisHost, c.currentHeartbeat.Load())
+	m := &msg
+
+	max := c.maxMessageBytes()
+
+	for _, n := range c.knownNodes.values() {
+		status, heartbeat, source := n.gossip()
+		if !m.tryAddMember(n, status, heartbeat, source, c.ipLen, max) {
+			messages = append(messages, m)
+
+			next := newMessage(verbSyncData, c.thisHost, c.currentHeartbeat.Load())
+			m = &next
+			m.addMember(n, status, heartbeat, source)
+		}
+	}
+
+	return append(messages, m)
+}
+
+// transmitPushPull sends our whole membership table to node. If verb is
+// SYNC, node answers with its own.
+func (c *Cluster) transmitPushPull(node *Node, verb messageVerb) error {
+	remoteAddr, err := c.transportImpl.ResolveAddr(c.transportImpl.Network(), node.Address())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.runContext(), time.Second*30)
+	defer cancel()
+
+	conn, err := c.transportImpl.Dial(ctx, nil, remoteAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	version, err := c.protocolVersionFor(node)
+	if err != nil {
+		return err
+	}
+
+	messages := c.pushPullMessages(verb)
+
+	for _, msg := range messages {
+		msg.version = version
+
+		packet, err := c.encodePacket(msg)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write(packet)
+		if err != nil {
+			return err
+		}
+	}
+
+	logfDebug("Sent %d member(s) to %v in %d message(s)",
+		c.knownNodes.length(), node.Address(), len(messages))
+
+	return c.transmitBroadcastDigests(node)
+}
+
+// receiveVerbSync answers a push with a pull. The members that came with the
+// message have already been merged by updateStatusesFromMessage().
+func (c *Cluster) receiveVerbSync(msg message) error {
+	if c.isLeaving() {
+		return nil
+	}
+
+	return c.transmitPushPull(msg.sender, verbSyncData)
+}
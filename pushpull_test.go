@@ -0,0 +1,76 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushPullMessages(t *testing.T) {
+	c := NewCluster()
+	c.SetListenIP(net.IPv4(10, 0, 10, 1))
+	c.SetNodeName("pusher")
+	c.initHostEnvironment()
+	c.AddNode(c.thisHost)
+
+	meta, err := encodeMeta(map[string]string{"role": "worker", "zone": "eu-west-1a"})
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		n, err := CreateNodeByIP(net.IPv4(10, 0, 11, byte(i)), 9999)
+		require.NoError(t, err)
+		n.name = fmt.Sprintf("node-%03d", i)
+		n.metaVersion = 1
+		n.metaBytes = meta
+		c.AddNode(n)
+	}
+
+	c.updateNodeStatus(c.knownNodes.getByKey("node-007"), StatusSuspected, 5, c.thisHost)
+
+	messages := c.pushPullMessages(verbSync)
+	require.True(t, len(messages) > 1)
+
+	// The whole table arrives, in messages that each fit a receive buffer.
+	r := NewCluster()
+	r.SetListenIP(net.IPv4(10, 0, 10, 2))
+	r.SetNodeName("puller")
+	r.initHostEnvironment()
+	r.AddNode(r.thisHost)
+
+	for i, msg := range messages {
+		if i == 0 {
+			require.Equal(t, verbSync, msg.verb)
+		} else {
+			require.Equal(t, verbSyncData, msg.verb)
+		}
+
+		bytes := msg.encode(c.ipLen, c.clusterID())
+		require.True(t, len(bytes) <= ReadBufSize)
+
+		decoded, err := r.decodeMessage(c.thisHost.ip, bytes)
+		require.NoError(t, err)
+		r.updateStatusesFromMessage(decoded)
+	}
+
+	require.Equal(t, 202, r.knownNodes.length())
+	require.Equal(t, StatusSuspected, r.knownNodes.getByKey("node-007").Status())
+	require.Equal(t, "worker", r.knownNodes.getByKey("node-123").Meta()["role"])
+}
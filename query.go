@@ -0,0 +1,492 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Query broadcast payload
+// Bytes 00-07 Query ID
+// Byte  08    Name length N
+// Bytes 09-NN Name
+// Byte        Node filter count C
+//             C names or addresses, each preceded by a byte holding its length
+// Bytes       Metadata filter length M (2 bytes)
+// Bytes       Metadata filter, as encoded by encodeMeta (M bytes)
+// Bytes       Payload
+//
+// Query response message payload
+// Bytes 00-07 Query ID
+// Byte  08    queryAck or queryReply
+// Bytes 09-NN Response (queryReply only)
+
+const (
+	queryAck byte = iota
+	queryReply
+)
+
+// QueryFilter selects the nodes that a query is meant for. A node answers
+// only if it matches every field that is set.
+type QueryFilter struct {
+	// The names or addresses of the nodes that should answer.
+	Nodes []string
+
+	// Metadata that the nodes that should answer must carry.
+	Meta map[string]string
+}
+
+// QueryHandler is the interface that must be implemented to answer the
+// queries of a given name, as registered with AddQueryHandler().
+type QueryHandler interface {
+	// The OnQuery() function is called whenever a query of the name it was
+	// registered for reaches this node, and this node passes its filter. It
+	// returns the response, or nil to only acknowledge the query.
+	OnQuery(origin *Node, payload []byte) []byte
+}
+
+// NodeResponse is the response of one node to a query.
+type NodeResponse struct {
+	Node    *Node
+	Payload []byte
+}
+
+// QueryResponse collects the acknowledgements and responses to a query
+// started by this node, until the query's context is done.
+type QueryResponse struct {
+	lock sync.Mutex
+
+	// The keys (names, if known) of the nodes that have acknowledged, and
+	// responded to, the query.
+	acked     map[string]bool
+	responded map[string]bool
+
+	// The responses received but not yet read from the responses channel,
+	// and a signal that there are more. However slowly the responses are
+	// read, none are dropped before the query is done.
+	pending []NodeResponse
+	notify  chan struct{}
+
+	responses chan NodeResponse
+	done      bool
+}
+
+// query is a query as received by a node.
+type query struct {
+	id      uint64
+	name    string
+	filter  *QueryFilter
+	payload []byte
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// AddQueryHandler registers the handler that answers the queries named name
+// on this node, in place of any handler registered for it before. Nodes that
+// have no handler for a query still acknowledge it.
+func (c *Cluster) AddQueryHandler(name string, handler QueryHandler) {
+	c.queryHandlers.Lock()
+	c.queryHandlers.m[name] = handler
+	c.queryHandlers.Unlock()
+}
+
+// Query asks the healthy nodes of the cluster (this one included) that pass
+// filter, or all of them if filter is nil, the query named name. The query is
+// spread like a broadcast, so payload and filter must fit in one, along with
+// the name. Each node that receives it acknowledges it, and answers it with
+// its handler for name, if it has one, straight to this node. Query returns
+// at once: the responses are streamed by the returned QueryResponse until
+// ctx is done, so ctx should have a deadline.
+func (c *Cluster) Query(ctx context.Context, name string, payload []byte, filter *QueryFilter) (*QueryResponse, error) {
+	q := &query{
+		id:      rand.Uint64(),
+		name:    name,
+		filter:  filter,
+		payload: payload,
+	}
+
+	bytes, err := q.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes) > c.GetMaxBroadcastBytes() {
+		return nil, fmt.Errorf("query length exceeds %d bytes", c.GetMaxBroadcastBytes())
+	}
+
+	response := &QueryResponse{
+		acked:     make(map[string]bool),
+		responded: make(map[string]bool),
+		notify:    make(chan struct{}, 1),
+		responses: make(chan NodeResponse),
+	}
+
+	c.queries.Lock()
+	c.queries.m[q.id] = response
+	c.queries.Unlock()
+
+	runCtx := c.runContext()
+
+	running := c.goBackgroundIfRunning(func() {
+		response.forward(ctx, runCtx)
+
+		c.queries.Lock()
+		delete(c.queries.m, q.id)
+		c.queries.Unlock()
+
+		response.finish()
+	})
+
+	if !running {
+		c.queries.Lock()
+		delete(c.queries.m, q.id)
+		c.queries.Unlock()
+
+		return nil, errors.New("node not started")
+	}
+
+	c.queueBroadcast(broadcastQuery, bytes)
+
+	if q.filter.matches(c.thisHost) {
+		c.goBackgroundIfRunning(func() { c.answerQuery(c.thisHost, q) })
+	}
+
+	return response, nil
+}
+
+// Responses returns the channel that the responses to the query are
+// delivered on. It is closed once the query's context is done.
+func (r *QueryResponse) Responses() <-chan NodeResponse {
+	return r.responses
+}
+
+// AckCount returns the number of nodes that have acknowledged the query so
+// far.
+func (r *QueryResponse) AckCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.acked)
+}
+
+// ResponseCount returns the number of nodes that have responded to the query
+// so far.
+func (r *QueryResponse) ResponseCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.responded)
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// matches returns true if node passes the filter. A nil filter passes every
+// node.
+func (f *QueryFilter) matches(node *Node) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.Nodes) > 0 {
+		found := false
+
+		for _, n := range f.Nodes {
+			if n == node.Address() || (n != "" && n == node.Name()) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	meta := node.Meta()
+	for k, v := range f.Meta {
+		if value, ok := meta[k]; !ok || value != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encode composes the payload of a query broadcast.
+func (q *query) encode() ([]byte, error) {
+	if q.name == "" || len(q.name) > 0xFF {
+		return nil, errors.New("query name must be 1 to 255 bytes long")
+	}
+
+	var nodes []string
+	var meta []byte
+
+	if q.filter != nil {
+		nodes = q.filter.Nodes
+
+		if len(nodes) > 0xFF {
+			return nil, fmt.Errorf("too many nodes in query filter: %d (max 255)", len(nodes))
+		}
+
+		var err error
+		meta, err = encodeMeta(q.filter.Meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bytes := make([]byte, 8, 8+1+len(q.name)+1+2+len(meta)+len(q.payload))
+	encodeUint64(q.id, bytes, 0)
+
+	bytes = append(bytes, byte(len(q.name)))
+	bytes = append(bytes, q.name...)
+
+	bytes = append(bytes, byte(len(nodes)))
+	for _, n := range nodes {
+		if len(n) > 0xFF {
+			return nil, fmt.Errorf("query filter node %q too long", n)
+		}
+
+		bytes = append(bytes, byte(len(n)))
+		bytes = append(bytes, n...)
+	}
+
+	p := len(bytes)
+	bytes = append(bytes, 0, 0)
+	encodeUint16(uint16(len(meta)), bytes, p)
+	bytes = append(bytes, meta...)
+
+	return append(bytes, q.payload...), nil
+}
+
+// decodeQuery reads the payload of a query broadcast.
+func decodeQuery(bytes []byte) (*query, error) {
+	truncated := errors.New("query truncated")
+
+	if len(bytes) < 9 {
+		return nil, truncated
+	}
+
+	q := &query{filter: &QueryFilter{}}
+
+	var length byte
+	var p int
+
+	q.id, p = decodeUint64(bytes, 0)
+
+	length, p = decodeByte(bytes, p)
+	if p+int(length)+1 > len(bytes) {
+		return nil, truncated
+	}
+
+	q.name = string(bytes[p : p+int(length)])
+	p += int(length)
+
+	var count byte
+	count, p = decodeByte(bytes, p)
+
+	for i := 0; i < int(count); i++ {
+		if p >= len(bytes) {
+			return nil, truncated
+		}
+
+		length, p = decodeByte(bytes, p)
+		if p+int(length) > len(bytes) {
+			return nil, truncated
+		}
+
+		q.filter.Nodes = append(q.filter.Nodes, string(bytes[p:p+int(length)]))
+		p += int(length)
+	}
+
+	if p+2 > len(bytes) {
+		return nil, truncated
+	}
+
+	var metaLength uint16
+	metaLength, p = decodeUint16(bytes, p)
+
+	if p+int(metaLength) > len(bytes) {
+		return nil, truncated
+	}
+
+	meta, err := decodeMeta(bytes[p : p+int(metaLength)])
+	if err != nil {
+		return nil, err
+	}
+
+	q.filter.Meta = meta
+	q.payload = bytes[p+int(metaLength):]
+
+	return q, nil
+}
+
+// receiveQuery answers a query broadcast by another node, if this node
+// passes its filter. The query is answered in the background, so that a slow
+// handler doesn't hold up the messages received after it.
+func (c *Cluster) receiveQuery(broadcast *Broadcast) {
+	q, err := decodeQuery(broadcast.bytes)
+	if err != nil {
+		logWarn("Bad query from", broadcast.Origin().Address(), "->", err)
+		return
+	}
+
+	if !q.filter.matches(c.thisHost) {
+		return
+	}
+
+	logfDebug("Received query %q from %s", q.name, broadcast.Origin().Address())
+
+	origin := broadcast.Origin()
+
+	c.goBackground(func() { c.answerQuery(origin, q) })
+}
+
+// answerQuery acknowledges a query, and responds to it with the handler
+// registered for its name, if there is one.
+func (c *Cluster) answerQuery(origin *Node, q *query) {
+	c.replyToQuery(origin, q.id, queryAck, nil)
+
+	c.queryHandlers.RLock()
+	handler, ok := c.queryHandlers.m[q.name]
+	c.queryHandlers.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	response := handler.OnQuery(origin, q.payload)
+	if response != nil {
+		c.replyToQuery(origin, q.id, queryReply, response)
+	}
+}
+
+// replyToQuery sends an acknowledgement of, or a response to, a query to the
+// node that asked it.
+func (c *Cluster) replyToQuery(origin *Node, id uint64, kind byte, response []byte) {
+	payload := make([]byte, 9, 9+len(response))
+	encodeUint64(id, payload, 0)
+	payload[8] = kind
+	payload = append(payload, response...)
+
+	if origin.Address() == c.thisHost.Address() {
+		c.noteQueryReply(c.thisHost, payload)
+		return
+	}
+
+	err := c.transmitPayload(origin, verbQueryResponse, payload)
+	if err != nil {
+		logInfo("Failure to answer query from", origin.Address(), "->", err)
+	}
+}
+
+func (c *Cluster) receiveVerbQueryResponse(msg message) error {
+	c.noteQueryReply(msg.sender, msg.payload)
+
+	return nil
+}
+
+// noteQueryReply records an acknowledgement of, or a response to, a query
+// that this node started and is still collecting responses for.
+func (c *Cluster) noteQueryReply(sender *Node, payload []byte) {
+	if len(payload) < 9 {
+		logWarn("Received a truncated query response from", sender.Address())
+		return
+	}
+
+	id, _ := decodeUint64(payload, 0)
+
+	c.queries.Lock()
+	response, ok := c.queries.m[id]
+	c.queries.Unlock()
+
+	if !ok {
+		return
+	}
+
+	response.lock.Lock()
+	defer response.lock.Unlock()
+
+	if response.done {
+		return
+	}
+
+	key := sender.key()
+
+	// A response implies an acknowledgement, should that have been lost.
+	response.acked[key] = true
+
+	if payload[8] != queryReply || response.responded[key] {
+		return
+	}
+
+	response.responded[key] = true
+	response.pending = append(response.pending, NodeResponse{Node: sender, Payload: payload[9:]})
+
+	select {
+	case response.notify <- struct{}{}:
+	default:
+	}
+}
+
+// forward delivers the pending responses on the response channel, in the
+// order they were received, until ctx or runCtx is done.
+func (r *QueryResponse) forward(ctx, runCtx context.Context) {
+	for {
+		var out chan NodeResponse
+		var next NodeResponse
+
+		r.lock.Lock()
+		if len(r.pending) > 0 {
+			out = r.responses
+			next = r.pending[0]
+		}
+		r.lock.Unlock()
+
+		// Sending on out blocks forever while it's nil.
+		select {
+		case <-ctx.Done():
+			return
+		case <-runCtx.Done():
+			return
+		case <-r.notify:
+		case out <- next:
+			r.lock.Lock()
+			r.pending = r.pending[1:]
+			r.lock.Unlock()
+		}
+	}
+}
+
+// finish closes the response channel, once the query is done.
+func (r *QueryResponse) finish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.done {
+		r.done = true
+		close(r.responses)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryEncoding(t *testing.T) {
+	q := &query{
+		id:   42,
+		name: "load",
+		filter: &QueryFilter{
+			Nodes: []string{"10.0.26.1:9999", "db-1"},
+			Meta:  map[string]string{"role": "db"},
+		},
+		payload: []byte("how busy?"),
+	}
+
+	bytes, err := q.encode()
+	require.NoError(t, err)
+
+	decoded, err := decodeQuery(bytes)
+	require.NoError(t, err)
+	require.Equal(t, q, decoded)
+
+	// Without a filter, every node matches.
+	q.filter = nil
+	bytes, err = q.encode()
+	require.NoError(t, err)
+
+	decoded, err = decodeQuery(bytes)
+	require.NoError(t, err)
+	require.Empty(t, decoded.filter.Nodes)
+	require.Empty(t, decoded.filter.Meta)
+
+	for i := 0; i < len(bytes)-len(q.payload); i++ {
+		_, err = decodeQuery(bytes[:i])
+		require.Error(t, err, "truncated to %d bytes", i)
+	}
+
+	q.name = ""
+	_, err = q.encode()
+	require.Error(t, err)
+}
+
+func TestQueryFilter(t *testing.T) {
+	node := &Node{
+		ip:   net.IPv4(10, 0, 26, 1),
+		port: 9999,
+		name: "db-1",
+		meta: map[string]string{"role": "db", "zone": "a"},
+	}
+
+	var nilFilter *QueryFilter
+	require.True(t, nilFilter.matches(node))
+	require.True(t, (&QueryFilter{}).matches(node))
+	require.True(t, (&QueryFilter{Nodes: []string{"10.0.26.1:9999"}}).matches(node))
+	require.True(t, (&QueryFilter{Nodes: []string{"web-1", "db-1"}}).matches(node))
+	require.False(t, (&QueryFilter{Nodes: []string{"web-1"}}).matches(node))
+	require.True(t, (&QueryFilter{Meta: map[string]string{"role": "db"}}).matches(node))
+	require.False(t, (&QueryFilter{Meta: map[string]string{"role": "web"}}).matches(node))
+	require.False(t, (&QueryFilter{
+		Nodes: []string{"db-1"},
+		Meta:  map[string]string{"zone": "b"},
+	}).matches(node))
+}
+
+func TestQueryReplyFromMovedNode(t *testing.T) {
+	c := NewCluster()
+
+	response := &QueryResponse{
+		acked:     make(map[string]bool),
+		responded: make(map[string]bool),
+		notify:    make(chan struct{}, 1),
+		responses: make(chan NodeResponse),
+	}
+
+	c.queries.m[42] = response
+
+	// The same node, before and after it restarted at another address.
+	before := &Node{name: "db-1", ip: net.IPv4(10, 0, 26, 1), port: 9999}
+	after := &Node{name: "db-1", ip: net.IPv4(10, 0, 26, 2), port: 9999}
+
+	for _, sender := range []*Node{before, after} {
+		payload := make([]byte, 9)
+		encodeUint64(42, payload, 0)
+		payload[8] = queryReply
+
+		c.noteQueryReply(sender, append(payload, "busy"...))
+	}
+
+	require.Equal(t, 1, response.AckCount())
+	require.Equal(t, 1, response.ResponseCount())
+	require.Len(t, response.pending, 1)
+}
+
+func TestQueryResponsesNotDropped(t *testing.T) {
+	c := NewCluster()
+
+	response := &QueryResponse{
+		acked:     make(map[string]bool),
+		responded: make(map[string]bool),
+		notify:    make(chan struct{}, 1),
+		responses: make(chan NodeResponse),
+	}
+
+	c.queries.m[42] = response
+
+	// Many more responses than the nodes known of, before any is read.
+	for i := 0; i < 100; i++ {
+		payload := make([]byte, 9)
+		encodeUint64(42, payload, 0)
+		payload[8] = queryReply
+
+		sender := &Node{ip: net.IPv4(10, 0, 26, byte(i+1)), port: 9999}
+		c.noteQueryReply(sender, payload)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		response.forward(ctx, context.Background())
+		response.finish()
+	}()
+
+	for i := 0; i < 100; i++ {
+		r := <-response.Responses()
+		require.Equal(t, net.IPv4(10, 0, 26, byte(i+1)).String(), r.Node.IP().String())
+	}
+
+	cancel()
+
+	for range response.Responses() {
+		t.Fatal("Unexpected response")
+	}
+}
+
+func TestQueryNotRunning(t *testing.T) {
+	c := NewCluster()
+
+	_, err := c.Query(context.Background(), "load", nil, nil)
+	require.Error(t, err)
+	require.Empty(t, c.queries.m)
+}
+
+type blockingQueryHandler struct {
+	release chan struct{}
+}
+
+func (h blockingQueryHandler) OnQuery(origin *Node, payload []byte) []byte {
+	<-h.release
+	return payload
+}
+
+func TestQueryHandlerInBackground(t *testing.T) {
+	c := NewCluster()
+	c.thisHost = &Node{ip: net.IPv4(10, 0, 26, 1), port: 9999}
+
+	handler := blockingQueryHandler{release: make(chan struct{})}
+	c.AddQueryHandler("slow", handler)
+
+	bytes, err := (&query{id: 42, name: "slow"}).encode()
+	require.NoError(t, err)
+
+	// The handler doesn't hold up the receipt of the query.
+	c.receiveQuery(&Broadcast{origin: c.thisHost, bytes: bytes})
+
+	close(handler.release)
+	c.background.Wait()
+}
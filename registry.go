@@ -22,28 +22,10 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 )
 
-// All known nodes, living and dead. Dead nodes are pinged (far) less often,
-// and are eventually removed
-var knownNodes = nodeMap{}
-
-// All nodes that have been updated "recently", living and dead
-var updatedNodes = nodeMap{}
-
-var deadNodeRetries = struct {
-	sync.RWMutex
-	m map[string]*deadNodeCounter
-}{m: make(map[string]*deadNodeCounter)}
-
 const maxDeadNodeRetries = 10
 
-func init() {
-	knownNodes.init()
-	updatedNodes.init()
-}
-
 /******************************************************************************
  * Exported functions (for public consumption)
  *****************************************************************************/
@@ -51,29 +33,31 @@ func init() {
 // AddNode can be used to explicitly add a node to the list of known live
 // nodes. Updates the node timestamp but DOES NOT implicitly update the node's
 // status; you need to do this explicitly.
-func AddNode(node *Node) (*Node, error) {
-	if !knownNodes.contains(node) {
-		if node.status == StatusUnknown {
+func (c *Cluster) AddNode(node *Node) (*Node, error) {
+	if !c.knownNodes.contains(node) {
+		status := node.Status()
+
+		if status == StatusUnknown {
 			logWarn(node.Address(),
 				"does not have a status! Setting to",
 				StatusAlive)
 
-			UpdateNodeStatus(node, StatusAlive, thisHost)
-		} else if node.status == StatusForwardTo {
+			c.UpdateNodeStatus(node, StatusAlive, c.thisHost)
+		} else if status == StatusForwardTo {
 			panic("invalid status: " + StatusForwardTo.String())
 		}
 
 		node.Touch()
 
-		_, n, err := knownNodes.add(node)
+		_, n, err := c.knownNodes.add(node)
 
 		logfInfo("Adding host: %s (total=%d live=%d dead=%d)",
 			node.Address(),
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+			c.knownNodes.length(),
+			c.knownNodes.lengthWithStatus(StatusAlive),
+			c.knownNodes.lengthWithStatus(StatusDead))
 
-		knownNodesModifiedFlag = true
+		c.knownNodesModifiedFlag.Store(true)
 
 		return n, err
 	}
@@ -84,8 +68,8 @@ func AddNode(node *Node) (*Node, error) {
 // CreateNodeByAddress will create and return a new node when supplied with a
 // node address ("ip:port" string). This doesn't add the node to the list of
 // live nodes; use AddNode().
-func CreateNodeByAddress(address string) (*Node, error) {
-	ip, port, err := parseNodeAddress(address)
+func (c *Cluster) CreateNodeByAddress(address string) (*Node, error) {
+	ip, port, err := c.parseNodeAddress(address)
 
 	if err == nil {
 		return CreateNodeByIP(ip, port)
@@ -135,10 +119,10 @@ func GetLocalIP() (net.IP, error) {
 }
 
 // TryGetLocalIP4 try get ipv4 listen address. If v4 address not set, return default listen address.
-func TryGetLocalIPv4() (net.IP, error) {
+func (c *Cluster) TryGetLocalIPv4() (net.IP, error) {
 	var ip net.IP
 
-	iface, err := getListenInterface()
+	iface, err := c.getListenInterface()
 	if err != nil {
 		return nil, err
 	}
@@ -164,14 +148,14 @@ func TryGetLocalIPv4() (net.IP, error) {
 // AllNodes will return a list of all nodes known at the time of the request,
 // including nodes that have been marked as "dead" but haven't yet been
 // removed from the registry.
-func AllNodes() []*Node {
-	return knownNodes.values()
+func (c *Cluster) AllNodes() []*Node {
+	return c.knownNodes.values()
 }
 
 // HealthyNodes will return a list of all nodes known at the time of the
 // request with a healthy status.
-func HealthyNodes() []*Node {
-	values := knownNodes.values()
+func (c *Cluster) HealthyNodes() []*Node {
+	values := c.knownNodes.values()
 	filtered := make([]*Node, 0, len(values))
 
 	for _, v := range values {
@@ -186,19 +170,19 @@ func HealthyNodes() []*Node {
 // RemoveNode can be used to explicitly remove a node from the list of known
 // live nodes. Updates the node timestamp but DOES NOT implicitly update the
 // node's status; you need to do this explicitly.
-func RemoveNode(node *Node) (*Node, error) {
-	if knownNodes.contains(node) {
+func (c *Cluster) RemoveNode(node *Node) (*Node, error) {
+	if c.knownNodes.contains(node) {
 		node.Touch()
 
-		_, n, err := knownNodes.delete(node)
+		_, n, err := c.knownNodes.delete(node)
 
 		logfInfo("Removing host: %s (total=%d live=%d dead=%d)",
 			node.Address(),
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+			c.knownNodes.length(),
+			c.knownNodes.lengthWithStatus(StatusAlive),
+			c.knownNodes.lengthWithStatus(StatusDead))
 
-		knownNodesModifiedFlag = true
+		c.knownNodesModifiedFlag.Store(true)
 
 		return n, err
 	}
@@ -209,24 +193,143 @@ func RemoveNode(node *Node) (*Node, error) {
 // UpdateNodeStatus assigns a new status for the specified node and adds it to
 // the list of recently updated nodes. If the status is StatusDead, then the
 // node will be moved from the live nodes list to the dead nodes list.
-func UpdateNodeStatus(node *Node, status NodeStatus, statusSource *Node) {
-	updateNodeStatus(node, status, node.heartbeat, statusSource)
+func (c *Cluster) UpdateNodeStatus(node *Node, status NodeStatus, statusSource *Node) {
+	c.updateNodeStatus(node, status, node.lastHeartbeat(), statusSource)
 }
 
 /******************************************************************************
  * Private functions (for internal use only)
  *****************************************************************************/
 
-func getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
+// Returns a pointer to the known Node with the given IP and port. If port
+// is 0, it uses the value of GetListenPort(). If the Node cannot be found,
+// this returns nil.
+func (c *Cluster) getKnownNodeByIP(ip net.IP, port uint16) *Node {
+	if port == 0 {
+		port = uint16(c.GetListenPort())
+	}
+
+	return c.knownNodes.getByIP(ip, port)
+}
+
+// Returns the node with the given name and address: the known node with that
+// name, or, failing that, the known node at that address whose name we don't
+// know yet. If there is no such node, a new one is created (but not added).
+//
+// If authoritative is true, the address comes straight from the node itself,
+// and a known node that has moved is updated to its new address.
+func (c *Cluster) resolveNode(name string, ip net.IP, port uint16, authoritative bool) *Node {
+	if port == 0 {
+		port = uint16(c.GetListenPort())
+	}
+
+	if name != "" {
+		if node := c.knownNodes.getByKey(name); node != nil {
+			if authoritative && (!node.IP().Equal(ip) || node.Port() != port) {
+				c.moveNode(node, ip, port)
+			}
+
+			return node
+		}
+	}
+
+	node := c.knownNodes.getByIP(ip, port)
+
+	if node != nil && node.Name() == "" && name != "" {
+		// Now we know what it's called.
+		c.rekeyNode(node, func() { node.name = name })
+	} else if node == nil || (name != "" && node.Name() != name) {
+		// Either we've never heard of it, or the address belonged to some
+		// other node: a new node doesn't inherit the history of another.
+		node, _ = CreateNodeByIP(ip, port)
+		node.name = name
+	}
+
+	return node
+}
+
+// Moves a known node to a new address, and notifies the address listeners.
+func (c *Cluster) moveNode(node *Node, ip net.IP, port uint16) {
+	oldAddress := node.Address()
+
+	c.rekeyNode(node, func() {
+		node.ip = ip
+		node.port = port
+		node.address = ""
+	})
+
+	logfInfo("Host %s moved from %s to %s", node.Name(), oldAddress, node.Address())
+
+	c.doAddressUpdate(node, oldAddress)
+}
+
+// Changes the name or address of node (by calling change) without losing
+// its place in the known and recently updated node maps, or any pending ACKs
+// and suspicions keyed to it.
+func (c *Cluster) rekeyNode(node *Node, change func()) {
+	oldKey := node.key()
+	known := c.knownNodes.getByKey(node.key()) == node
+	updated := c.updatedNodes.getByKey(node.key()) == node
+
+	if known {
+		c.knownNodes.delete(node)
+	}
+
+	if updated {
+		c.updatedNodes.delete(node)
+	}
+
+	node.lock.Lock()
+	change()
+	node.lock.Unlock()
+
+	if known {
+		c.knownNodes.add(node)
+	}
+
+	if updated {
+		c.updatedNodes.add(node)
+	}
+
+	newKey := node.key()
+	if newKey == oldKey {
+		return
+	}
+
+	c.pendingAcks.Lock()
+	for k, pack := range c.pendingAcks.m {
+		if pack.node == node && strings.HasPrefix(k, oldKey+":") {
+			delete(c.pendingAcks.m, k)
+			c.pendingAcks.m[newKey+k[len(oldKey):]] = pack
+		}
+	}
+	c.pendingAcks.Unlock()
+
+	c.suspicions.Lock()
+	if s, ok := c.suspicions.m[oldKey]; ok {
+		delete(c.suspicions.m, oldKey)
+		c.suspicions.m[newKey] = s
+	}
+	c.suspicions.Unlock()
+
+	c.deadNodeRetries.Lock()
+	if dnc, ok := c.deadNodeRetries.m[oldKey]; ok {
+		delete(c.deadNodeRetries.m, oldKey)
+		c.deadNodeRetries.m[newKey] = dnc
+	}
+	c.deadNodeRetries.Unlock()
+}
+
+func (c *Cluster) getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
 	updatedNodesCopy := nodeMap{}
 	updatedNodesCopy.init()
 
 	// Prune nodes with emit counters of 0 (or less) from the map. Any
 	// others we copy into a secondary nodemap.
-	for _, n := range updatedNodes.values() {
-		if n.emitCounter <= 0 {
+	for _, n := range c.updatedNodes.values() {
+		if n.EmitCounter() <= 0 {
 			logDebug("Removing", n.Address(), "from recently updated list")
-			updatedNodes.delete(n)
+			c.updatedNodes.delete(n)
 		} else {
 			updatedNodesCopy.add(n)
 		}
@@ -249,14 +352,14 @@ func getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
 	return updatedNodesSlice[:size]
 }
 
-func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
+func (c *Cluster) parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 	var host string
 	var ip net.IP
 	var port uint16
 	var err error
 
 	ip = net.ParseIP(hostAndMaybePort)
-	port = uint16(GetListenPort())
+	port = uint16(c.GetListenPort())
 
 	host, sport, err := net.SplitHostPort(hostAndMaybePort)
 	if err != nil && strings.Contains(err.Error(), "missing port in address") {
@@ -274,7 +377,7 @@ func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 	} else {
 		err = nil
 		ip = net.ParseIP(hostAndMaybePort)
-		port = uint16(GetListenPort())
+		port = uint16(c.GetListenPort())
 
 		if host == "" {
 			host = hostAndMaybePort
@@ -289,10 +392,10 @@ func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 
 		for _, i := range ips {
 			if !i.IsLoopback() {
-				if GetListenIP().To4() != nil && i.To4() != nil {
+				if c.GetListenIP().To4() != nil && i.To4() != nil {
 					ip = i
 					break
-				} else if GetListenIP().To4() == nil && i.To4() == nil {
+				} else if c.GetListenIP().To4() == nil && i.To4() == nil {
 					ip = i
 					break
 				}
@@ -310,40 +413,55 @@ func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 // UpdateNodeStatus assigns a new status for the specified node and adds it to
 // the list of recently updated nodes. If the status is StatusDead, then the
 // node will be moved from the live nodes list to the dead nodes list.
-func updateNodeStatus(node *Node, status NodeStatus, heartbeat uint32, statusSource *Node) {
-	if node.status != status {
-		if heartbeat < node.heartbeat {
-			logfWarn("Decreasing known node heartbeat value from %d to %d",
-				node.heartbeat,
-				heartbeat)
-		}
+func (c *Cluster) updateNodeStatus(node *Node, status NodeStatus, heartbeat uint32, statusSource *Node) {
+	emitCount := int8(c.emitCount())
 
-		node.timestamp = GetNowInMillis()
-		node.status = status
-		node.statusSource = statusSource
-		node.emitCounter = int8(emitCount())
-		node.heartbeat = heartbeat
+	node.lock.Lock()
 
-		// If this isn't in the recently updated list, add it.
-		if !updatedNodes.contains(node) {
-			updatedNodes.add(node)
-		}
+	if node.status == status {
+		node.lock.Unlock()
+		return
+	}
 
-		if status != StatusDead {
-			deadNodeRetries.Lock()
-			delete(deadNodeRetries.m, node.Address())
-			deadNodeRetries.Unlock()
-		}
+	if heartbeat < node.heartbeat {
+		logfWarn("Decreasing known node heartbeat value from %d to %d",
+			node.heartbeat,
+			heartbeat)
+	}
 
-		logfInfo("Updating host: %s to %s (total=%d live=%d dead=%d)",
-			node.Address(),
-			status,
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+	node.timestamp = GetNowInMillis()
+	node.status = status
+	node.statusSource = statusSource
+	node.emitCounter = emitCount
+	node.heartbeat = heartbeat
+
+	node.lock.Unlock()
 
-		doStatusUpdate(node, status)
+	// If this isn't in the recently updated list, add it.
+	if !c.updatedNodes.contains(node) {
+		c.updatedNodes.add(node)
 	}
+
+	if status == StatusSuspected {
+		c.startSuspicion(node)
+	} else {
+		c.stopSuspicion(node)
+	}
+
+	if status != StatusDead {
+		c.deadNodeRetries.Lock()
+		delete(c.deadNodeRetries.m, node.key())
+		c.deadNodeRetries.Unlock()
+	}
+
+	logfInfo("Updating host: %s to %s (total=%d live=%d dead=%d)",
+		node.Address(),
+		status,
+		c.knownNodes.length(),
+		c.knownNodes.lengthWithStatus(StatusAlive),
+		c.knownNodes.lengthWithStatus(StatusDead))
+
+	c.doStatusUpdate(node, status)
 }
 
 type deadNodeCounter struct {
@@ -364,5 +482,5 @@ func (a byNodeEmitCounter) Swap(i, j int) {
 }
 
 func (a byNodeEmitCounter) Less(i, j int) bool {
-	return a[i].emitCounter > a[j].emitCounter
+	return a[i].EmitCounter() > a[j].EmitCounter()
 }
@@ -26,7 +26,7 @@ import (
 
 func TestAddNode(t *testing.T) {
 	// Start empty
-	require.Empty(t, knownNodes.nodes)
+	require.Empty(t, defaultCluster.knownNodes.nodes)
 
 	n := testNode()
 	n.status = StatusUnknown
@@ -38,13 +38,13 @@ func TestAddNode(t *testing.T) {
 	key := fmt.Sprintf("%s:%d", n.ip.String(), n.port)
 
 	// Also, it adds exactly one node: this one.
-	require.Equal(t, 1, len(knownNodes.values()))
-	require.NotNil(t, knownNodes.nodes[key])
-	require.Equal(t, n, knownNodes.nodes[key])
+	require.Equal(t, 1, len(defaultCluster.knownNodes.values()))
+	require.NotNil(t, defaultCluster.knownNodes.nodes[key])
+	require.Equal(t, n, defaultCluster.knownNodes.nodes[key])
 
 	// Adding again is a no-op
 	AddNode(n)
-	require.Equal(t, 1, len(knownNodes.values()))
+	require.Equal(t, 1, len(defaultCluster.knownNodes.values()))
 
 	t.Log(n.status)
 }
@@ -65,7 +65,7 @@ func TestCreateNodeByAddress(t *testing.T) {
 
 func TestIPv4(t *testing.T) {
 	s := "127.0.0.1"
-	ip, port, err := parseNodeAddress(s)
+	ip, port, err := defaultCluster.parseNodeAddress(s)
 
 	if err != nil {
 		t.Error("Error should be nil but was:", err)
@@ -82,7 +82,7 @@ func TestIPv4(t *testing.T) {
 
 func TestIPv4WithPort(t *testing.T) {
 	s := "127.0.0.1:80"
-	ip, port, err := parseNodeAddress(s)
+	ip, port, err := defaultCluster.parseNodeAddress(s)
 
 	if err != nil {
 		t.Error("Error should be nil but was:", err)
@@ -99,7 +99,7 @@ func TestIPv4WithPort(t *testing.T) {
 
 func TestIPv6(t *testing.T) {
 	s := "fd02:6b8:b010:9020:1::2"
-	ip, port, err := parseNodeAddress(s)
+	ip, port, err := defaultCluster.parseNodeAddress(s)
 
 	if err != nil {
 		t.Error("Error should be nil but was:", err)
@@ -116,7 +116,7 @@ func TestIPv6(t *testing.T) {
 
 func TestIPv6WithPort(t *testing.T) {
 	s := "[fd02:6b8:b010:9020:1::2]:80"
-	ip, port, err := parseNodeAddress(s)
+	ip, port, err := defaultCluster.parseNodeAddress(s)
 
 	if err != nil {
 		t.Error("Error should be nil but was:", err)
@@ -133,7 +133,7 @@ func TestIPv6WithPort(t *testing.T) {
 
 //func TestHostname(t *testing.T) {
 //	s := "localhost"
-//	ip, port, err := parseNodeAddress(s)
+//	ip, port, err := defaultCluster.parseNodeAddress(s)
 //
 //	if err != nil {
 //		t.Error("Error should be nil but was:", err)
@@ -150,7 +150,7 @@ func TestIPv6WithPort(t *testing.T) {
 //
 //func TestHostnameWithPort(t *testing.T) {
 //	s := "localhost:80"
-//	ip, port, err := parseNodeAddress(s)
+//	ip, port, err := defaultCluster.parseNodeAddress(s)
 //
 //	if err != nil {
 //		t.Error("Error should be nil but was:", err)
@@ -169,7 +169,7 @@ func TestIPv6WithPort(t *testing.T) {
 //	SetListenIP(net.ParseIP("fd02:6b8:b010:9020:1::2"))
 //
 //	s := "localhost"
-//	_, _, err := parseNodeAddress(s)
+//	_, _, err := defaultCluster.parseNodeAddress(s)
 //
 //	if err == nil {
 //		t.Error("Error should not have been be nil")
@@ -177,3 +177,60 @@ func TestIPv6WithPort(t *testing.T) {
 //
 //	SetListenIP(net.ParseIP("127.0.0.1"))
 //}
+
+func TestResolveNodeNamesSeed(t *testing.T) {
+	c := NewCluster()
+
+	seed, err := CreateNodeByIP(net.IPv4(10, 9, 8, 7), 1234)
+	require.NoError(t, err)
+	c.AddNode(seed)
+
+	// The seed's first message tells us its name.
+	node := c.resolveNode("seed", net.IPv4(10, 9, 8, 7), 1234, true)
+	require.True(t, node == seed)
+	require.Equal(t, "seed", node.Name())
+	require.True(t, c.knownNodes.getByKey("seed") == seed)
+	require.False(t, c.knownNodes.containsByKey("10.9.8.7:1234"))
+	require.Equal(t, 1, c.knownNodes.length())
+}
+
+func TestResolveNodeMoves(t *testing.T) {
+	c := NewCluster()
+	moves := &collectingAddressListener{}
+	c.AddAddressListener(moves)
+
+	node, err := CreateNodeByIP(net.IPv4(10, 9, 8, 7), 1234)
+	require.NoError(t, err)
+	node.name = "mover"
+	c.AddNode(node)
+
+	// Gossip from other nodes doesn't move a node...
+	resolved := c.resolveNode("mover", net.IPv4(10, 9, 8, 6), 1234, false)
+	require.True(t, resolved == node)
+	require.Equal(t, "10.9.8.7:1234", node.Address())
+	require.Equal(t, 0, moves.count())
+
+	// ...but a message from the node itself does.
+	resolved = c.resolveNode("mover", net.IPv4(10, 9, 8, 6), 1234, true)
+	require.True(t, resolved == node)
+	require.Equal(t, "10.9.8.6:1234", node.Address())
+	require.True(t, c.getKnownNodeByIP(net.IPv4(10, 9, 8, 6), 1234) == node)
+	require.Nil(t, c.getKnownNodeByIP(net.IPv4(10, 9, 8, 7), 1234))
+	require.Equal(t, StatusAlive, node.Status())
+	require.Equal(t, 1, moves.count())
+}
+
+func TestResolveNodeReusedAddress(t *testing.T) {
+	c := NewCluster()
+
+	old, err := CreateNodeByIP(net.IPv4(10, 9, 8, 7), 1234)
+	require.NoError(t, err)
+	old.name = "old"
+	c.AddNode(old)
+
+	// A different node at the same address is a new node.
+	node := c.resolveNode("new", net.IPv4(10, 9, 8, 7), 1234, true)
+	require.False(t, node == old)
+	require.Equal(t, "new", node.Name())
+	require.Equal(t, "old", old.Name())
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// When reliable broadcasts are enabled (see SetBroadcastRetentionMillis),
+// every node keeps the user broadcasts (named, on a topic or neither, and
+// fragments) it sends or receives for a while. Whenever it exchanges state
+// with another node, it follows its membership table with a digest of the
+// labels of the broadcasts it keeps.
+// The other node asks for the ones it hasn't seen, and is sent them along
+// with their age, so that they're kept no longer on the late node than on
+// the others. Broadcasts caught up on this way are delivered, but aren't
+// gossiped any further.
+//
+// Broadcast sync (BSYNC) message payload
+// Byte  00    bsyncDigest, bsyncRequest or bsyncData
+// For bsyncDigest and bsyncRequest, any number of labels:
+// Bytes 00-15 Origin IP (00-03 on IPv4)
+// Bytes 16-17 Origin response port (04-05 on IPv4)
+// Bytes 18-25 Origin epoch (06-13 on IPv4)
+// Bytes 26-29 Origin broadcast counter (14-17 on IPv4)
+// For bsyncData, any number of broadcasts:
+// Bytes 00-03 Age of the broadcast, in milliseconds
+// Bytes 04-NN Broadcast, encoded as in a message (see broadcast.go)
+
+const (
+	bsyncDigest byte = iota
+	bsyncRequest
+	bsyncData
+)
+
+// The most broadcasts that are kept at once. Once there are this many, the
+// oldest makes way for each new one.
+const maxRetainedBroadcasts = 1024
+
+// retainedBroadcast is a broadcast kept for nodes that missed it.
+type retainedBroadcast struct {
+	broadcast *Broadcast
+
+	// When the broadcast was first sent, in milliseconds, as best we know.
+	timestamp uint32
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// broadcastLabel returns the label of the broadcast sent by the node at ip
+// and port with the given epoch and index.
+func broadcastLabel(ip net.IP, port uint16, epoch uint64, index uint32) string {
+	return fmt.Sprintf("%s:%d:%d:%d", ip.String(), port, epoch, index)
+}
+
+// encodeLabel returns the encoded label of a broadcast, which is how it
+// begins once encoded.
+func (b *Broadcast) encodeLabel(ipLen int) []byte {
+	bytes := make([]byte, ipLen+14)
+
+	ip := b.origin.IP()
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+
+	p := copy(bytes, ip[:ipLen])
+	p += encodeUint16(b.origin.Port(), bytes, p)
+	p += encodeUint64(b.epoch, bytes, p)
+	encodeUint32(b.index, bytes, p)
+
+	return bytes
+}
+
+// retainable returns true for the kinds of broadcasts that are kept for nodes
+// that missed them. The others are of no use once they're stale.
+func (k broadcastKind) retainable() bool {
+	return k == broadcastUser || k == broadcastFragment || k == broadcastNamed ||
+		k == broadcastTopic
+}
+
+// retainBroadcast keeps a broadcast, which was first sent age milliseconds
+// ago, if reliable broadcasts are enabled.
+func (c *Cluster) retainBroadcast(broadcast *Broadcast, age uint32) {
+	retention := c.GetBroadcastRetentionMillis()
+	if retention <= 0 || !broadcast.kind.retainable() || age >= uint32(retention) {
+		return
+	}
+
+	label := broadcast.Label()
+
+	c.retained.Lock()
+	defer c.retained.Unlock()
+
+	if _, ok := c.retained.m[label]; ok {
+		return
+	}
+
+	if len(c.retained.m) >= maxRetainedBroadcasts {
+		var oldest string
+		var oldestTimestamp uint32
+
+		now := GetNowInMillis()
+		for l, r := range c.retained.m {
+			if oldest == "" || now-r.timestamp > now-oldestTimestamp {
+				oldest, oldestTimestamp = l, r.timestamp
+			}
+		}
+
+		delete(c.retained.m, oldest)
+	}
+
+	c.retained.m[label] = &retainedBroadcast{
+		broadcast: broadcast,
+		timestamp: GetNowInMillis() - age,
+	}
+}
+
+// isRetained returns true if a broadcast with the given label is kept.
+func (c *Cluster) isRetained(label string) bool {
+	c.retained.Lock()
+	defer c.retained.Unlock()
+
+	_, ok := c.retained.m[label]
+
+	return ok
+}
+
+// pruneRetainedBroadcasts drops the broadcasts that have been kept for
+// longer than GetBroadcastRetentionMillis().
+func (c *Cluster) pruneRetainedBroadcasts() {
+	retention := c.GetBroadcastRetentionMillis()
+	now := GetNowInMillis()
+
+	c.retained.Lock()
+	for label, r := range c.retained.m {
+		if retention <= 0 || now-r.timestamp >= uint32(retention) {
+			delete(c.retained.m, label)
+		}
+	}
+	c.retained.Unlock()
+}
+
+// retainedBroadcasts returns the broadcasts that are kept.
+func (c *Cluster) retainedBroadcasts() []*Broadcast {
+	c.retained.Lock()
+	defer c.retained.Unlock()
+
+	broadcasts := make([]*Broadcast, 0, len(c.retained.m))
+
+	for _, r := range c.retained.m {
+		broadcasts = append(broadcasts, r.broadcast)
+	}
+
+	return broadcasts
+}
+
+// bsyncPayloadMax returns the longest BSYNC payload that fits in a packet.
+func (c *Cluster) bsyncPayloadMax() int {
+	msg := newMessage(verbBroadcastSync, c.thisHost, c.currentHeartbeat.Load())
+
+	return c.maxMessageBytes() - msg.encodedSize(c.ipLen)
+}
+
+// transmitBroadcastDigests offers node the broadcasts that are kept here,
+// split over as many BSYNC messages as needed.
+func (c *Cluster) transmitBroadcastDigests(node *Node) error {
+	if c.GetBroadcastRetentionMillis() <= 0 {
+		return nil
+	}
+
+	broadcasts := c.retainedBroadcasts()
+	if len(broadcasts) == 0 {
+		return nil
+	}
+
+	labelSize := c.ipLen + 14
+	max := c.bsyncPayloadMax()
+
+	payload := []byte{bsyncDigest}
+
+	for i, b := range broadcasts {
+		payload = append(payload, b.encodeLabel(c.ipLen)...)
+
+		if i == len(broadcasts)-1 || len(payload)+labelSize > max {
+			err := c.transmitPayload(node, verbBroadcastSync, payload)
+			if err != nil {
+				return err
+			}
+
+			payload = payload[:1]
+		}
+	}
+
+	logfDebug("Offered %d broadcast(s) to %v", len(broadcasts), node.Address())
+
+	return nil
+}
+
+// receiveVerbBroadcastSync answers an offer of broadcasts with a request for
+// the ones we haven't seen, a request with the broadcasts asked for, and
+// delivers the broadcasts that come in answer to a request.
+func (c *Cluster) receiveVerbBroadcastSync(msg message) error {
+	if c.GetBroadcastRetentionMillis() <= 0 || len(msg.payload) == 0 {
+		return nil
+	}
+
+	switch msg.payload[0] {
+	case bsyncDigest:
+		return c.receiveBroadcastDigest(msg.sender, msg.payload[1:])
+	case bsyncRequest:
+		return c.receiveBroadcastRequest(msg.sender, msg.payload[1:])
+	case bsyncData:
+		return c.receiveBroadcastData(msg.payload[1:])
+	default:
+		return fmt.Errorf("unknown broadcast sync message %d", msg.payload[0])
+	}
+}
+
+// decodeBroadcastLabels reads the labels of a digest or request, and returns
+// them along with their encoded forms.
+func (c *Cluster) decodeBroadcastLabels(bytes []byte) ([]string, [][]byte, error) {
+	labelSize := c.ipLen + 14
+
+	if len(bytes)%labelSize != 0 {
+		return nil, nil, errors.New("broadcast sync labels truncated")
+	}
+
+	var labels []string
+	var encoded [][]byte
+
+	for p := 0; p < len(bytes); p += labelSize {
+		var ip net.IP
+		if c.ipLen == net.IPv6len {
+			ip = make(net.IP, net.IPv6len)
+			copy(ip, bytes[p:p+16])
+		} else {
+			ip = net.IPv4(bytes[p+0], bytes[p+1], bytes[p+2], bytes[p+3])
+		}
+
+		port, q := decodeUint16(bytes, p+c.ipLen)
+		epoch, q := decodeUint64(bytes, q)
+		index, _ := decodeUint32(bytes, q)
+
+		labels = append(labels, broadcastLabel(ip, port, epoch, index))
+		encoded = append(encoded, bytes[p:p+labelSize])
+	}
+
+	return labels, encoded, nil
+}
+
+// receiveBroadcastDigest asks sender for the broadcasts it offers that we
+// haven't seen.
+func (c *Cluster) receiveBroadcastDigest(sender *Node, bytes []byte) error {
+	labels, encoded, err := c.decodeBroadcastLabels(bytes)
+	if err != nil {
+		return err
+	}
+
+	request := []byte{bsyncRequest}
+
+	for i, label := range labels {
+		c.broadcasts.RLock()
+		_, known := c.broadcasts.m[label]
+		c.broadcasts.RUnlock()
+
+		if !known && !c.isRetained(label) {
+			request = append(request, encoded[i]...)
+		}
+	}
+
+	if len(request) == 1 {
+		return nil
+	}
+
+	logfDebug("Asking %v for %d missed broadcast(s)",
+		sender.Address(), (len(request)-1)/(c.ipLen+14))
+
+	// No longer than the digest, so it fits.
+	return c.transmitPayload(sender, verbBroadcastSync, request)
+}
+
+// receiveBroadcastRequest sends sender the broadcasts it asks for, if they're
+// still kept, split over as many BSYNC messages as needed.
+func (c *Cluster) receiveBroadcastRequest(sender *Node, bytes []byte) error {
+	labels, _, err := c.decodeBroadcastLabels(bytes)
+	if err != nil {
+		return err
+	}
+
+	max := c.bsyncPayloadMax()
+	now := GetNowInMillis()
+
+	payload := []byte{bsyncData}
+
+	for _, label := range labels {
+		c.retained.Lock()
+		r, ok := c.retained.m[label]
+		c.retained.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		entry := make([]byte, 4, 4+r.broadcast.encodedSize(c.ipLen))
+		encodeUint32(now-r.timestamp, entry, 0)
+		entry = append(entry, r.broadcast.encode(c.ipLen)...)
+
+		if len(payload)+len(entry) > max && len(payload) > 1 {
+			err := c.transmitPayload(sender, verbBroadcastSync, payload)
+			if err != nil {
+				return err
+			}
+
+			payload = payload[:1]
+		}
+
+		payload = append(payload, entry...)
+	}
+
+	if len(payload) == 1 {
+		return nil
+	}
+
+	return c.transmitPayload(sender, verbBroadcastSync, payload)
+}
+
+// receiveBroadcastData delivers the broadcasts that were sent in answer to
+// our request, and keeps them for as long as the node they came from would
+// have.
+func (c *Cluster) receiveBroadcastData(bytes []byte) error {
+	for p := 0; p < len(bytes); {
+		if p+4 > len(bytes) {
+			return errors.New("broadcast sync data truncated")
+		}
+
+		age, q := decodeUint32(bytes, p)
+
+		broadcast, err := c.decodeBroadcast(bytes[q:])
+		if err != nil {
+			return err
+		}
+
+		p = q + broadcast.encodedSize(c.ipLen)
+
+		// It has already been gossiped; it's only for us.
+		broadcast.emitCounter = 0
+
+		if !c.addReceivedBroadcast(broadcast) {
+			continue
+		}
+
+		logfDebug("Caught up on broadcast [%s], %d ms old", broadcast.Label(), age)
+
+		c.retainBroadcast(broadcast, age)
+		c.handleBroadcast(broadcast)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetainedBroadcasts(t *testing.T) {
+	c := NewCluster()
+	c.thisHost = &Node{ip: net.IPv4(10, 0, 27, 1), port: 9999}
+
+	// Nothing is kept unless reliable broadcasts are enabled.
+	b := c.queueBroadcast(broadcastUser, []byte("lost"))
+	require.False(t, c.isRetained(b.Label()))
+
+	c.SetBroadcastRetentionMillis(10000)
+
+	b = c.queueBroadcast(broadcastUser, []byte("kept"))
+	require.True(t, c.isRetained(b.Label()))
+
+	// Internal broadcasts are of no use once stale.
+	b = c.queueBroadcast(broadcastKeyringOp, []byte("not kept"))
+	require.False(t, c.isRetained(b.Label()))
+
+	// Broadcasts older than the retention aren't kept.
+	b = &Broadcast{origin: c.thisHost, index: 1000, kind: broadcastUser}
+	c.retainBroadcast(b, 10000)
+	require.False(t, c.isRetained(b.Label()))
+
+	// The store is bounded, and the oldest broadcasts make way.
+	oldest := &Broadcast{origin: c.thisHost, index: 2000, kind: broadcastUser}
+	c.retainBroadcast(oldest, 5000)
+
+	for i := 0; i < maxRetainedBroadcasts; i++ {
+		c.retainBroadcast(&Broadcast{origin: c.thisHost, index: uint32(3000 + i), kind: broadcastUser}, 0)
+	}
+
+	require.Len(t, c.retainedBroadcasts(), maxRetainedBroadcasts)
+	require.False(t, c.isRetained(oldest.Label()))
+
+	// Pruning drops the broadcasts kept for too long.
+	c.SetBroadcastRetentionMillis(1)
+	c.retained.Lock()
+	for _, r := range c.retained.m {
+		r.timestamp -= 10
+	}
+	c.retained.Unlock()
+
+	c.pruneRetainedBroadcasts()
+	require.Empty(t, c.retainedBroadcasts())
+}
+
+func TestBroadcastSyncLabels(t *testing.T) {
+	c := NewCluster()
+	origin := &Node{ip: net.IPv4(10, 0, 27, 2), port: 1234}
+
+	b := &Broadcast{origin: origin, index: 42, kind: broadcastUser, bytes: []byte("x")}
+	encoded := b.encode(c.ipLen)[:c.ipLen+14]
+
+	labels, _, err := c.decodeBroadcastLabels(append(encoded, encoded...))
+	require.NoError(t, err)
+	require.Equal(t, []string{b.Label(), b.Label()}, labels)
+
+	_, _, err = c.decodeBroadcastLabels(encoded[:5])
+	require.Error(t, err)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"math"
+)
+
+// The suspicion timeout, before any confirmations, is this many heartbeats
+// (scaled up for larger clusters by log10(node count)).
+const suspicionMult = 4
+
+// With no independent confirmations, a suspicion lasts this many times the
+// minimum suspicion timeout. Each confirmation brings it closer to the
+// minimum.
+const suspicionMaxTimeoutMult = 6
+
+// The most that local health (see localHealth) multiplies timeouts by is
+// maxLocalHealth + 1.
+const maxLocalHealth = 8
+
+// suspicion tracks a node that we suspect of being dead, following Lifeguard
+// (https://arxiv.org/abs/1707.00788). The node is declared dead when the
+// suspicion times out. The timeout starts out long, and shrinks as other
+// nodes independently confirm the suspicion.
+type suspicion struct {
+	// When the suspicion started, in milliseconds.
+	start uint32
+
+	// The number of independent confirmations that bring the timeout down
+	// to min.
+	k int
+
+	// The shortest and longest possible timeout, in milliseconds.
+	min, max uint32
+
+	// The nodes that have confirmed the suspicion, by name. The node that
+	// first reported it doesn't count.
+	confirmations map[string]bool
+}
+
+// timeout returns the current length of the suspicion, in milliseconds.
+func (s *suspicion) timeout() uint32 {
+	if s.k < 1 {
+		return s.min
+	}
+
+	frac := math.Log(float64(len(s.confirmations)+1)) / math.Log(float64(s.k+1))
+	timeout := float64(s.max) - frac*float64(s.max-s.min)
+
+	if timeout < float64(s.min) {
+		return s.min
+	}
+
+	return uint32(timeout)
+}
+
+// expired returns true if the suspicion has lasted longer than its timeout.
+func (s *suspicion) expired() bool {
+	return GetNowInMillis()-s.start >= s.timeout()
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// newSuspicion returns a suspicion with timeouts that suit the current size
+// of the cluster and our own local health.
+func (c *Cluster) newSuspicion() *suspicion {
+	n := c.knownNodes.length()
+
+	nodeScale := math.Log10(float64(n))
+	if nodeScale < 1 {
+		nodeScale = 1
+	}
+
+	min := uint32(suspicionMult * nodeScale * float64(c.GetHeartbeatMillis()) *
+		float64(c.localHealthMultiplier()))
+
+	// We can't expect confirmations from more nodes than those that aren't
+	// either us or the suspect.
+	k := suspicionMult - 2
+	if k > n-2 {
+		k = n - 2
+	}
+
+	return &suspicion{
+		start:         GetNowInMillis(),
+		k:             k,
+		min:           min,
+		max:           min * suspicionMaxTimeoutMult,
+		confirmations: make(map[string]bool),
+	}
+}
+
+// startSuspicion starts the suspicion timer for node, unless it's already
+// running.
+func (c *Cluster) startSuspicion(node *Node) {
+	s := c.newSuspicion()
+
+	c.suspicions.Lock()
+	if _, ok := c.suspicions.m[node.key()]; !ok {
+		c.suspicions.m[node.key()] = s
+	}
+	c.suspicions.Unlock()
+}
+
+// stopSuspicion stops the suspicion timer for node, if there is one.
+func (c *Cluster) stopSuspicion(node *Node) {
+	c.suspicions.Lock()
+	delete(c.suspicions.m, node.key())
+	c.suspicions.Unlock()
+}
+
+// confirmSuspicion notes that source also suspects node, which shortens the
+// suspicion timeout. Confirmations from us and from the node that first
+// reported the suspicion don't count.
+func (c *Cluster) confirmSuspicion(node *Node, source *Node) {
+	if source == nil || source.key() == c.thisHost.key() ||
+		source.key() == node.key() {
+		return
+	}
+
+	if statusSource := node.StatusSource(); statusSource != nil && statusSource.key() == source.key() {
+		return
+	}
+
+	c.suspicions.Lock()
+	if s, ok := c.suspicions.m[node.key()]; ok {
+		s.confirmations[source.key()] = true
+	}
+	c.suspicions.Unlock()
+}
+
+// checkSuspicions declares the nodes whose suspicion has timed out dead.
+func (c *Cluster) checkSuspicions() {
+	expired := make([]string, 0)
+
+	c.suspicions.Lock()
+	for key, s := range c.suspicions.m {
+		if s.expired() {
+			expired = append(expired, key)
+			delete(c.suspicions.m, key)
+		}
+	}
+	c.suspicions.Unlock()
+
+	for _, key := range expired {
+		node := c.knownNodes.getByKey(key)
+		if node == nil || node.Status() != StatusSuspected {
+			continue
+		}
+
+		logDebug(node.Address(), "suspicion timed out")
+
+		c.updateNodeStatus(node, StatusDead, c.currentHeartbeat.Load(), c.thisHost)
+		node.setPingMillis(PingTimedOut)
+	}
+}
+
+// Local health is Lifeguard's measure of how well this node itself is doing.
+// It goes up when our probes go unanswered or when others suspect us, and
+// down when our probes are answered. A node that can't keep up (because it's
+// starved of CPU, say) will miss ACKs from perfectly healthy nodes; an
+// unhealthy node waits proportionately longer before accusing anybody.
+
+// adjustLocalHealth adds delta to the local health score, keeping it within
+// 0 to maxLocalHealth.
+func (c *Cluster) adjustLocalHealth(delta int) {
+	c.localHealth.Lock()
+	defer c.localHealth.Unlock()
+
+	score := c.localHealth.score + delta
+	if score < 0 {
+		score = 0
+	} else if score > maxLocalHealth {
+		score = maxLocalHealth
+	}
+
+	if score != c.localHealth.score {
+		logfDebug("Local health score is now %d", score)
+	}
+
+	c.localHealth.score = score
+}
+
+// localHealthMultiplier returns the factor that timeouts are multiplied by
+// according to our local health: 1 when healthy, up to maxLocalHealth + 1.
+func (c *Cluster) localHealthMultiplier() int {
+	c.localHealth.Lock()
+	defer c.localHealth.Unlock()
+
+	return c.localHealth.score + 1
+}
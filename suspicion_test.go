@@ -0,0 +1,102 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuspicionTimeoutShrinks(t *testing.T) {
+	s := suspicion{k: 2, min: 1000, max: 6000, confirmations: map[string]bool{}}
+	require.Equal(t, uint32(6000), s.timeout())
+
+	s.confirmations["a"] = true
+	one := s.timeout()
+	require.Less(t, one, uint32(6000))
+	require.Greater(t, one, uint32(1000))
+
+	s.confirmations["b"] = true
+	require.Equal(t, uint32(1000), s.timeout())
+
+	s.confirmations["c"] = true
+	require.Equal(t, uint32(1000), s.timeout())
+}
+
+func TestSuspicionConfirmations(t *testing.T) {
+	c, peers := newTestClusterWithPeers(t, 4)
+	suspect := peers[0]
+
+	c.updateNodeStatus(suspect, StatusSuspected, 1, peers[1])
+
+	// The original accuser, us, and the suspect itself don't count.
+	c.confirmSuspicion(suspect, peers[1])
+	c.confirmSuspicion(suspect, c.thisHost)
+	c.confirmSuspicion(suspect, suspect)
+	require.Len(t, c.suspicions.m[suspect.Address()].confirmations, 0)
+
+	c.confirmSuspicion(suspect, peers[2])
+	c.confirmSuspicion(suspect, peers[2])
+	require.Len(t, c.suspicions.m[suspect.Address()].confirmations, 1)
+}
+
+func TestSuspicionExpires(t *testing.T) {
+	c, peers := newTestClusterWithPeers(t, 2)
+	suspect := peers[0]
+
+	c.updateNodeStatus(suspect, StatusSuspected, 1, c.thisHost)
+	require.Contains(t, c.suspicions.m, suspect.Address())
+
+	c.checkSuspicions()
+	require.Equal(t, StatusSuspected, suspect.Status())
+
+	s := c.suspicions.m[suspect.Address()]
+	s.start -= s.max
+
+	c.checkSuspicions()
+	require.Equal(t, StatusDead, suspect.Status())
+	require.NotContains(t, c.suspicions.m, suspect.Address())
+}
+
+func TestSuspicionStopsWhenAlive(t *testing.T) {
+	c, peers := newTestClusterWithPeers(t, 2)
+	suspect := peers[0]
+
+	c.updateNodeStatus(suspect, StatusSuspected, 1, c.thisHost)
+	require.Contains(t, c.suspicions.m, suspect.Address())
+
+	c.updateNodeStatus(suspect, StatusAlive, 2, suspect)
+	require.NotContains(t, c.suspicions.m, suspect.Address())
+}
+
+func TestLocalHealthSlowsSuspicion(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, 2)
+
+	healthy := c.newSuspicion()
+	require.Equal(t, 1, c.localHealthMultiplier())
+
+	c.adjustLocalHealth(3)
+	require.Equal(t, 4, c.localHealthMultiplier())
+	require.Equal(t, healthy.min*4, c.newSuspicion().min)
+
+	c.adjustLocalHealth(100)
+	require.Equal(t, maxLocalHealth+1, c.localHealthMultiplier())
+
+	c.adjustLocalHealth(-100)
+	require.Equal(t, 1, c.localHealthMultiplier())
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A topic broadcast is a user broadcast that carries a topic, so that the
+// libraries sharing a cluster don't have to tell their payloads apart. Every
+// node passes it only to the listeners that subscribed to its topic, and not
+// to the broadcast listeners; nodes with no subscribers to the topic still
+// pass it on, like any other broadcast.
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// BroadcastTopic emits bytes on topic. It is passed to the listeners that
+// subscribed to topic (see SubscribeTopic) on every node that receives it,
+// and to no others. The topic (1 to 255 bytes) and bytes must fit in a single
+// broadcast, as topic broadcasts aren't fragmented. The returned handle tells
+// when the broadcast has been spread (see BroadcastHandle).
+func (c *Cluster) BroadcastTopic(topic string, bytes []byte) (*BroadcastHandle, error) {
+	if topic == "" || len(topic) > 0xFF {
+		return nil, errors.New("broadcast topic must be 1 to 255 bytes long")
+	}
+
+	if 1+len(topic)+len(bytes) > c.GetMaxBroadcastBytes() {
+		return nil, fmt.Errorf("topic broadcast length exceeds %d bytes", c.GetMaxBroadcastBytes())
+	}
+
+	handle := c.newBroadcastHandle()
+
+	c.enqueueBroadcast(&Broadcast{
+		bytes:  bytes,
+		kind:   broadcastTopic,
+		topic:  topic,
+		handle: handle})
+
+	handle.start()
+
+	return handle, nil
+}
+
+// SubscribeTopic registers a listener whose OnBroadcast() function is called
+// whenever this node receives a broadcast on topic (see BroadcastTopic).
+// Broadcast listeners added with AddBroadcastListener() aren't passed topic
+// broadcasts.
+func (c *Cluster) SubscribeTopic(topic string, listener BroadcastListener) {
+	c.topicListeners.Lock()
+	c.topicListeners.m[topic] = append(c.topicListeners.m[topic], listener)
+	c.topicListeners.Unlock()
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// receiveTopicBroadcast passes a topic broadcast to the subscribers of its
+// topic, if there are any.
+func (c *Cluster) receiveTopicBroadcast(broadcast *Broadcast) {
+	c.topicListeners.RLock()
+	defer c.topicListeners.RUnlock()
+
+	listeners := c.topicListeners.m[broadcast.Topic()]
+	if len(listeners) == 0 {
+		logfDebug("Broadcast [%s] on topic %s has no subscribers",
+			broadcast.Label(),
+			broadcast.Topic())
+
+		return
+	}
+
+	logfInfo("Broadcast [%s] on topic %s=%s",
+		broadcast.Label(),
+		broadcast.Topic(),
+		string(broadcast.Bytes()))
+
+	for _, l := range listeners {
+		l.OnBroadcast(broadcast)
+	}
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+)
+
+// InboxSize is the number of undelivered packets a listening connection will
+// hold before further packets are dropped, mirroring a full UDP socket buffer.
+const InboxSize = 1024
+
+// Packet is a single datagram travelling through the in-memory network.
+type Packet struct {
+	From *MemAddr
+	Data []byte
+}
+
+// ListenConn is the receiving end of an in-memory "socket".
+type ListenConn struct {
+	laddr     *MemAddr
+	inbox     chan Packet
+	closeChan chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func NewListenConn(laddr *MemAddr, onClose func()) *ListenConn {
+	return &ListenConn{
+		laddr:     laddr,
+		inbox:     make(chan Packet, InboxSize),
+		closeChan: make(chan struct{}),
+		onClose:   onClose,
+	}
+}
+
+// Deliver enqueues a packet for ReadFrom. It returns false if the packet was
+// dropped because the connection is closed or its inbox is full.
+func (lc *ListenConn) Deliver(p Packet) bool {
+	select {
+	case <-lc.closeChan:
+		return false
+	default:
+	}
+
+	select {
+	case lc.inbox <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+func (lc *ListenConn) ReadFrom(b []byte) (n int, addr transport.SockAddr, error error) {
+	select {
+	case p := <-lc.inbox:
+		return copy(b, p.Data), p.From, nil
+	case <-lc.closeChan:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// Read reads data from the connection.
+func (lc *ListenConn) Read(b []byte) (n int, err error) {
+	n, _, err = lc.ReadFrom(b)
+
+	return n, err
+}
+
+// Write is not supported on a listening connection; dial the peer instead.
+func (lc *ListenConn) Write(b []byte) (n int, err error) {
+	return 0, net.ErrWriteToConnected
+}
+
+// Close unregisters the connection from its network and unblocks any pending
+// ReadFrom.
+func (lc *ListenConn) Close() error {
+	lc.closeOnce.Do(func() {
+		close(lc.closeChan)
+
+		if lc.onClose != nil {
+			lc.onClose()
+		}
+	})
+
+	return nil
+}
+
+// LocalAddr returns the local network address, if known.
+func (lc *ListenConn) LocalAddr() net.Addr {
+	return lc.laddr
+}
+
+// RemoteAddr returns the remote network address, if known.
+func (lc *ListenConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (lc *ListenConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (lc *ListenConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (lc *ListenConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// DialConn is the sending end of an in-memory "socket". Every Write is handed
+// to send as a single datagram.
+type DialConn struct {
+	laddr *MemAddr
+	raddr *MemAddr
+	send  func(from, to *MemAddr, b []byte)
+}
+
+func NewDialConn(laddr, raddr *MemAddr, send func(from, to *MemAddr, b []byte)) *DialConn {
+	return &DialConn{
+		laddr: laddr,
+		raddr: raddr,
+		send:  send,
+	}
+}
+
+func (dc *DialConn) ReadFrom(b []byte) (n int, addr transport.SockAddr, error error) {
+	return 0, nil, net.ErrClosed
+}
+
+// Read is not supported; replies arrive on the peer's listening connection.
+func (dc *DialConn) Read(b []byte) (n int, err error) {
+	return 0, net.ErrClosed
+}
+
+// Write sends b to the remote address. Like UDP, delivery is not guaranteed
+// and no error is reported for lost packets.
+func (dc *DialConn) Write(b []byte) (n int, err error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	dc.send(dc.laddr, dc.raddr, data)
+
+	return len(b), nil
+}
+
+func (dc *DialConn) Close() error {
+	return nil
+}
+
+// LocalAddr returns the local network address, if known.
+func (dc *DialConn) LocalAddr() net.Addr {
+	return dc.laddr
+}
+
+// RemoteAddr returns the remote network address, if known.
+func (dc *DialConn) RemoteAddr() net.Addr {
+	return dc.raddr
+}
+
+func (dc *DialConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *DialConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *DialConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"net"
+	"strconv"
+)
+
+type MemAddr struct {
+	IP   net.IP
+	Port int
+}
+
+func (ma *MemAddr) GetIPAddr() net.IP {
+	return ma.IP
+}
+
+func (ma *MemAddr) GetPort() int {
+	return ma.Port
+}
+
+func (ma *MemAddr) GetZone() string {
+	return ""
+}
+
+func (ma *MemAddr) Network() string {
+	return "mem"
+}
+
+func (ma *MemAddr) String() string {
+	host := ""
+	if ma.IP != nil {
+		host = ma.IP.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(ma.Port))
+}
@@ -0,0 +1,103 @@
+package memtransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+	"github.com/andyollylarkin/smudge-custom-transport/transport/memtransport/internal"
+)
+
+var errAddrInUse = errors.New("address already in use")
+
+// MemTransport is a transport.Transport that sends packets through an
+// in-process Network instead of real sockets. Create one per simulated host
+// with Network.NewTransport.
+type MemTransport struct {
+	network    *Network
+	ip         net.IP
+	mu         sync.Mutex
+	listenPort int
+}
+
+// IP returns the address that this transport's traffic originates from.
+func (mt *MemTransport) IP() net.IP {
+	return mt.ip
+}
+
+// Listen binds the transport's IP and the port of addr. The IP of addr is
+// ignored, so ":port" style addresses work as they would with UDP.
+func (mt *MemTransport) Listen(network string, addr transport.SockAddr) (transport.GenericConn, error) {
+	laddr := &internal.MemAddr{IP: mt.ip, Port: addr.GetPort()}
+
+	lc, err := mt.network.listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mt.mu.Lock()
+	mt.listenPort = laddr.Port
+	mt.mu.Unlock()
+
+	return lc, nil
+}
+
+// Dial returns a connection to raddr. If laddr is nil, packets appear to
+// come from this transport's IP and listen port.
+func (mt *MemTransport) Dial(ctx context.Context, laddr transport.SockAddr,
+	raddr transport.SockAddr,
+) (transport.GenericConn, error) {
+	if raddr == nil {
+		return nil, fmt.Errorf("invalid addr format for raddr. should be host:port, or host. Given nil")
+	}
+
+	from := &internal.MemAddr{IP: mt.ip}
+
+	if laddr != nil {
+		from.Port = laddr.GetPort()
+	} else {
+		mt.mu.Lock()
+		from.Port = mt.listenPort
+		mt.mu.Unlock()
+	}
+
+	to := &internal.MemAddr{IP: raddr.GetIPAddr(), Port: raddr.GetPort()}
+
+	return internal.NewDialConn(from, to, mt.network.send), nil
+}
+
+func (mt *MemTransport) ResolveAddr(network string, addr string) (transport.SockAddr, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in address %s: %w", addr, err)
+	}
+
+	var ip net.IP
+
+	if host != "" {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP in address %s", addr)
+		}
+	}
+
+	return &internal.MemAddr{IP: ip, Port: int(port)}, nil
+}
+
+func (mt *MemTransport) AllowMulticast() bool {
+	return false
+}
+
+// Return network, udp, websockets, tcp, ipv4, etc.
+func (mt *MemTransport) Network() string {
+	return "mem"
+}
@@ -0,0 +1,169 @@
+package memtransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	ipA = net.IPv4(10, 0, 0, 1)
+	ipB = net.IPv4(10, 0, 0, 2)
+)
+
+func listenOn(t *testing.T, mt *MemTransport, port string) transport.GenericConn {
+	addr, err := mt.ResolveAddr(mt.Network(), ":"+port)
+	require.NoError(t, err)
+
+	c, err := mt.Listen(mt.Network(), addr)
+	require.NoError(t, err)
+
+	return c
+}
+
+func send(t *testing.T, mt *MemTransport, to string, payload string) {
+	raddr, err := mt.ResolveAddr(mt.Network(), to)
+	require.NoError(t, err)
+
+	c, err := mt.Dial(context.Background(), nil, raddr)
+	require.NoError(t, err)
+
+	_, err = c.Write([]byte(payload))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+}
+
+type received struct {
+	data string
+	from transport.SockAddr
+}
+
+// inbox reads from c in the background until it is closed.
+func inbox(c transport.GenericConn) <-chan received {
+	ch := make(chan received, 16)
+
+	go func() {
+		buf := make([]byte, 64)
+
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			ch <- received{string(buf[:n]), from}
+		}
+	}()
+
+	return ch
+}
+
+// receive returns the next payload, or "" if nothing arrives within wait.
+func receive(ch <-chan received, wait time.Duration) (string, transport.SockAddr) {
+	select {
+	case r := <-ch:
+		return r.data, r.from
+	case <-time.After(wait):
+		return "", nil
+	}
+}
+
+func TestMemTransport_Deliver(t *testing.T) {
+	nw := NewNetwork()
+	a, b := nw.NewTransport(ipA), nw.NewTransport(ipB)
+
+	ca := listenOn(t, a, "9999")
+	defer ca.Close()
+	cb := listenOn(t, b, "9999")
+	defer cb.Close()
+	rb := inbox(cb)
+
+	send(t, a, "10.0.0.2:9999", "hello")
+
+	data, from := receive(rb, time.Second)
+	require.Equal(t, "hello", data)
+	require.True(t, from.GetIPAddr().Equal(ipA))
+	require.Equal(t, 9999, from.GetPort())
+}
+
+func TestMemTransport_AddrInUse(t *testing.T) {
+	nw := NewNetwork()
+	a := nw.NewTransport(ipA)
+
+	c := listenOn(t, a, "9999")
+
+	addr, _ := a.ResolveAddr(a.Network(), ":9999")
+	_, err := a.Listen(a.Network(), addr)
+	require.Error(t, err)
+
+	// Closing releases the address.
+	require.NoError(t, c.Close())
+	listenOn(t, a, "9999").Close()
+}
+
+func TestMemTransport_LossAndDuplicate(t *testing.T) {
+	nw := NewNetwork()
+	nw.SetSeed(1)
+	a, b := nw.NewTransport(ipA), nw.NewTransport(ipB)
+
+	cb := listenOn(t, b, "9999")
+	defer cb.Close()
+	rb := inbox(cb)
+
+	nw.SetLink(ipA, ipB, LinkConfig{Loss: 1})
+	send(t, a, "10.0.0.2:9999", "lost")
+
+	data, _ := receive(rb, time.Millisecond*50)
+	require.Empty(t, data)
+
+	nw.SetLink(ipA, ipB, LinkConfig{Duplicate: 1})
+	send(t, a, "10.0.0.2:9999", "twice")
+
+	data, _ = receive(rb, time.Second)
+	require.Equal(t, "twice", data)
+	data, _ = receive(rb, time.Second)
+	require.Equal(t, "twice", data)
+}
+
+func TestMemTransport_Latency(t *testing.T) {
+	nw := NewNetwork()
+	a, b := nw.NewTransport(ipA), nw.NewTransport(ipB)
+
+	cb := listenOn(t, b, "9999")
+	defer cb.Close()
+	rb := inbox(cb)
+
+	nw.SetDefaultLink(LinkConfig{Latency: time.Millisecond * 100})
+
+	start := time.Now()
+	send(t, a, "10.0.0.2:9999", "slow")
+
+	data, _ := receive(rb, time.Second)
+	require.Equal(t, "slow", data)
+	require.GreaterOrEqual(t, time.Since(start), time.Millisecond*100)
+}
+
+func TestMemTransport_Partition(t *testing.T) {
+	nw := NewNetwork()
+	a, b := nw.NewTransport(ipA), nw.NewTransport(ipB)
+
+	cb := listenOn(t, b, "9999")
+	defer cb.Close()
+	rb := inbox(cb)
+
+	nw.Partition("split", []net.IP{ipA}, []net.IP{ipB})
+	send(t, a, "10.0.0.2:9999", "blocked")
+
+	data, _ := receive(rb, time.Millisecond*50)
+	require.Empty(t, data)
+
+	nw.Heal("split")
+	send(t, a, "10.0.0.2:9999", "healed")
+
+	data, _ = receive(rb, time.Second)
+	require.Equal(t, "healed", data)
+}
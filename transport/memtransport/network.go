@@ -0,0 +1,247 @@
+package memtransport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport/memtransport/internal"
+)
+
+// LinkConfig describes the simulated conditions of a link between two hosts.
+type LinkConfig struct {
+	// Latency is the fixed delay added to every packet.
+	Latency time.Duration
+
+	// Jitter is the upper bound of a random delay added on top of Latency.
+	Jitter time.Duration
+
+	// Loss is the probability (0.0 to 1.0) that a packet is dropped.
+	Loss float64
+
+	// Duplicate is the probability (0.0 to 1.0) that a packet is delivered
+	// twice.
+	Duplicate float64
+}
+
+type link struct {
+	from string
+	to   string
+}
+
+// Network is an in-process stand-in for a real network. Every Transport
+// created from the same Network can reach every other one, subject to the
+// per-link conditions and partitions configured on it. All methods are safe
+// to call while traffic is flowing.
+type Network struct {
+	mu          sync.RWMutex
+	listeners   map[string]*internal.ListenConn
+	links       map[link]LinkConfig
+	defaultLink LinkConfig
+	partitions  map[string][]map[string]struct{}
+	rand        *rand.Rand
+	randMu      sync.Mutex
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		listeners:  make(map[string]*internal.ListenConn),
+		links:      make(map[link]LinkConfig),
+		partitions: make(map[string][]map[string]struct{}),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// NewTransport returns a Transport whose traffic originates from ip.
+func (n *Network) NewTransport(ip net.IP) *MemTransport {
+	return &MemTransport{
+		network: n,
+		ip:      ip,
+	}
+}
+
+// SetSeed reseeds the random source used for loss, duplication and jitter,
+// making a simulation repeatable.
+func (n *Network) SetSeed(seed int64) {
+	n.randMu.Lock()
+	n.rand = rand.New(rand.NewSource(seed))
+	n.randMu.Unlock()
+}
+
+// SetDefaultLink sets the conditions used by every link that has not been
+// configured explicitly with SetLink.
+func (n *Network) SetDefaultLink(cfg LinkConfig) {
+	n.mu.Lock()
+	n.defaultLink = cfg
+	n.mu.Unlock()
+}
+
+// SetLink sets the conditions for packets sent from the host with IP from to
+// the host with IP to. Links are directional; call it twice for a symmetric
+// link.
+func (n *Network) SetLink(from, to net.IP, cfg LinkConfig) {
+	n.mu.Lock()
+	n.links[link{from: from.String(), to: to.String()}] = cfg
+	n.mu.Unlock()
+}
+
+// ResetLink reverts the link from -> to to the default link conditions.
+func (n *Network) ResetLink(from, to net.IP) {
+	n.mu.Lock()
+	delete(n.links, link{from: from.String(), to: to.String()})
+	n.mu.Unlock()
+}
+
+// Partition installs a named partition. Hosts in different groups can't
+// reach each other until the partition is healed; hosts that aren't listed in
+// any group are unaffected. Installing a partition with an existing name
+// replaces it.
+func (n *Network) Partition(name string, groups ...[]net.IP) {
+	sets := make([]map[string]struct{}, len(groups))
+
+	for i, g := range groups {
+		sets[i] = make(map[string]struct{}, len(g))
+
+		for _, ip := range g {
+			sets[i][ip.String()] = struct{}{}
+		}
+	}
+
+	n.mu.Lock()
+	n.partitions[name] = sets
+	n.mu.Unlock()
+}
+
+// Heal removes the named partition.
+func (n *Network) Heal(name string) {
+	n.mu.Lock()
+	delete(n.partitions, name)
+	n.mu.Unlock()
+}
+
+// HealAll removes every partition.
+func (n *Network) HealAll() {
+	n.mu.Lock()
+	n.partitions = make(map[string][]map[string]struct{})
+	n.mu.Unlock()
+}
+
+func (n *Network) listen(laddr *internal.MemAddr) (*internal.ListenConn, error) {
+	key := laddr.String()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[key]; ok {
+		return nil, &net.OpError{Op: "listen", Net: laddr.Network(), Addr: laddr, Err: errAddrInUse}
+	}
+
+	var lc *internal.ListenConn
+
+	lc = internal.NewListenConn(laddr, func() {
+		n.mu.Lock()
+		if n.listeners[key] == lc {
+			delete(n.listeners, key)
+		}
+		n.mu.Unlock()
+	})
+
+	n.listeners[key] = lc
+
+	return lc, nil
+}
+
+// send routes a single packet, applying partitions and link conditions.
+// Undeliverable packets are silently dropped, as they would be on UDP.
+func (n *Network) send(from, to *internal.MemAddr, b []byte) {
+	n.mu.RLock()
+
+	if n.partitioned(from.IP.String(), to.IP.String()) {
+		n.mu.RUnlock()
+		return
+	}
+
+	cfg, ok := n.links[link{from: from.IP.String(), to: to.IP.String()}]
+	if !ok {
+		cfg = n.defaultLink
+	}
+
+	n.mu.RUnlock()
+
+	if n.chance(cfg.Loss) {
+		return
+	}
+
+	copies := 1
+	if n.chance(cfg.Duplicate) {
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		delay := cfg.Latency + n.jitter(cfg.Jitter)
+		p := internal.Packet{From: from, Data: b}
+
+		if delay <= 0 {
+			n.deliver(to, p)
+		} else {
+			time.AfterFunc(delay, func() { n.deliver(to, p) })
+		}
+	}
+}
+
+func (n *Network) deliver(to *internal.MemAddr, p internal.Packet) {
+	n.mu.RLock()
+	lc, ok := n.listeners[to.String()]
+	n.mu.RUnlock()
+
+	if ok {
+		lc.Deliver(p)
+	}
+}
+
+// partitioned reports whether an active partition separates the two hosts.
+// Must be called with n.mu held.
+func (n *Network) partitioned(from, to string) bool {
+	for _, groups := range n.partitions {
+		fromGroup, toGroup := -1, -1
+
+		for i, g := range groups {
+			if _, ok := g[from]; ok {
+				fromGroup = i
+			}
+
+			if _, ok := g[to]; ok {
+				toGroup = i
+			}
+		}
+
+		if fromGroup >= 0 && toGroup >= 0 && fromGroup != toGroup {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Network) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	n.randMu.Lock()
+	defer n.randMu.Unlock()
+
+	return n.rand.Float64() < p
+}
+
+func (n *Network) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	n.randMu.Lock()
+	defer n.randMu.Unlock()
+
+	return time.Duration(n.rand.Int63n(int64(max)))
+}
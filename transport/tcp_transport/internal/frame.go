@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize is the largest frame payload that will be accepted from a
+// peer. Anything larger is treated as a corrupt stream.
+const MaxFrameSize = 1 << 20
+
+// frameHeaderSize is the size of the big-endian length prefix that precedes
+// every frame on the wire.
+const frameHeaderSize = 4
+
+// ReadFrame reads a single length-prefixed frame from r.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame size %d exceeds maximum of %d bytes", size, MaxFrameSize)
+	}
+
+	payload := make([]byte, size)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// WriteFrame writes b to w as a single length-prefixed frame.
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxFrameSize {
+		return fmt.Errorf("frame size %d exceeds maximum of %d bytes", len(b), MaxFrameSize)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[frameHeaderSize:], b)
+
+	_, err := w.Write(frame)
+
+	return err
+}
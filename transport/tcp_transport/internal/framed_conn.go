@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+)
+
+// FramedConn adapter around a persistent TCP connection that sends and
+// receives length-prefixed frames, so that every Write is delivered to the
+// peer as exactly one message.
+type FramedConn struct {
+	UnderlyingConn net.Conn
+	mu             sync.Mutex
+	onError        func(*FramedConn)
+}
+
+// NewFramedConn wraps conn. onError, if not nil, is called once a read or
+// write fails so that the owner can evict the connection from its pool.
+func NewFramedConn(conn net.Conn, onError func(*FramedConn)) *FramedConn {
+	return &FramedConn{
+		UnderlyingConn: conn,
+		onError:        onError,
+	}
+}
+
+func (fc *FramedConn) ReadFrom(b []byte) (n int, addr transport.SockAddr, err error) {
+	n, err = fc.Read(b)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tcpAddr, ok := fc.UnderlyingConn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, nil, fmt.Errorf("cant resolve tcp addr. RemoteAddr() socket is not TCP Addr")
+	}
+
+	return n, &TCPAddr{Taddr: tcpAddr}, nil
+}
+
+// Read reads a single frame from the connection. If the frame is larger than
+// b, the remainder of the frame is discarded.
+func (fc *FramedConn) Read(b []byte) (n int, err error) {
+	frame, err := ReadFrame(fc.UnderlyingConn)
+	if err != nil {
+		fc.fail()
+
+		return 0, err
+	}
+
+	return copy(b, frame), nil
+}
+
+// Write writes b to the connection as a single frame.
+func (fc *FramedConn) Write(b []byte) (n int, err error) {
+	fc.mu.Lock()
+	err = WriteFrame(fc.UnderlyingConn, b)
+	fc.mu.Unlock()
+
+	if err != nil {
+		fc.fail()
+
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close closes the connection.
+// **NOTICE** this function do nothing, because we don't want the connection to be closed after every data transfer.
+func (fc *FramedConn) Close() error {
+	return nil
+}
+
+// ActuallyClose actually closes the underlying TCP connection.
+func (fc *FramedConn) ActuallyClose() error {
+	return fc.UnderlyingConn.Close()
+}
+
+// LocalAddr returns the local network address, if known.
+func (fc *FramedConn) LocalAddr() net.Addr {
+	return fc.UnderlyingConn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address, if known.
+func (fc *FramedConn) RemoteAddr() net.Addr {
+	return fc.UnderlyingConn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated
+// with the connection. It is equivalent to calling both
+// SetReadDeadline and SetWriteDeadline.
+func (fc *FramedConn) SetDeadline(t time.Time) error {
+	return fc.UnderlyingConn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls
+// and any currently-blocked Read call.
+// A zero value for t means Read will not time out.
+func (fc *FramedConn) SetReadDeadline(t time.Time) error {
+	return fc.UnderlyingConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future Write calls
+// and any currently-blocked Write call.
+// A zero value for t means Write will not time out.
+func (fc *FramedConn) SetWriteDeadline(t time.Time) error {
+	return fc.UnderlyingConn.SetWriteDeadline(t)
+}
+
+func (fc *FramedConn) fail() {
+	if fc.onError != nil {
+		fc.onError(fc)
+	}
+}
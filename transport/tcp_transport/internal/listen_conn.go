@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+)
+
+type readData struct {
+	readedFrom transport.SockAddr
+	data       []byte
+}
+
+// ListenConn accepts inbound TCP connections and multiplexes the frames read
+// from all of them into a single packet-like ReadFrom stream.
+type ListenConn struct {
+	listener  *net.TCPListener
+	dataChan  chan readData
+	closeChan chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{}
+}
+
+func NewListenConn(listener *net.TCPListener) *ListenConn {
+	lc := &ListenConn{
+		listener:  listener,
+		dataChan:  make(chan readData),
+		closeChan: make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	lc.wg.Add(1)
+	go lc.acceptLoop()
+
+	return lc
+}
+
+func (lc *ListenConn) acceptLoop() {
+	defer lc.wg.Done()
+
+	for {
+		conn, err := lc.listener.Accept()
+		if err != nil {
+			select {
+			case <-lc.closeChan:
+				return
+			default:
+			}
+
+			// Temporary accept errors (e.g. too many open files); back off
+			// briefly rather than spinning.
+			time.Sleep(time.Millisecond * 10)
+
+			continue
+		}
+
+		lc.mu.Lock()
+		lc.conns[conn] = struct{}{}
+		lc.mu.Unlock()
+
+		lc.wg.Add(1)
+		go lc.handleRead(conn)
+	}
+}
+
+func (lc *ListenConn) handleRead(conn net.Conn) {
+	defer lc.wg.Done()
+
+	defer func() {
+		lc.mu.Lock()
+		delete(lc.conns, conn)
+		lc.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	from := &TCPAddr{Taddr: tcpAddr}
+
+	for {
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+
+		select {
+		case lc.dataChan <- readData{readedFrom: from, data: frame}:
+		case <-lc.closeChan:
+			return
+		}
+	}
+}
+
+// ReadFrom returns the next frame received on any accepted connection,
+// together with the address of the peer that sent it.
+func (lc *ListenConn) ReadFrom(b []byte) (n int, addr transport.SockAddr, error error) {
+	select {
+	case data := <-lc.dataChan:
+		return copy(b, data.data), data.readedFrom, nil
+	case <-lc.closeChan:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// Read reads data from the connection.
+func (lc *ListenConn) Read(b []byte) (n int, err error) {
+	n, _, err = lc.ReadFrom(b)
+
+	return n, err
+}
+
+// Write is not supported on a listening connection; dial the peer instead.
+func (lc *ListenConn) Write(b []byte) (n int, err error) {
+	return 0, net.ErrWriteToConnected
+}
+
+// Close stops accepting connections, closes every accepted connection and
+// unblocks any pending ReadFrom.
+func (lc *ListenConn) Close() error {
+	var err error
+
+	lc.closeOnce.Do(func() {
+		close(lc.closeChan)
+
+		err = lc.listener.Close()
+
+		lc.mu.Lock()
+		for conn := range lc.conns {
+			conn.Close()
+		}
+		lc.mu.Unlock()
+
+		lc.wg.Wait()
+	})
+
+	return err
+}
+
+// LocalAddr returns the local network address, if known.
+func (lc *ListenConn) LocalAddr() net.Addr {
+	return lc.listener.Addr()
+}
+
+// RemoteAddr returns the remote network address, if known.
+func (lc *ListenConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline is a no-op; deadlines are managed per accepted connection.
+func (lc *ListenConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op; deadlines are managed per accepted connection.
+func (lc *ListenConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op; deadlines are managed per accepted connection.
+func (lc *ListenConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
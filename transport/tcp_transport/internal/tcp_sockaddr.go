@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"net"
+	"net/netip"
+)
+
+type TCPAddr struct {
+	Taddr *net.TCPAddr
+}
+
+func (ta *TCPAddr) GetIPAddr() net.IP {
+	return ta.Taddr.IP
+}
+
+func (ta *TCPAddr) GetPort() int {
+	return ta.Taddr.Port
+}
+
+func (ta *TCPAddr) GetZone() string {
+	return ta.Taddr.Zone
+}
+
+func (ta *TCPAddr) AddrPort() netip.AddrPort {
+	return ta.Taddr.AddrPort()
+}
+
+func (ta *TCPAddr) Network() string {
+	return ta.Taddr.Network()
+}
+
+func (ta *TCPAddr) String() string {
+	return ta.Taddr.String()
+}
@@ -0,0 +1,159 @@
+package tcptransport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/andyollylarkin/smudge-custom-transport/transport"
+	"github.com/andyollylarkin/smudge-custom-transport/transport/tcp_transport/internal"
+)
+
+// TCPTransport carries gossip messages over persistent, per-peer TCP
+// connections. Each message is sent as a single length-prefixed frame, so the
+// membership layer sees the same packet semantics it gets from UDP.
+type TCPTransport struct {
+	mu    sync.Mutex
+	conns map[string]*internal.FramedConn
+}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{
+		conns: make(map[string]*internal.FramedConn),
+	}
+}
+
+func (tt *TCPTransport) Listen(network string, addr transport.SockAddr) (transport.GenericConn, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.NewListenConn(listener), nil
+}
+
+// Dial returns the pooled connection to raddr, establishing it first if
+// necessary. Calling Close on the returned connection keeps it open for
+// reuse; a connection is only torn down once a read or write on it fails.
+func (tt *TCPTransport) Dial(ctx context.Context, laddr transport.SockAddr,
+	raddr transport.SockAddr,
+) (transport.GenericConn, error) {
+	if raddr == nil {
+		return nil, fmt.Errorf("invalid addr format for raddr. should be host:port, or host. Given nil")
+	}
+
+	key := raddr.String()
+
+	tt.mu.Lock()
+	c, ok := tt.getConns()[key]
+	tt.mu.Unlock()
+
+	if ok {
+		return c, nil
+	}
+
+	dialer := net.Dialer{}
+
+	if laddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{
+			IP:   laddr.GetIPAddr(),
+			Port: laddr.GetPort(),
+			Zone: laddr.GetZone(),
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", key)
+	if err != nil {
+		return nil, err
+	}
+
+	c = internal.NewFramedConn(conn, func(fc *internal.FramedConn) {
+		tt.evict(key, fc)
+	})
+
+	tt.mu.Lock()
+	if existing, ok := tt.getConns()[key]; ok {
+		// Somebody else won the race; use their connection.
+		tt.mu.Unlock()
+		conn.Close()
+
+		return existing, nil
+	}
+	tt.conns[key] = c
+	tt.mu.Unlock()
+
+	// Peers never write on a connection that we dialed, so reading from it
+	// only serves to notice when the remote end goes away.
+	go tt.drain(c)
+
+	return c, nil
+}
+
+// Close closes every pooled outbound connection.
+func (tt *TCPTransport) Close() error {
+	tt.mu.Lock()
+	conns := tt.conns
+	tt.conns = make(map[string]*internal.FramedConn)
+	tt.mu.Unlock()
+
+	for _, c := range conns {
+		c.ActuallyClose()
+	}
+
+	return nil
+}
+
+func (tt *TCPTransport) ResolveAddr(network string, addr string) (transport.SockAddr, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &internal.TCPAddr{Taddr: tcpAddr}, nil
+}
+
+func (tt *TCPTransport) AllowMulticast() bool {
+	return false
+}
+
+// Return network, udp, websockets, tcp, ipv4, etc.
+func (tt *TCPTransport) Network() string {
+	return "tcp"
+}
+
+func (tt *TCPTransport) drain(c *internal.FramedConn) {
+	buf := make([]byte, 1)
+
+	for {
+		_, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (tt *TCPTransport) evict(key string, c *internal.FramedConn) {
+	tt.mu.Lock()
+	if tt.conns[key] == c {
+		delete(tt.conns, key)
+	}
+	tt.mu.Unlock()
+
+	c.ActuallyClose()
+}
+
+// getConns lazily initializes the pool so that a zero TCPTransport is usable.
+// Must be called with tt.mu held.
+func (tt *TCPTransport) getConns() map[string]*internal.FramedConn {
+	if tt.conns == nil {
+		tt.conns = make(map[string]*internal.FramedConn)
+	}
+
+	return tt.conns
+}
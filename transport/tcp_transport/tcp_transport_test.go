@@ -0,0 +1,79 @@
+package tcptransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPTransport_RoundTrip(t *testing.T) {
+	tt := NewTCPTransport()
+	defer tt.Close()
+
+	laddr, err := tt.ResolveAddr(tt.Network(), "127.0.0.1:0")
+	require.NoError(t, err)
+
+	lc, err := tt.Listen(tt.Network(), laddr)
+	require.NoError(t, err)
+	defer lc.Close()
+
+	raddr, err := tt.ResolveAddr(tt.Network(), lc.LocalAddr().String())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	messages := [][]byte{[]byte("first"), []byte("second message"), {}}
+
+	for _, m := range messages {
+		c, err := tt.Dial(ctx, nil, raddr)
+		require.NoError(t, err)
+
+		_, err = c.Write(m)
+		require.NoError(t, err)
+
+		// Close must not tear down the pooled connection.
+		require.NoError(t, c.Close())
+	}
+
+	require.Len(t, tt.conns, 1)
+
+	buf := make([]byte, 64)
+
+	for _, m := range messages {
+		n, from, err := lc.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, m, buf[:n])
+		require.True(t, from.GetIPAddr().Equal(net.IPv4(127, 0, 0, 1)))
+		require.NotZero(t, from.GetPort())
+	}
+}
+
+func TestTCPTransport_CloseUnblocksReadFrom(t *testing.T) {
+	tt := NewTCPTransport()
+
+	laddr, err := tt.ResolveAddr(tt.Network(), "127.0.0.1:0")
+	require.NoError(t, err)
+
+	lc, err := tt.Listen(tt.Network(), laddr)
+	require.NoError(t, err)
+
+	done := make(chan error)
+
+	go func() {
+		_, _, err := lc.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+
+	require.NoError(t, lc.Close())
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second * 5):
+		t.Fatal("ReadFrom was not unblocked by Close")
+	}
+}
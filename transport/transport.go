@@ -10,3 +10,17 @@ type Transport interface {
 	// Return network, udp, websockets, tcp, ipv4, etc.
 	Network() string
 }
+
+// ClusterAware is implemented by transports that can turn away peers of
+// another cluster as soon as they connect. The cluster passes its ID (a hash
+// of the cluster name) before it starts listening.
+type ClusterAware interface {
+	SetClusterID(id uint32)
+}
+
+// PacketSizeLimited is implemented by transports that can only carry packets
+// up to a certain size, such as datagram transports bound by the path MTU.
+// The cluster packs its messages to fit.
+type PacketSizeLimited interface {
+	MaxPacketSize() int
+}
@@ -8,6 +8,10 @@ import (
 	"github.com/andyollylarkin/smudge-custom-transport/transport/upd_transport/internal"
 )
 
+// MaxPacketSize is the largest datagram that is sent: small enough to fit in
+// a single Ethernet frame, over IPv4 or IPv6, without fragmentation.
+const MaxPacketSize = 1400
+
 type UDPTransport struct{}
 
 func (ut *UDPTransport) Listen(network string, addr transport.SockAddr) (transport.GenericConn, error) {
@@ -69,6 +73,10 @@ func (ut *UDPTransport) ResolveAddr(network string, addr string) (transport.Sock
 	return sa, nil
 }
 
+func (ut *UDPTransport) MaxPacketSize() int {
+	return MaxPacketSize
+}
+
 func (ut *UDPTransport) AllowMulticast() bool {
 	return true
 }
@@ -47,6 +47,26 @@ func (cs *ConnectionStore) ConnCacheRemove(addr net.Addr) bool {
 	return true
 }
 
+// ConnCacheRemoveConn remove connection from cache, unless another connection
+// has replaced it.
+func (cs *ConnectionStore) ConnCacheRemoveConn(conn *WsConnAdapter) bool {
+	h, err := extractIpFromAddr(conn.RemoteAddr())
+	if err != nil {
+		return false
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.conns[h] != conn {
+		return false
+	}
+
+	delete(cs.conns, h)
+
+	return true
+}
+
 // ConnCacheGet get connection from cache.
 func (cs *ConnectionStore) ConnCacheGet(addr net.Addr) (*WsConnAdapter, bool, error) {
 	h, err := extractIpFromAddr(addr)
@@ -21,6 +21,7 @@ type MultiplexConn struct {
 	wg            sync.WaitGroup
 	dataChan      chan readData
 	onCloseChan   chan struct{}
+	closeOnce     sync.Once
 	connChan      chan *WsConnAdapter
 	connErrorChan chan net.Addr
 	logger        smudge.Logger
@@ -43,8 +44,20 @@ func NewMuxConn(laddr transport.SockAddr, logger smudge.Logger) (*MultiplexConn,
 	return c, connErrChan
 }
 
-func (mc *MultiplexConn) HandleNewConn(conn *WsConnAdapter) {
-	mc.connChan <- conn
+// HandleNewConn starts reading from conn. It returns false if the connection
+// is closed, in which case conn isn't read from.
+func (mc *MultiplexConn) HandleNewConn(conn *WsConnAdapter) bool {
+	select {
+	case mc.connChan <- conn:
+		return true
+	case <-mc.onCloseChan:
+		return false
+	}
+}
+
+// Done returns a channel that is closed once the connection is closed.
+func (mc *MultiplexConn) Done() <-chan struct{} {
+	return mc.onCloseChan
 }
 
 func (mc *MultiplexConn) handleLoop() {
@@ -64,18 +77,25 @@ func (mc *MultiplexConn) handleRead(conn *WsConnAdapter) {
 	for {
 		n, err := conn.Read(buf)
 		if err != nil {
-			mc.connErrorChan <- conn.RemoteAddr()
+			select {
+			case mc.connErrorChan <- conn.RemoteAddr():
+			case <-mc.onCloseChan:
+			}
 
 			return
 		}
 
 		tcpaddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
 
-		mc.dataChan <- readData{
+		select {
+		case mc.dataChan <- readData{
 			readed:     n,
 			readedFrom: &WsAddr{WsAddrTCP: *tcpaddr},
 			err:        err,
 			data:       buf,
+		}:
+		case <-mc.onCloseChan:
+			return
 		}
 	}
 }
@@ -97,7 +117,9 @@ func (mc *MultiplexConn) Write(b []byte) (n int, err error) {
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (mc *MultiplexConn) Close() error {
-	close(mc.onCloseChan)
+	mc.closeOnce.Do(func() {
+		close(mc.onCloseChan)
+	})
 
 	return nil
 }
@@ -154,7 +176,13 @@ func (mc *MultiplexConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (mc *MultiplexConn) ReadFrom(b []byte) (n int, addr transport.SockAddr, error error) {
-	data := <-mc.dataChan
+	var data readData
+
+	select {
+	case data = <-mc.dataChan:
+	case <-mc.onCloseChan:
+		return 0, nil, net.ErrClosed
+	}
 
 	copy(b, data.data)
 
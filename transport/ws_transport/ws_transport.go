@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/andyollylarkin/smudge-custom-transport"
 	"github.com/andyollylarkin/smudge-custom-transport/transport"
@@ -17,6 +18,10 @@ import (
 
 const (
 	MaxLRUCacheItems int = 100
+
+	// ClusterIDHeader carries the cluster ID of the dialing node, so that
+	// connections from other clusters are refused during the upgrade.
+	ClusterIDHeader = "X-Smudge-Cluster-Id"
 )
 
 var (
@@ -31,6 +36,7 @@ type WsTransport struct {
 	wsBasePath         string
 	connChan           chan *internal.WsConnAdapter
 	logger             smudge.Logger
+	clusterID          atomic.Pointer[uint32]
 }
 
 func NewWsTransport(logger smudge.Logger, remoteWsServerPort *int, wsBasePath string) (*WsTransport, error) {
@@ -48,8 +54,21 @@ func NewWsTransport(logger smudge.Logger, remoteWsServerPort *int, wsBasePath st
 	return t, nil
 }
 
+// SetClusterID sets the cluster ID that is sent when dialing, and required of
+// connections being upgraded. The cluster calls it before it starts listening.
+func (wst *WsTransport) SetClusterID(id uint32) {
+	wst.clusterID.Store(&id)
+}
+
 // UpgageWebsocket upgrade http request to websocket connection. Pass it to web server handler.
 func (wst *WsTransport) UpgageWebsocket(w http.ResponseWriter, r *http.Request) error {
+	if id := wst.clusterID.Load(); id != nil &&
+		r.Header.Get(ClusterIDHeader) != strconv.FormatUint(uint64(*id), 10) {
+		http.Error(w, "cluster mismatch", http.StatusForbidden)
+
+		return fmt.Errorf("refused websocket connection from %s: it's from another cluster", r.RemoteAddr)
+	}
+
 	wsconn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return fmt.Errorf("cant upgrade websocket connection: %w", err)
@@ -76,7 +95,14 @@ func (wst *WsTransport) UpgageWebsocket(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	wst.connChan <- adapter
+	// Wait for a listener, should the node be restarting.
+	select {
+	case wst.connChan <- adapter:
+	case <-r.Context().Done():
+		wst.closeConn(adapter)
+
+		return r.Context().Err()
+	}
 
 	return nil
 }
@@ -87,34 +113,56 @@ func (wst *WsTransport) Listen(network string, addr transport.SockAddr) (transpo
 
 	muxConn, connErrChan := internal.NewMuxConn(addr, wst.logger)
 
-	go func() {
-		for c := range wst.connChan {
-			muxConn.HandleNewConn(c)
-		}
-	}()
-
-	go wst.connCloseMonitor(connErrChan)
-
-	// TODO: listen on close and then close all opened connections
+	go wst.serve(muxConn, connErrChan)
 
 	return muxConn, nil
 }
 
-func (wst *WsTransport) connCloseMonitor(connErrChan chan net.Addr) {
-	for addr := range connErrChan {
-		conn, ok, err := wst.cache.ConnCacheGet(addr)
-		if err != nil || !ok {
-			continue
+// serve hands new connections to muxConn, and closes the ones that fail,
+// until muxConn is closed. Then it closes the connections it handed over, so
+// that the next listener (if the node is restarted) gets them afresh.
+func (wst *WsTransport) serve(muxConn *internal.MultiplexConn, connErrChan chan net.Addr) {
+	handled := make(map[*internal.WsConnAdapter]bool)
+
+	for {
+		select {
+		case c := <-wst.connChan:
+			if !muxConn.HandleNewConn(c) {
+				// Closed in the meantime; the peer will have to reconnect.
+				wst.closeConn(c)
+				continue
+			}
+
+			handled[c] = true
+		case addr := <-connErrChan:
+			conn, ok, err := wst.cache.ConnCacheGet(addr)
+			if err != nil || !ok {
+				continue
+			}
+
+			delete(handled, conn)
+
+			conn.ActuallyClose()
+
+			wst.cache.ConnCacheRemove(addr)
+
+			wst.logger.Logf(smudge.LogDebug, "Actually close %s", conn.RemoteAddr().String())
+		case <-muxConn.Done():
+			for c := range handled {
+				wst.closeConn(c)
+			}
+
+			return
 		}
-
-		conn.ActuallyClose()
-
-		wst.cache.ConnCacheRemove(addr)
-
-		wst.logger.Logf(smudge.LogDebug, "Actually close %s", conn.RemoteAddr().String())
 	}
 }
 
+// closeConn closes conn, and forgets it.
+func (wst *WsTransport) closeConn(conn *internal.WsConnAdapter) {
+	conn.ActuallyClose()
+	wst.cache.ConnCacheRemoveConn(conn)
+}
+
 func (wst *WsTransport) Dial(ctx context.Context, laddr transport.SockAddr,
 	raddr transport.SockAddr,
 ) (transport.GenericConn, error) {
@@ -179,7 +227,13 @@ func (wst *WsTransport) Dial(ctx context.Context, laddr transport.SockAddr,
 		return nil, err
 	}
 
-	wst.connChan <- adapter
+	select {
+	case wst.connChan <- adapter:
+	case <-ctx.Done():
+		wst.closeConn(adapter)
+
+		return nil, ctx.Err()
+	}
 
 	return adapter, nil
 }
@@ -196,6 +250,10 @@ func (wst *WsTransport) getDialHeaders() (http.Header, error) {
 	header := http.Header{}
 	header.Set("X-Forwarded-For", wst.listenIp.String())
 
+	if id := wst.clusterID.Load(); id != nil {
+		header.Set(ClusterIDHeader, strconv.FormatUint(uint64(*id), 10))
+	}
+
 	return header, err
 }
 
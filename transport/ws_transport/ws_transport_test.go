@@ -0,0 +1,106 @@
+package wstransport
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andyollylarkin/smudge-custom-transport"
+	"github.com/andyollylarkin/smudge-custom-transport/transport/ws_transport/internal"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeRefusesOtherCluster(t *testing.T) {
+	wst, err := NewWsTransport(smudge.DefaultLogger{}, nil, "")
+	require.NoError(t, err)
+	wst.SetClusterID(42)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wst.UpgageWebsocket(w, r)
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + WebsocketRoutePath
+
+	for _, header := range []http.Header{
+		{},
+		{ClusterIDHeader: []string{"43"}},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(url, header)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestListenAfterRestart(t *testing.T) {
+	wst, err := NewWsTransport(smudge.DefaultLogger{}, nil, "")
+	require.NoError(t, err)
+
+	addr, err := wst.ResolveAddr(wst.Network(), "127.0.0.1:9999")
+	require.NoError(t, err)
+
+	goroutines := runtime.NumGoroutine()
+
+	// The node is stopped, and then started again. Nothing is left of the
+	// first listener.
+	first, err := wst.Listen(wst.Network(), addr)
+	require.NoError(t, err)
+	require.NoError(t, first.Close())
+
+	// Polled here, as require.Eventually runs goroutines of its own.
+	for deadline := time.Now().Add(time.Second * 5); runtime.NumGoroutine() > goroutines; {
+		require.True(t, time.Now().Before(deadline), "first listener's goroutines still running")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wst.UpgageWebsocket(w, r)
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + WebsocketRoutePath
+
+	second, err := wst.Listen(wst.Network(), addr)
+	require.NoError(t, err)
+	defer second.Close()
+
+	mux := second.(*internal.MultiplexConn)
+
+	received := make(chan string)
+	go func() {
+		buf := make([]byte, smudge.ReadBufSize)
+		for {
+			n, _, err := mux.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			received <- string(buf[:n])
+		}
+	}()
+
+	// Every new connection goes to the second listener.
+	for i := 1; i <= 10; i++ {
+		header := http.Header{"X-Forwarded-For": []string{fmt.Sprintf("10.0.0.%d, 127.0.0.1", i)}}
+		message := fmt.Sprintf("hello from peer %d", i)
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+
+		select {
+		case m := <-received:
+			require.Equal(t, message, m)
+		case <-time.After(time.Second):
+			t.Fatalf("message from peer %d not received", i)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+)
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// SendTo sends payload straight to node, over the configured transport, as a
+// USER message. The receiving node passes it to its message listeners, along
+// with this node as the sender. Like any other message, it may be lost: SendTo
+// only reports whether it could be sent. The payload must fit in a single
+// packet, along with the message header; for UDP, that's a little over a
+// kilobyte.
+func (c *Cluster) SendTo(node *Node, payload []byte) error {
+	if node == nil {
+		return errors.New("cannot send to a nil node")
+	}
+
+	if !c.isRunning() {
+		return errors.New("node not started")
+	}
+
+	return c.transmitPayload(node, verbUser, payload)
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// transmitPayload sends a message with a payload section (see
+// messageVerb.hasPayload) to node, if it fits in a packet.
+func (c *Cluster) transmitPayload(node *Node, verb messageVerb, payload []byte) error {
+	msg := newMessage(verb, c.thisHost, c.currentHeartbeat.Load())
+	msg.payload = payload
+
+	if max := c.maxMessageBytes(); len(payload) > 0xFFFF || msg.encodedSize(c.ipLen) > max {
+		return fmt.Errorf("message payload of %d bytes doesn't fit in a packet of %d bytes",
+			len(payload), max)
+	}
+
+	return c.transmitMessage(node, &msg)
+}
+
+// receiveVerbUser passes the payload of a USER message to the message
+// listeners.
+func (c *Cluster) receiveVerbUser(msg message) error {
+	logfDebug("Received a %d byte message from %s", len(msg.payload), msg.sender.Address())
+
+	c.doMessageUpdate(msg.sender, msg.payload)
+
+	return nil
+}